@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"go-open-p2p/op"
+	"log"
+
+	"github.com/fasthttp/websocket"
+	"github.com/google/uuid"
+)
+
+// 命令错误代码, 同 JSON-RPC 2.0
+const (
+	feedErrorParse          = -32700
+	feedErrorMethodNotFound = -32601
+	feedErrorInvalidParams  = -32602
+	feedErrorServer         = -32000
+	feedErrorTooMany        = -32029
+)
+
+// WebSocket订阅客户端
+type wsClient struct {
+	conn *websocket.Conn
+	ip   string
+	// 订阅的回调名称, 为nil表示全部
+	callbacks map[string]bool
+}
+
+// 订阅请求
+//
+//	{"callbacks": ["OnOpConnState", "OnOpTextReceiveDone"]}
+//
+// callbacks 为空或者请求不是JSON时订阅全部回调
+type feedSubscribe struct {
+	Callbacks []string `json:"callbacks"`
+}
+
+// 命令请求, 对方通过相同的 id 对应响应
+//
+//	{"id": 1, "method": "sendText", "params": {"id": "节点标识", "text": "你好"}}
+type feedRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// 命令响应, 与回调推送的区别是带有 id
+type feedResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *feedError      `json:"error,omitempty"`
+}
+
+type feedError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// 设置订阅的回调
+func (client *wsClient) subscribe(data []byte) {
+	var r feedSubscribe
+	e := json.Unmarshal(data, &r)
+	var callbacks map[string]bool
+	if e == nil && len(r.Callbacks) != 0 {
+		callbacks = make(map[string]bool)
+		for _, v := range r.Callbacks {
+			callbacks[v] = true
+		}
+	}
+	sm.Lock()
+	client.callbacks = callbacks
+	sm.Unlock()
+}
+
+// 是否订阅了回调, 需要在锁中调用
+func (client *wsClient) subscribed(c string) bool {
+	return client.callbacks == nil || client.callbacks[c]
+}
+
+// 处理命令请求并响应
+func (client *wsClient) handle(data []byte) {
+	var r feedRequest
+	response := feedResponse{}
+	e := json.Unmarshal(data, &r)
+	if e != nil || r.Method == "" {
+		response.Error = &feedError{Code: feedErrorParse, Message: "请求格式错误"}
+	} else {
+		response.ID = r.ID
+		response.Result, response.Error = client.call(r.Method, r.Params)
+	}
+	if response.Error == nil && response.Result == nil {
+		response.Result = true
+	}
+
+	jsonBytes, e := json.Marshal(response)
+	if e != nil {
+		log.Println("命令响应转JSON出错", e)
+		return
+	}
+	sm.Lock()
+	e = client.conn.WriteMessage(websocket.TextMessage, jsonBytes)
+	sm.Unlock()
+	if e != nil {
+		log.Println("命令响应出错", e)
+	}
+}
+
+// 命令参数
+type feedParams struct {
+	UUID       string   `json:"uuid"`
+	ID         string   `json:"id"`
+	Text       string   `json:"text"`
+	Path       string   `json:"path"`
+	IdArray    []string `json:"idArray"`
+	Before     int64    `json:"before"`
+	BeforeUUID string   `json:"beforeUUID"`
+	Limit      int64    `json:"limit"`
+	Callbacks  []string `json:"callbacks"`
+}
+
+// 执行命令
+func (client *wsClient) call(method string, params json.RawMessage) (interface{}, *feedError) {
+	var p feedParams
+	if len(params) != 0 {
+		e := json.Unmarshal(params, &p)
+		if e != nil {
+			return nil, &feedError{Code: feedErrorInvalidParams, Message: e.Error()}
+		}
+	}
+	invalid := func(message string) (interface{}, *feedError) {
+		return nil, &feedError{Code: feedErrorInvalidParams, Message: message}
+	}
+	result := func(v interface{}, e error) (interface{}, *feedError) {
+		if e != nil {
+			return nil, &feedError{Code: feedErrorServer, Message: e.Error()}
+		}
+		return v, nil
+	}
+	// JSON文本结果原样返回
+	jsonResult := func(jt string, e error) (interface{}, *feedError) {
+		return result(json.RawMessage(jt), e)
+	}
+
+	// 与HTTP接口相同, 发送命令需要限流. 没有设置 uuid 时生成, 通过结果返回
+	switch method {
+	case "sendText", "sendFile", "sendDir", "queueText", "queueFile":
+		if !httpSensitiveLimiter.allow(client.ip) {
+			return nil, &feedError{Code: feedErrorTooMany, Message: "请求过多"}
+		}
+		if p.UUID == "" {
+			p.UUID = uuid.New().String()
+		}
+	}
+
+	switch method {
+	case "subscribe":
+		data, _ := json.Marshal(feedSubscribe{Callbacks: p.Callbacks})
+		client.subscribe(data)
+		return nil, nil
+	case "state":
+		sm.Lock()
+		id := opID
+		sm.Unlock()
+		return map[string]interface{}{"id": id, "running": id != ""}, nil
+	case "sendText":
+		if p.ID == "" || p.Text == "" {
+			return invalid("需要 id 和 text")
+		}
+		op.TextSend(p.UUID, p.ID, p.Text)
+		return p.UUID, nil
+	case "sendFile":
+		if p.ID == "" || p.Path == "" {
+			return invalid("需要 id 和 path")
+		}
+		op.FileSend(p.UUID, p.ID, p.Path)
+		return p.UUID, nil
+	case "sendDir":
+		if p.ID == "" || p.Path == "" {
+			return invalid("需要 id 和 path")
+		}
+		op.DirSend(p.UUID, p.ID, p.Path)
+		return p.UUID, nil
+	case "queueText":
+		if p.ID == "" || p.Text == "" {
+			return invalid("需要 id 和 text")
+		}
+		return result(p.UUID, op.QueueTextSend(p.UUID, p.ID, p.Text))
+	case "queueFile":
+		if p.ID == "" || p.Path == "" {
+			return invalid("需要 id 和 path")
+		}
+		return result(p.UUID, op.QueueFileSend(p.UUID, p.ID, p.Path))
+	case "cancel":
+		if p.UUID == "" {
+			return invalid("需要 uuid")
+		}
+		return result(nil, op.SendCancel(p.UUID))
+	case "setContacts":
+		data, e := json.Marshal(p.IdArray)
+		if e != nil {
+			return result(nil, e)
+		}
+		return result(nil, op.ConnStateCheckSet(string(data)))
+	case "connList":
+		if p.ID == "" {
+			return invalid("需要 id")
+		}
+		return jsonResult(op.ConnList(p.ID))
+	case "queueList":
+		return jsonResult(op.QueueList())
+	case "history":
+		if p.ID == "" {
+			return invalid("需要 id")
+		}
+		return jsonResult(op.HistoryQuery(p.ID, p.Before, p.BeforeUUID, p.Limit))
+	case "markRead":
+		if p.ID == "" || p.UUID == "" {
+			return invalid("需要 id 和 uuid")
+		}
+		return result(nil, op.TextMarkRead(p.ID, p.UUID))
+	}
+	return nil, &feedError{Code: feedErrorMethodNotFound, Message: "未知命令: " + method}
+}
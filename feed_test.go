@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// 连接测试HTTP服务的 /feed
+func testFeedDial(ln *fasthttputil.InmemoryListener, query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	return dialer.Dial("ws://test/feed"+query, header)
+}
+
+// 发送命令并读取响应
+func testFeedCall(t *testing.T, conn *websocket.Conn, request string) feedResponse {
+	e := conn.WriteMessage(websocket.TextMessage, []byte(request))
+	if e != nil {
+		t.Fatal(e)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, data, e := conn.ReadMessage()
+	if e != nil {
+		t.Fatal(e)
+	}
+	var response feedResponse
+	e = json.Unmarshal(data, &response)
+	if e != nil {
+		t.Fatal(e, string(data))
+	}
+	return response
+}
+
+func TestFeedAuth(t *testing.T) {
+	ln := startTestHTTP(t)
+
+	_, res, e := testFeedDial(ln, "", nil)
+	if e == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("没有令牌时没有拒绝", e)
+	}
+	header := http.Header{}
+	header.Set("Origin", "http://evil.example")
+	_, res, e = testFeedDial(ln, "?token="+testHTTPToken, header)
+	if e == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatal("没有拒绝未设置的来源", e)
+	}
+}
+
+func TestFeedCall(t *testing.T) {
+	ln := startTestHTTP(t)
+	header := http.Header{}
+	header.Set("Origin", testHTTPOrigin)
+	conn, _, e := testFeedDial(ln, "?token="+testHTTPToken, header)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 第一条消息是命令时也执行
+	response := testFeedCall(t, conn, `{"id":1,"method":"state"}`)
+	var state map[string]interface{}
+	data, _ := json.Marshal(response.Result)
+	_ = json.Unmarshal(data, &state)
+	if string(response.ID) != "1" || response.Error != nil || state["running"] != false {
+		t.Fatal("状态命令错误", response)
+	}
+
+	response = testFeedCall(t, conn, `{"id":"a","method":"subscribe","params":{"callbacks":["OnOpState"]}}`)
+	if string(response.ID) != `"a"` || response.Result != true {
+		t.Fatal("订阅命令错误", response)
+	}
+
+	for _, item := range []struct {
+		request string
+		code    int
+	}{
+		{`不是JSON`, feedErrorParse},
+		{`{"id":2}`, feedErrorParse},
+		{`{"id":3,"method":"unknown"}`, feedErrorMethodNotFound},
+		{`{"id":4,"method":"sendText","params":{"id":"节点"}}`, feedErrorInvalidParams},
+		{`{"id":5,"method":"history","params":"不是对象"}`, feedErrorInvalidParams},
+		{`{"id":6,"method":"cancel","params":{}}`, feedErrorInvalidParams},
+		// 节点标识无效
+		{`{"id":7,"method":"history","params":{"id":"节点"}}`, feedErrorServer},
+	} {
+		response = testFeedCall(t, conn, item.request)
+		if response.Error == nil || response.Error.Code != item.code {
+			t.Fatal("命令错误代码错误", item.request, response.Error)
+		}
+	}
+
+	// 发送命令限流
+	httpSensitiveLimiter = newHTTPLimiter(1, 0)
+	response = testFeedCall(t, conn, `{"id":8,"method":"sendText","params":{"id":"节点"}}`)
+	if response.Error == nil || response.Error.Code != feedErrorInvalidParams {
+		t.Fatal("没有达到限制时拒绝", response.Error)
+	}
+	response = testFeedCall(t, conn, `{"id":9,"method":"sendText","params":{"id":"节点"}}`)
+	if response.Error == nil || response.Error.Code != feedErrorTooMany {
+		t.Fatal("超过限制时没有拒绝", response.Error)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HTTP令牌, 每个请求都需要通过 Authorization: Bearer 令牌 或者 token 参数(用于WebSocket)提供
+var httpToken string
+
+// 允许跨域访问的来源
+var httpAllowedOrigins = make(map[string]bool)
+
+// 加载HTTP令牌, 没有时生成并保存到私有文件夹
+func httpTokenLoad(privateDir string) (string, error) {
+	tokenPath := filepath.Join(privateDir, "http.token")
+	data, e := os.ReadFile(tokenPath)
+	if e == nil && len(strings.TrimSpace(string(data))) != 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if e != nil && !os.IsNotExist(e) {
+		return "", e
+	}
+
+	b := make([]byte, 32)
+	_, e = rand.Read(b)
+	if e != nil {
+		return "", e
+	}
+	token := hex.EncodeToString(b)
+	e = os.WriteFile(tokenPath, []byte(token), 0600)
+	if e != nil {
+		return "", e
+	}
+	return token, nil
+}
+
+// 设置允许跨域访问的来源, 逗号分隔
+func httpAllowedOriginsSet(text string) {
+	for _, v := range strings.Split(text, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			httpAllowedOrigins[v] = true
+		}
+	}
+}
+
+// 来源是否允许, 没有来源(非浏览器)时允许
+func httpOriginOk(origin string) bool {
+	return origin == "" || httpAllowedOrigins[origin]
+}
+
+// 检查令牌
+func httpTokenOk(ctx *fasthttp.RequestCtx) bool {
+	token := string(ctx.Request.Header.Peek("Authorization"))
+	if strings.HasPrefix(token, "Bearer ") {
+		token = strings.TrimPrefix(token, "Bearer ")
+	} else {
+		token = string(ctx.QueryArgs().Peek("token"))
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(httpToken)) == 1
+}
+
+// 令牌桶限流, 键为客户端地址
+type httpLimiter struct {
+	mutex  sync.Mutex
+	burst  float64
+	rate   float64
+	bucket map[string]*httpBucket
+}
+
+type httpBucket struct {
+	tokens float64
+	time   time.Time
+}
+
+// burst 最多连续请求数量, rate 每秒恢复数量
+func newHTTPLimiter(burst, rate float64) *httpLimiter {
+	return &httpLimiter{burst: burst, rate: rate, bucket: make(map[string]*httpBucket)}
+}
+
+// 是否允许请求, 允许时消耗一次
+func (l *httpLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b := l.refill(key)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 是否还有剩余次数, 不消耗
+func (l *httpLimiter) remain(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.refill(key).tokens >= 1
+}
+
+// 恢复桶中的次数, 需要在锁中调用
+func (l *httpLimiter) refill(key string) *httpBucket {
+	now := time.Now()
+	b, ok := l.bucket[key]
+	if !ok {
+		// 防止占用过多内存, 清理已经恢复满的桶
+		if len(l.bucket) > 1024 {
+			for k, v := range l.bucket {
+				if v.tokens+now.Sub(v.time).Seconds()*l.rate >= l.burst {
+					delete(l.bucket, k)
+				}
+			}
+		}
+		b = &httpBucket{tokens: l.burst, time: now}
+		l.bucket[key] = b
+	}
+	b.tokens += now.Sub(b.time).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.time = now
+	return b
+}
+
+// 敏感接口限流, 除了 httpUnlimitedPaths 中的接口都需要限流
+var httpSensitiveLimiter = newHTTPLimiter(20, 2)
+
+// 令牌错误限流, 防止猜测令牌
+var httpAuthLimiter = newHTTPLimiter(5, 0.2)
+
+// 不限流的接口, 只读取状态或者记录, 界面会频繁调用. 其他接口都可以读取文件, 修改设置或者向其他节点发送内容, 默认限流
+//
+// /feed 连接本身不限流, 其中的发送命令单独限流
+var httpUnlimitedPaths = map[string]bool{
+	"/":             true,
+	"/feed":         true,
+	"/queue/list":   true,
+	"/history":      true,
+	"/receive/read": true,
+	"/conn/list":    true,
+	"/relay/stats":  true,
+	"/trust/list":   true,
+	"/metrics":      true,
+	"/check/id":     true,
+}
+
+// 检查来源, 令牌和限流, 不通过时设置状态码并返回false
+func httpAuth(ctx *fasthttp.RequestCtx) bool {
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if !httpOriginOk(origin) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		return false
+	}
+	if origin != "" {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+		ctx.Response.Header.Set("Vary", "Origin")
+	}
+
+	// 预检请求不带令牌
+	if string(ctx.Method()) == "OPTIONS" {
+		return false
+	}
+
+	// 令牌错误次数过多时暂时拒绝所有请求
+	clientIP := ctx.RemoteIP().String()
+	if !httpAuthLimiter.remain(clientIP) {
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		return false
+	}
+	if !httpTokenOk(ctx) {
+		httpAuthLimiter.allow(clientIP)
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return false
+	}
+
+	if !httpUnlimitedPaths[string(ctx.Path())] && !httpSensitiveLimiter.allow(clientIP) {
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+const (
+	testHTTPToken  = "test-token"
+	testHTTPOrigin = "http://localhost:3000"
+)
+
+// 使用内存连接启动测试HTTP服务, 重置令牌, 来源和限流
+func startTestHTTP(t *testing.T) *fasthttputil.InmemoryListener {
+	httpToken = testHTTPToken
+	httpAllowedOrigins = map[string]bool{testHTTPOrigin: true}
+	httpSensitiveLimiter = newHTTPLimiter(20, 2)
+	httpAuthLimiter = newHTTPLimiter(5, 0.2)
+	publicDir = t.TempDir()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := newHTTPServer()
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	return ln
+}
+
+// 带有令牌的测试请求
+func testHTTPRequest(uri string) *fasthttp.Request {
+	req := fasthttp.AcquireRequest()
+	req.SetRequestURI("http://test" + uri)
+	req.Header.Set("Authorization", "Bearer "+testHTTPToken)
+	return req
+}
+
+// 发送测试请求
+func testHTTPDo(t *testing.T, ln *fasthttputil.InmemoryListener, req *fasthttp.Request) *fasthttp.Response {
+	c := &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+	res := fasthttp.AcquireResponse()
+	e := c.Do(req, res)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return res
+}
+
+func TestHTTPAuthToken(t *testing.T) {
+	ln := startTestHTTP(t)
+
+	req := testHTTPRequest("/")
+	req.Header.Del("Authorization")
+	if res := testHTTPDo(t, ln, req); res.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatal("没有令牌时没有拒绝", res.StatusCode())
+	}
+	req = testHTTPRequest("/")
+	req.Header.Set("Authorization", "Bearer "+testHTTPToken+"x")
+	if res := testHTTPDo(t, ln, req); res.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatal("令牌错误时没有拒绝", res.StatusCode())
+	}
+
+	// 节点没有启动, 通过检查后返回不可用
+	if res := testHTTPDo(t, ln, testHTTPRequest("/")); res.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatal("请求头中的令牌没有通过", res.StatusCode())
+	}
+	req = testHTTPRequest("/?token=" + testHTTPToken)
+	req.Header.Del("Authorization")
+	if res := testHTTPDo(t, ln, req); res.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatal("参数中的令牌没有通过", res.StatusCode())
+	}
+}
+
+func TestHTTPAuthOrigin(t *testing.T) {
+	ln := startTestHTTP(t)
+
+	req := testHTTPRequest("/")
+	req.Header.Set("Origin", "http://evil.example")
+	if res := testHTTPDo(t, ln, req); res.StatusCode() != fasthttp.StatusForbidden || len(res.Header.Peek("Access-Control-Allow-Origin")) != 0 {
+		t.Fatal("没有拒绝未设置的来源", res.StatusCode())
+	}
+
+	req = testHTTPRequest("/")
+	req.Header.Set("Origin", testHTTPOrigin)
+	res := testHTTPDo(t, ln, req)
+	if res.StatusCode() != fasthttp.StatusServiceUnavailable || string(res.Header.Peek("Access-Control-Allow-Origin")) != testHTTPOrigin {
+		t.Fatal("没有允许设置的来源", res.StatusCode(), string(res.Header.Peek("Access-Control-Allow-Origin")))
+	}
+
+	// 预检请求不带令牌
+	req = testHTTPRequest("/send/text")
+	req.Header.Del("Authorization")
+	req.Header.SetMethod("OPTIONS")
+	req.Header.Set("Origin", testHTTPOrigin)
+	res = testHTTPDo(t, ln, req)
+	if res.StatusCode() != fasthttp.StatusOK || string(res.Header.Peek("Access-Control-Allow-Origin")) != testHTTPOrigin {
+		t.Fatal("预检请求错误", res.StatusCode())
+	}
+}
+
+func TestHTTPAuthLimit(t *testing.T) {
+	ln := startTestHTTP(t)
+
+	// 没有列出的接口默认限流, 参数错误也消耗次数
+	for i := 0; i < 20; i++ {
+		if res := testHTTPDo(t, ln, testHTTPRequest("/peer/forget")); res.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatal("没有达到限制时拒绝", i, res.StatusCode())
+		}
+	}
+	for _, uri := range []string{"/peer/forget", "/download?path=a.txt", "/trust/mode?mode=open", "/qrcode?text=a"} {
+		if res := testHTTPDo(t, ln, testHTTPRequest(uri)); res.StatusCode() != fasthttp.StatusTooManyRequests {
+			t.Fatal("超过限制时没有拒绝", uri, res.StatusCode())
+		}
+	}
+	if res := testHTTPDo(t, ln, testHTTPRequest("/")); res.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatal("不限流的接口被拒绝", res.StatusCode())
+	}
+
+	// 令牌错误次数过多时拒绝所有请求
+	for i := 0; i < 5; i++ {
+		req := testHTTPRequest("/")
+		req.Header.Set("Authorization", "Bearer x")
+		if res := testHTTPDo(t, ln, req); res.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Fatal("令牌错误时没有拒绝", i, res.StatusCode())
+		}
+	}
+	if res := testHTTPDo(t, ln, testHTTPRequest("/")); res.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Fatal("令牌错误次数过多时没有拒绝", res.StatusCode())
+	}
+}
@@ -1,25 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go-open-p2p/op"
 	"go-open-p2p/qc"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fasthttp/websocket"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
 
 type CallbackImpl struct {
@@ -42,11 +49,11 @@ var wsUpgrader = websocket.FastHTTPUpgrader{
 	WriteBufferSize: 1024,
 	//跨域
 	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
-		return true
+		return httpOriginOk(string(ctx.Request.Header.Peek("Origin")))
 	},
 }
 
-var wsConnMap = make(map[string]*websocket.Conn)
+var wsConnMap = make(map[string]*wsClient)
 
 // 节点ID
 var opID string
@@ -58,13 +65,27 @@ func main() {
 	privateFlag := flag.String("private", "/home/m/lilu-ne/private", "private dir")
 	publicFlag := flag.String("public", "/home/m/lilu-ne/public", "public dir")
 	httpPortFlag := flag.Int64("http", 0, "http service port")
+	httpBindFlag := flag.String("bind", "127.0.0.1", "http service bind address")
+	httpOriginsFlag := flag.String("origins", "", "http service allowed origins, comma separated, e.g. http://localhost:3000")
+	optionsFlag := flag.String("options", "", `p2p options json, e.g. {"port":4001,"transports":["tcp","quic"]}`)
+	modeFlag := flag.String("mode", "", "run mode: empty for normal node, relay for relay and bootstrap server")
+	swarmKeyFlag := flag.Bool("swarm-key", false, "print a new private network key (swarm.key) and exit")
 	flag.Parse()
 
+	if *swarmKeyFlag {
+		key, e := op.PrivateNetworkKeyGenerate()
+		if e != nil {
+			log.Fatalln("生成私有网络密钥出错", e)
+		}
+		fmt.Print(key)
+		return
+	}
+
 	if *privateFlag == "" || *publicFlag == "" {
 		log.Fatalln("没有设置文件夹")
 	}
 
-	e := os.MkdirAll(*privateFlag, os.ModePerm)
+	e := os.MkdirAll(*privateFlag, 0700)
 	if e != nil {
 		log.Fatalln("创建私有文件夹出错", e)
 	}
@@ -74,8 +95,19 @@ func main() {
 		log.Fatalln("创建公共文件夹出错", e)
 	}
 
+	// 密钥密码通过环境变量设置, 避免出现在命令行中
+	passphrase := os.Getenv("OP_PASSPHRASE")
+
 	go func() {
-		e := op.Start(*privateFlag, *publicFlag, CallbackImpl{})
+		var e error
+		switch *modeFlag {
+		case op.ModeNormal:
+			e = op.StartWithOptions(*privateFlag, *publicFlag, passphrase, *optionsFlag, CallbackImpl{})
+		case op.ModeRelay:
+			e = op.StartRelay(*privateFlag, *publicFlag, passphrase, *optionsFlag, CallbackImpl{})
+		default:
+			e = fmt.Errorf("不支持的运行模式: %s", *modeFlag)
+		}
 		if e != nil {
 			startErrorChan <- e
 		}
@@ -83,9 +115,15 @@ func main() {
 
 	httpPort := *httpPortFlag
 	if httpPort != 0 {
+		httpToken, e = httpTokenLoad(*privateFlag)
+		if e != nil {
+			log.Fatalln("加载HTTP令牌出错", e)
+		}
+		log.Println("HTTP令牌保存在", filepath.Join(*privateFlag, "http.token"))
+		httpAllowedOriginsSet(*httpOriginsFlag)
 		go func() {
-			log.Println("开始启动HTTP服务:", httpPort)
-			e := startHTTP(httpPort)
+			log.Println("开始启动HTTP服务:", *httpBindFlag, httpPort)
+			e := startHTTP(*httpBindFlag, httpPort)
 			if e != nil {
 				startErrorChan <- e
 			}
@@ -155,10 +193,10 @@ func (impl CallbackImpl) OnOpMDNSPeer(id string) {
 	wsPush("OnOpMDNSPeer", id)
 }
 
-func (impl CallbackImpl) OnOpConnState(id string, isConn bool) {
-	//log.Println("回调节点连接状态变化", id, isConn)
+func (impl CallbackImpl) OnOpConnState(id string, isConn bool, reason string) {
+	log.Println("回调节点连接状态变化", id, isConn, reason)
 
-	m := map[string]interface{}{"id": id, "conn": isConn}
+	m := map[string]interface{}{"id": id, "conn": isConn, "reason": reason}
 	jsonBytes, e := json.Marshal(m)
 	if e != nil {
 		log.Println("节点连接状态变化数据转JSON出错", e)
@@ -196,10 +234,52 @@ func (impl CallbackImpl) OnOpTextSendDone(uuid string) {
 	}
 }
 
-func (impl CallbackImpl) OnOpTextReceiveDone(id, text string) {
-	log.Println("回调文本接收完毕", id, text)
+func (impl CallbackImpl) OnOpTextSendCancel(uuid string) {
+	log.Println("回调文本发送取消", uuid)
 
-	m := map[string]interface{}{"id": id, "text": text}
+	m := map[string]interface{}{
+		"uuid": uuid,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpTextSendCancel", string(jsonBytes))
+	}
+}
+
+func (impl CallbackImpl) OnOpTextDelivered(uuid string) {
+	log.Println("回调文本已经送达", uuid)
+
+	m := map[string]interface{}{
+		"uuid": uuid,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpTextDelivered", string(jsonBytes))
+	}
+}
+
+func (impl CallbackImpl) OnOpTextRead(uuid string) {
+	log.Println("回调文本已读", uuid)
+
+	m := map[string]interface{}{
+		"uuid": uuid,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpTextRead", string(jsonBytes))
+	}
+}
+
+func (impl CallbackImpl) OnOpTextReceiveDone(id, text, uuid string) {
+	log.Println("回调文本接收完毕", id, text, uuid)
+
+	m := map[string]interface{}{"id": id, "text": text, "uuid": uuid}
 	jsonBytes, e := json.Marshal(m)
 	if e != nil {
 		log.Println("文本接收完毕数据转JSON出错", e)
@@ -223,13 +303,16 @@ func (impl CallbackImpl) OnOpFileSendError(uuid, et string) {
 	}
 }
 
-func (impl CallbackImpl) OnOpFileSendProgress(uuid string, fileSize, sendSize int64) {
-	log.Println("回调文件发送进度", uuid, fileSize, sendSize)
+func (impl CallbackImpl) OnOpFileSendProgress(uuid string, fileSize, sendSize, speed, averageSpeed, etaSecond int64) {
+	log.Println("回调文件发送进度", uuid, fileSize, sendSize, speed, averageSpeed, etaSecond)
 
 	m := map[string]interface{}{
-		"uuid":     uuid,
-		"fileSize": fileSize,
-		"sendSize": sendSize,
+		"uuid":         uuid,
+		"fileSize":     fileSize,
+		"sendSize":     sendSize,
+		"speed":        speed,
+		"averageSpeed": averageSpeed,
+		"etaSecond":    etaSecond,
 	}
 	jsonBytes, e := json.Marshal(m)
 	if e != nil {
@@ -254,6 +337,38 @@ func (impl CallbackImpl) OnOpFileSendDone(uuid, fileHash string) {
 	}
 }
 
+func (impl CallbackImpl) OnOpFileSendCancel(uuid string) {
+	log.Println("回调文件发送取消", uuid)
+
+	m := map[string]interface{}{
+		"uuid": uuid,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpFileSendCancel", string(jsonBytes))
+	}
+}
+
+func (impl CallbackImpl) OnOpFileReceiveOffer(id, fileHash, fileName, uuid string, fileSize int64) {
+	log.Println("回调收到文件", id, fileHash, fileName, uuid, fileSize)
+
+	m := map[string]interface{}{
+		"id":       id,
+		"fileHash": fileHash,
+		"fileName": fileName,
+		"uuid":     uuid,
+		"fileSize": fileSize,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpFileReceiveOffer", string(jsonBytes))
+	}
+}
+
 func (impl CallbackImpl) OnOpFileReceiveStart(id, fileHash, fileName, uuid string, fileSize int64) {
 	log.Println("回调文件接收开始", id, fileHash, fileName, uuid, fileSize)
 
@@ -287,13 +402,16 @@ func (impl CallbackImpl) OnOpFileReceiveError(uuid, et string) {
 	}
 }
 
-func (impl CallbackImpl) OnOpFileReceiveProgress(uuid string, fileSize, receiveSize int64) {
-	log.Println("回调文件接收进度", uuid, fileSize, receiveSize)
+func (impl CallbackImpl) OnOpFileReceiveProgress(uuid string, fileSize, receiveSize, speed, averageSpeed, etaSecond int64) {
+	log.Println("回调文件接收进度", uuid, fileSize, receiveSize, speed, averageSpeed, etaSecond)
 
 	m := map[string]interface{}{
-		"uuid":        uuid,
-		"fileSize":    fileSize,
-		"receiveSize": receiveSize,
+		"uuid":         uuid,
+		"fileSize":     fileSize,
+		"receiveSize":  receiveSize,
+		"speed":        speed,
+		"averageSpeed": averageSpeed,
+		"etaSecond":    etaSecond,
 	}
 	jsonBytes, e := json.Marshal(m)
 	if e != nil {
@@ -318,20 +436,52 @@ func (impl CallbackImpl) OnOpFileReceiveDone(uuid, filePath string) {
 	}
 }
 
+func (impl CallbackImpl) OnOpFileReceiveCancel(uuid string) {
+	log.Println("回调文件接收取消", uuid)
+
+	m := map[string]interface{}{
+		"uuid": uuid,
+	}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println(e)
+	} else {
+		wsPush("OnOpFileReceiveCancel", string(jsonBytes))
+	}
+}
+
+func (impl CallbackImpl) OnOpQueueChanged(jt string) {
+	log.Println("回调发送队列变化", jt)
+
+	wsPush("OnOpQueueChanged", jt)
+}
+
+func (impl CallbackImpl) OnOpPeerReject(id, protocol string) {
+	log.Println("回调拒绝节点", id, protocol)
+
+	m := map[string]interface{}{"id": id, "protocol": protocol}
+	jsonBytes, e := json.Marshal(m)
+	if e != nil {
+		log.Println("拒绝节点数据转JSON出错", e)
+	} else {
+		wsPush("OnOpPeerReject", string(jsonBytes))
+	}
+}
+
 // 更新WebSocket连接
 //
-// conn 设为nil表示删除并关闭连接
-func wsConnUpdate(id string, conn *websocket.Conn) {
+// client 设为nil表示删除并关闭连接
+func wsConnUpdate(id string, client *wsClient) {
 	sm.Lock()
-	oldConn, connExists := wsConnMap[id]
+	oldClient, connExists := wsConnMap[id]
 	if connExists {
 		log.Println("关闭WebSocket连接", id)
-		_ = oldConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "服务主动关闭"))
-		_ = oldConn.Close()
+		_ = oldClient.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "服务主动关闭"))
+		_ = oldClient.conn.Close()
 		delete(wsConnMap, id)
 	}
-	if conn != nil {
-		wsConnMap[id] = conn
+	if client != nil {
+		wsConnMap[id] = client
 	}
 	sm.Unlock()
 }
@@ -343,10 +493,13 @@ func wsPush(c, t string) {
 	//log.Println("ws推送", string(jsonBytes))
 
 	sm.Lock()
-	for _, conn := range wsConnMap {
+	for _, client := range wsConnMap {
 		//log.Println("推送ws", id)
 
-		_ = conn.WriteMessage(websocket.TextMessage, jsonBytes)
+		if !client.subscribed(c) {
+			continue
+		}
+		_ = client.conn.WriteMessage(websocket.TextMessage, jsonBytes)
 		//if e != nil {
 		//	log.Println("推送ws失败", id, c, e)
 		//} else {
@@ -356,16 +509,29 @@ func wsPush(c, t string) {
 	sm.Unlock()
 }
 
-func startHTTP(p int64) error {
+func startHTTP(bind string, p int64) error {
+	return newHTTPServer().ListenAndServe(net.JoinHostPort(bind, strconv.FormatInt(p, 10)))
+}
+
+// 创建HTTP服务, 需要在设置公共文件夹之后调用
+func newHTTPServer() *fasthttp.Server {
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	// 只提供公共文件夹中的文件, 支持Range
+	downloadHandler := (&fasthttp.FS{
+		Root:            publicDir,
+		AcceptByteRange: true,
+		PathRewrite: func(ctx *fasthttp.RequestCtx) []byte {
+			return []byte(downloadPath(ctx))
+		},
+	}).NewRequestHandler()
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
-		//CORS
-		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		//CORS, 只允许设置的来源
 		ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, DELETE")
 		ctx.Response.Header.Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
 		ctx.Response.Header.Set("Access-Control-Expose-Headers", "x-name, x-size")
 
-		//防止客户端发送OPTIONS时报错
-		if string(ctx.Method()) == "OPTIONS" {
+		//检查来源和令牌, OPTIONS也在这里返回
+		if !httpAuth(ctx) {
 			return
 		}
 
@@ -382,8 +548,68 @@ func startHTTP(p int64) error {
 			httpHandlerTextSend(ctx)
 		case "/send/file":
 			httpHandlerFileSend(ctx)
+		case "/send/dir":
+			httpHandlerDirSend(ctx)
+		case "/send/upload":
+			httpHandlerUploadSend(ctx)
+		case "/download":
+			httpHandlerDownload(ctx, downloadHandler)
+		case "/send/cancel":
+			httpHandlerSendCancel(ctx)
+		case "/queue/text":
+			httpHandlerQueueTextSend(ctx)
+		case "/queue/file":
+			httpHandlerQueueFileSend(ctx)
+		case "/queue/list":
+			httpHandlerQueueList(ctx)
+		case "/history":
+			httpHandlerHistoryQuery(ctx)
+		case "/receive/read":
+			httpHandlerTextMarkRead(ctx)
+		case "/receive/accept":
+			httpHandlerFileReceiveAccept(ctx)
+		case "/receive/reject":
+			httpHandlerFileReceiveReject(ctx)
+		case "/receive/auto":
+			httpHandlerFileReceiveAutoAcceptSet(ctx)
 		case "/conn/check":
 			httpHandlerConnStateCheckSet(ctx)
+		case "/conn/list":
+			httpHandlerConnList(ctx)
+		case "/relay/stats":
+			httpHandlerRelayStats(ctx)
+		case "/peer/allow":
+			httpHandlerPeerTrust(ctx, op.PeerAllow)
+		case "/peer/block":
+			httpHandlerPeerTrust(ctx, op.PeerBlock)
+		case "/peer/forget":
+			httpHandlerPeerTrust(ctx, op.PeerForget)
+		case "/trust/mode":
+			httpHandlerTrustModeSet(ctx)
+		case "/trust/list":
+			httpHandlerTrustList(ctx)
+		case "/passphrase":
+			httpHandlerPassphraseChange(ctx)
+		case "/identity/export":
+			httpHandlerIdentityExport(ctx)
+		case "/identity/import":
+			httpHandlerIdentityImport(ctx)
+		case "/identity/migrate/receive":
+			httpHandlerIdentityMigrateReceive(ctx)
+		case "/identity/migrate/wait":
+			httpHandlerIdentityMigrateWait(ctx)
+		case "/identity/migrate/send":
+			httpHandlerIdentityMigrateSend(ctx)
+		case "/contact/card":
+			httpHandlerContactCard(ctx)
+		case "/contact/card/verify":
+			httpHandlerContactCardVerify(ctx)
+		case "/rate/limit":
+			httpHandlerRateLimitSet(ctx)
+		case "/progress/interval":
+			httpHandlerProgressIntervalSet(ctx)
+		case "/metrics":
+			metricsHandler(ctx)
 		case "/qrcode":
 			httpHandlerQrcode(ctx)
 		case "/check/id":
@@ -392,13 +618,15 @@ func startHTTP(p int64) error {
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
 	}
-	fhServer := &fasthttp.Server{
+	return &fasthttp.Server{
 		Name: "Open P2P HTTP Service",
 		// Other Server settings may be set here.
-		MaxRequestBodySize: 1024 * 1024 * 18,
-		Handler:            requestHandler,
+		// 请求体超过这个大小时不预先读入内存, 上传通过 RequestBodyStream 读取并直接发送给对方, 不限制大小
+		MaxRequestBodySize:           4 * 1024 * 1024,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		Handler:                      requestHandler,
 	}
-	return fhServer.ListenAndServe(fmt.Sprint(":", strconv.FormatInt(p, 10)))
 }
 
 // 检测节点是否已经启动
@@ -429,7 +657,10 @@ func httpHandlerBootstrapSet(ctx *fasthttp.RequestCtx) {
 }
 
 // 订阅
+//
+// 第一条消息为订阅请求, 见 feedSubscribe. 之后的消息为命令请求, 见 feedRequest
 func httpHandlerFeed(ctx *fasthttp.RequestCtx) {
+	clientIP := ctx.RemoteIP().String()
 	e := wsUpgrader.Upgrade(ctx, func(conn *websocket.Conn) {
 		defer conn.Close()
 
@@ -442,13 +673,24 @@ func httpHandlerFeed(ctx *fasthttp.RequestCtx) {
 		requestText := string(messageBytes)
 		log.Println("订阅请求: ", requestText)
 		clientID := uuid.New().String()
+		client := &wsClient{conn: conn, ip: clientIP}
+		client.subscribe(messageBytes)
+		// 第一条消息也可以直接是命令请求, 此时订阅全部回调
+		if r := (feedRequest{}); json.Unmarshal(messageBytes, &r) == nil && r.Method != "" {
+			go client.handle(messageBytes)
+		}
 
 		// 保持连接, 检测连接断开
-		var closeChan = make(chan error, 1)
+		var closeChan = make(chan error, 2)
+		doneChan := make(chan int)
+		defer close(doneChan)
 		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 		go func() {
 			for {
 				select {
+				case <-doneChan:
+					return
 				case <-ticker.C:
 					sm.Lock()
 					e := conn.WriteMessage(websocket.PingMessage, nil)
@@ -457,18 +699,30 @@ func httpHandlerFeed(ctx *fasthttp.RequestCtx) {
 						closeChan <- e
 						return
 					}
-					//// 发送测试
-					//e = conn.WriteMessage(websocket.TextMessage, []byte(time.Now().String()))
-					//log.Println("发送测试是否出错", e)
 				}
 			}
 		}()
 
+		// 处理命令请求
+		go func() {
+			for {
+				messageType, messageBytes, e := conn.ReadMessage()
+				if e != nil {
+					closeChan <- e
+					return
+				}
+				if messageType != websocket.TextMessage {
+					continue
+				}
+				go client.handle(messageBytes)
+			}
+		}()
+
 		// 缓存连接, 用于批量发送回调
-		wsConnUpdate(clientID, conn)
+		wsConnUpdate(clientID, client)
 
 		closeError := <-closeChan
-		log.Println("订阅连接断开(ping报错)", clientID, closeError)
+		log.Println("订阅连接断开", clientID, closeError)
 
 		// 移除连接
 		wsConnUpdate(clientID, nil)
@@ -505,6 +759,288 @@ func httpHandlerFileSend(ctx *fasthttp.RequestCtx) {
 	op.FileSend(reqUUID, reqID, reqPath)
 }
 
+// 上传并发送文件, 请求体为文件数据, 以流的方式直接发送给对方, 阻塞直到发送完成
+//
+// 参数通过URL提供: id 节点标识, name 文件名称, size 文件大小, hash 文件SHA-256哈希, uuid 唯一标识(可选)
+//
+// 请求体大小需要和 size 一致. 发送时同时计算哈希, 和 hash 不符时中止发送并返回400
+//
+// 成功时返回 uuid, 失败时返回错误文本
+func httpHandlerUploadSend(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	reqUUID := string(args.Peek("uuid"))
+	reqID := string(args.Peek("id"))
+	reqName := string(args.Peek("name"))
+	reqHash := string(args.Peek("hash"))
+	reqSize, e := strconv.ParseInt(string(args.Peek("size")), 10, 64)
+
+	if e != nil || reqSize < 0 || reqID == "" || reqName == "" || reqHash == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	// 分块传输时没有长度, 由发送时的哈希校验
+	if contentLength := ctx.Request.Header.ContentLength(); contentLength >= 0 && int64(contentLength) != reqSize {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString("请求体大小和size不符")
+		return
+	}
+	if reqUUID == "" {
+		reqUUID = uuid.New().String()
+	}
+
+	var r io.Reader = ctx.RequestBodyStream()
+	if r == nil {
+		r = bytes.NewReader(ctx.PostBody())
+	}
+	e = op.FileSendReader(reqUUID, reqID, reqName, reqHash, reqSize, r)
+	if e != nil {
+		log.Println("上传发送出错", e)
+		if op.ErrorCode(e.Error()) == op.ErrorCodeHashMismatch {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		} else {
+			ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		}
+		ctx.SetBodyString(e.Error())
+		return
+	}
+
+	ctx.SetBodyString(reqUUID)
+}
+
+// 下载路径, 相对公共文件夹
+func downloadPath(ctx *fasthttp.RequestCtx) string {
+	// Windows中反斜杠也是分隔符
+	p := strings.ReplaceAll(string(ctx.QueryArgs().Peek("path")), "\\", "/")
+	return path.Clean("/" + p)
+}
+
+// 是否为缓存文件夹中的路径
+//
+// 不区分大小写并忽略结尾的点和空格, 兼容不区分大小写的文件系统和Windows
+func downloadPathCache(p string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	return strings.EqualFold(strings.TrimRight(first, ". "), ".CACHE")
+}
+
+// 下载公共文件夹中的文件, 支持Range
+//
+// path 相对公共文件夹的路径, 例如接收文件回调中的路径去掉公共文件夹部分
+func httpHandlerDownload(ctx *fasthttp.RequestCtx, handler fasthttp.RequestHandler) {
+	reqPath := downloadPath(ctx)
+	// 不提供缓存
+	if reqPath == "/" || downloadPathCache(reqPath) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		return
+	}
+	fileInfo, e := os.Stat(filepath.Join(publicDir, filepath.FromSlash(reqPath)))
+	if e != nil || fileInfo.IsDir() {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	name := path.Base(reqPath)
+	ctx.Response.Header.Set("x-name", url.PathEscape(name))
+	ctx.Response.Header.Set("x-size", strconv.FormatInt(fileInfo.Size(), 10))
+	ctx.Response.Header.Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(name))
+	handler(ctx)
+}
+
+func httpHandlerDirSend(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+	reqID := string(ctx.FormValue("id"))
+	reqPath := string(ctx.FormValue("path"))
+
+	if reqUUID == "" || reqID == "" || reqPath == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	op.DirSend(reqUUID, reqID, reqPath)
+}
+
+func httpHandlerQueueTextSend(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+	reqID := string(ctx.FormValue("id"))
+	reqText := string(ctx.FormValue("text"))
+
+	if reqUUID == "" || reqID == "" || reqText == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.QueueTextSend(reqUUID, reqID, reqText)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	}
+}
+
+func httpHandlerQueueFileSend(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+	reqID := string(ctx.FormValue("id"))
+	reqPath := string(ctx.FormValue("path"))
+
+	if reqUUID == "" || reqID == "" || reqPath == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.QueueFileSend(reqUUID, reqID, reqPath)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	}
+}
+
+func httpHandlerQueueList(ctx *fasthttp.RequestCtx) {
+	jt, e := op.QueueList()
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
+func httpHandlerHistoryQuery(ctx *fasthttp.RequestCtx) {
+	reqID := string(ctx.FormValue("id"))
+	if reqID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	var reqBefore, reqLimit int64
+	var e error
+	if v := string(ctx.FormValue("before")); v != "" {
+		reqBefore, e = strconv.ParseInt(v, 10, 64)
+		if e != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+	}
+	if v := string(ctx.FormValue("limit")); v != "" {
+		reqLimit, e = strconv.ParseInt(v, 10, 64)
+		if e != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	jt, e := op.HistoryQuery(reqID, reqBefore, string(ctx.FormValue("beforeUUID")), reqLimit)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
+func httpHandlerSendCancel(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+
+	if reqUUID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.SendCancel(reqUUID)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func httpHandlerTextMarkRead(ctx *fasthttp.RequestCtx) {
+	reqID := string(ctx.FormValue("id"))
+	reqUUID := string(ctx.FormValue("uuid"))
+
+	if reqID == "" || reqUUID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.TextMarkRead(reqID, reqUUID)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func httpHandlerFileReceiveAccept(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+
+	if reqUUID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.FileReceiveAccept(reqUUID)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func httpHandlerFileReceiveReject(ctx *fasthttp.RequestCtx) {
+	reqUUID := string(ctx.FormValue("uuid"))
+	reqReason := string(ctx.FormValue("reason"))
+
+	if reqUUID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.FileReceiveReject(reqUUID, reqReason)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func httpHandlerFileReceiveAutoAcceptSet(ctx *fasthttp.RequestCtx) {
+	reqSecond, e := strconv.ParseInt(string(ctx.FormValue("second")), 10, 64)
+	if e != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	op.FileReceiveAutoAcceptSet(reqSecond)
+}
+
+func httpHandlerConnList(ctx *fasthttp.RequestCtx) {
+	reqID := string(ctx.FormValue("id"))
+
+	if reqID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	jt, e := op.ConnList(reqID)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
+func httpHandlerRelayStats(ctx *fasthttp.RequestCtx) {
+	jt, e := op.RelayStats()
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
 func httpHandlerConnStateCheckSet(ctx *fasthttp.RequestCtx) {
 	reqIdArray := string(ctx.FormValue("id_array"))
 
@@ -522,6 +1058,222 @@ func httpHandlerConnStateCheckSet(ctx *fasthttp.RequestCtx) {
 	return
 }
 
+// 修改节点信任, f 为 op.PeerAllow, op.PeerBlock 或 op.PeerForget
+func httpHandlerPeerTrust(ctx *fasthttp.RequestCtx, f func(id string) error) {
+	reqID := string(ctx.FormValue("id"))
+
+	if reqID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := f(reqID)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+	}
+}
+
+func httpHandlerTrustModeSet(ctx *fasthttp.RequestCtx) {
+	reqMode := string(ctx.FormValue("mode"))
+
+	e := op.TrustModeSet(reqMode)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+	}
+}
+
+func httpHandlerTrustList(ctx *fasthttp.RequestCtx) {
+	jt, e := op.TrustList()
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
+func httpHandlerPassphraseChange(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	reqOld := string(ctx.PostArgs().Peek("old"))
+	reqNew := string(ctx.PostArgs().Peek("new"))
+
+	e := op.PassphraseChange(reqOld, reqNew)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+	}
+}
+
+func httpHandlerIdentityExport(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	reqPassphrase := string(ctx.PostArgs().Peek("passphrase"))
+
+	blob, e := op.IdentityExport(reqPassphrase)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+		return
+	}
+	ctx.SetBodyString(blob)
+}
+
+func httpHandlerIdentityImport(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	reqBlob := string(ctx.PostArgs().Peek("blob"))
+	reqPassphrase := string(ctx.PostArgs().Peek("passphrase"))
+
+	id, e := op.IdentityImport(reqBlob, reqPassphrase)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+		return
+	}
+	ctx.SetBodyString(id)
+}
+
+// 开始接收迁移, 返回二维码图片
+func httpHandlerIdentityMigrateReceive(ctx *fasthttp.RequestCtx) {
+	fileName := "qrcode-migrate.jpg"
+	imgPath := filepath.Join(publicDir, fileName)
+	_, e := op.IdentityMigrateReceive(imgPath)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString(e.Error())
+		return
+	}
+
+	fileBytes, e := ioutil.ReadFile(imgPath)
+	_ = os.Remove(imgPath)
+	if e != nil {
+		log.Println("读取文件错误:", e)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetContentType("image/jpeg")
+	ctx.SetBody(fileBytes)
+}
+
+func httpHandlerIdentityMigrateWait(ctx *fasthttp.RequestCtx) {
+	reqTimeout := string(ctx.FormValue("timeout"))
+
+	timeout, e := strconv.ParseInt(reqTimeout, 10, 64)
+	if e != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	id, e := op.IdentityMigrateWait(timeout)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+		return
+	}
+	ctx.SetBodyString(id)
+}
+
+func httpHandlerIdentityMigrateSend(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	reqText := string(ctx.PostArgs().Peek("text"))
+
+	e := op.IdentityMigrateSend(reqText)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+	}
+}
+
+// 自己的名片二维码图片
+func httpHandlerContactCard(ctx *fasthttp.RequestCtx) {
+	reqName := string(ctx.FormValue("name"))
+
+	fileName := "qrcode-card.jpg"
+	imgPath := filepath.Join(publicDir, fileName)
+	_, e := op.ContactCardQrcodeCreate(imgPath, reqName)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	fileBytes, e := ioutil.ReadFile(imgPath)
+	if e != nil {
+		log.Println("读取文件错误:", e)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetContentType("image/jpeg")
+	ctx.SetBody(fileBytes)
+}
+
+func httpHandlerContactCardVerify(ctx *fasthttp.RequestCtx) {
+	reqText := string(ctx.FormValue("text"))
+
+	if reqText == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	jt, e := op.ContactCardVerify(reqText)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+		return
+	}
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBodyString(jt)
+}
+
+func httpHandlerRateLimitSet(ctx *fasthttp.RequestCtx) {
+	reqLimit := string(ctx.FormValue("limit"))
+
+	if reqLimit == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	e := op.RateLimitSet(reqLimit)
+	if e != nil {
+		log.Println(e)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(e.Error())
+	}
+}
+
+func httpHandlerProgressIntervalSet(ctx *fasthttp.RequestCtx) {
+	reqMillisecond, e := strconv.ParseInt(string(ctx.FormValue("millisecond")), 10, 64)
+	if e != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	op.ProgressIntervalSet(reqMillisecond)
+}
+
 func httpHandlerQrcode(ctx *fasthttp.RequestCtx) {
 	reqText := string(ctx.FormValue("text"))
 
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestHTTPUploadSend(t *testing.T) {
+	ln := startTestHTTP(t)
+	const hash = "0000000000000000000000000000000000000000000000000000000000000000"
+	upload := func(query string, body []byte) *fasthttp.Response {
+		req := testHTTPRequest("/send/upload?" + query)
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetBody(body)
+		return testHTTPDo(t, ln, req)
+	}
+
+	for _, query := range []string{
+		"id=节点&name=a.txt&size=3",
+		"id=节点&name=a.txt&hash=" + hash,
+		"id=节点&name=a.txt&size=-1&hash=" + hash,
+		"name=a.txt&size=3&hash=" + hash,
+	} {
+		if res := upload(query, []byte("abc")); res.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatal("参数错误时没有拒绝", query, res.StatusCode())
+		}
+	}
+
+	// 请求体大小和size不符
+	for _, size := range []string{"2", "4"} {
+		res := upload("id=节点&name=a.txt&size="+size+"&hash="+hash, []byte("abc"))
+		if res.StatusCode() != fasthttp.StatusBadRequest || string(res.Body()) != "请求体大小和size不符" {
+			t.Fatal("请求体大小不符时没有拒绝", size, res.StatusCode(), string(res.Body()))
+		}
+	}
+
+	// 超过预先读入内存的大小时也按流发送, 节点没有启动时发送出错
+	body := bytes.Repeat([]byte{1}, 5*1024*1024)
+	res := upload("id=节点&name=a.txt&size=5242880&hash="+hash, body)
+	if res.StatusCode() != fasthttp.StatusBadGateway {
+		t.Fatal("大小相符时没有发送", res.StatusCode(), string(res.Body()))
+	}
+}
+
+func TestHTTPDownload(t *testing.T) {
+	ln := startTestHTTP(t)
+	e := os.MkdirAll(filepath.Join(publicDir, ".CACHE"), 0700)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range []string{"a.txt", filepath.Join(".CACHE", "b.txt")} {
+		e = os.WriteFile(filepath.Join(publicDir, name), []byte("0123456789"), 0644)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	res := testHTTPDo(t, ln, testHTTPRequest("/download?path=a.txt"))
+	if res.StatusCode() != fasthttp.StatusOK || string(res.Body()) != "0123456789" || string(res.Header.Peek("x-size")) != "10" || string(res.Header.Peek("x-name")) != "a.txt" {
+		t.Fatal("下载错误", res.StatusCode(), string(res.Body()))
+	}
+
+	// 断点续传
+	req := testHTTPRequest("/download?path=/a.txt")
+	req.Header.Set("Range", "bytes=2-5")
+	res = testHTTPDo(t, ln, req)
+	if res.StatusCode() != fasthttp.StatusPartialContent || string(res.Body()) != "2345" || string(res.Header.Peek("Content-Range")) != "bytes 2-5/10" {
+		t.Fatal("Range下载错误", res.StatusCode(), string(res.Body()), string(res.Header.Peek("Content-Range")))
+	}
+	req = testHTTPRequest("/download?path=a.txt")
+	req.Header.Set("Range", "bytes=7-")
+	res = testHTTPDo(t, ln, req)
+	if res.StatusCode() != fasthttp.StatusPartialContent || string(res.Body()) != "789" {
+		t.Fatal("Range下载错误", res.StatusCode(), string(res.Body()))
+	}
+
+	// 不提供缓存和公共文件夹之外的文件
+	for _, item := range []struct {
+		path string
+		code int
+	}{
+		{"", fasthttp.StatusForbidden},
+		{"/", fasthttp.StatusForbidden},
+		{".CACHE/b.txt", fasthttp.StatusForbidden},
+		{".cache/b.txt", fasthttp.StatusForbidden},
+		{"/.Cache./b.txt", fasthttp.StatusForbidden},
+		{"a/../.cache/b.txt", fasthttp.StatusForbidden},
+		{"a\\..\\.cache\\b.txt", fasthttp.StatusForbidden},
+		{"../a.txt", fasthttp.StatusOK},
+		{"../../etc/passwd", fasthttp.StatusNotFound},
+		{"c.txt", fasthttp.StatusNotFound},
+	} {
+		args := fasthttp.AcquireArgs()
+		args.Set("path", item.path)
+		res = testHTTPDo(t, ln, testHTTPRequest("/download?"+args.String()))
+		if res.StatusCode() != item.code {
+			t.Fatal("下载路径检查错误", item.path, res.StatusCode())
+		}
+	}
+}
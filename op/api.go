@@ -2,28 +2,43 @@ package op
 
 import (
 	"encoding/json"
+	"io"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-// TODO 发送需要支持取消
-
 // 检查ID是否有效
 func IdOk(id string) bool {
 	_, e := peer.Decode(id)
 	return e == nil
 }
 
-// 设置引导
-func BootstrapSet(arrayText string) error {
+// ID 节点标识, 没有启动时返回空
+func (n *Node) ID() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.running || n.host == nil {
+		return ""
+	}
+	return n.host.ID().Pretty()
+}
+
+// BootstrapSet 设置引导
+//
+// arrayText 引导多址JSON数组
+func (n *Node) BootstrapSet(arrayText string) error {
 	var array []string
 	e := json.Unmarshal([]byte(arrayText), &array)
 	if e != nil {
 		return e
 	}
 
+	ctx, h, e := n.started()
+	if e != nil {
+		return e
+	}
 	for _, v := range array {
-		go connectBootstrap(globalContext, globalHost, v)
+		go connectBootstrap(ctx, h, v)
 	}
 
 	return nil
@@ -40,8 +55,8 @@ func BootstrapSet(arrayText string) error {
 // 发送错误通过 Callback.OnOpTextSendError 获取
 //
 // 发送完成通过 Callback.OnOpTextSendDone 获取
-func TextSend(uuid, id, text string) {
-	go textSend(uuid, id, text)
+func (n *Node) TextSend(uuid, id, text string) {
+	go n.textSend(uuid, id, text)
 }
 
 // FileSend 文件发送
@@ -57,23 +72,475 @@ func TextSend(uuid, id, text string) {
 // 发送进度通过 Callback.OnOpFileSendProgress 获取
 //
 // 发送完成通过 Callback.OnOpFileSendDone 获取
-func FileSend(uuid, id, filePath string) {
-	go fileSend(uuid, id, filePath)
+func (n *Node) FileSend(uuid, id, filePath string) {
+	go n.fileSend(uuid, id, filePath)
+}
+
+// FileSendReader 发送数据流, 阻塞直到完成, 用于不在本机的文件(例如HTTP上传)
+//
+// uuid 唯一标识, 用于跟踪状态
+//
+// id 节点标识
+//
+// fileName 文件名称
+//
+// fileHash 文件SHA-256哈希, 十六进制小写, 对方用于校验和续传
+//
+// fileSize 文件大小
+//
+// r 文件数据, 只能读取一次, 对方已经接收部分数据时跳过这部分. 最多读取 fileSize 字节, 读取时计算哈希,
+// 和 fileHash 不符时中止发送, 错误代码为 ErrorCodeHashMismatch. 出错时不会重试
+//
+// 回调同 FileSend
+func (n *Node) FileSendReader(uuid, id, fileName, fileHash string, fileSize int64, r io.Reader) error {
+	return n.fileSendReader(uuid, id, fileName, fileHash, fileSize, r)
+}
+
+// QueueTextSend 通过发送队列发送文本
+//
+// 队列保存在私有文件夹, 重新启动后继续发送. 对方可以连接时发送, 出错时按指数退避重试, 对方拒绝时不再重试
+//
+// uuid 唯一标识, 用于跟踪状态
+//
+// id 节点标识
+//
+// text 文本内容
+//
+// 队列项目变化通过 Callback.OnOpQueueChanged 获取, 发送结果和 TextSend 相同
+func (n *Node) QueueTextSend(uuid, id, text string) error {
+	return n.queueAdd(&queueItem{UUID: uuid, ID: id, Kind: queueKindText, Text: text})
+}
+
+// QueueFileSend 通过发送队列发送文件
+//
+// uuid 唯一标识, 用于跟踪状态
+//
+// id 节点标识
+//
+// filePath 文件绝对路径, 发送完成前不要删除
+//
+// 队列项目变化通过 Callback.OnOpQueueChanged 获取, 发送结果和 FileSend 相同
+func (n *Node) QueueFileSend(uuid, id, filePath string) error {
+	return n.queueAdd(&queueItem{UUID: uuid, ID: id, Kind: queueKindFile, FilePath: filePath})
+}
+
+// QueueList 发送队列JSON数组
+//
+// 状态: wait 等待发送, send 正在发送, fail 发送失败(不再重试, 通过 SendCancel 移除)
+func (n *Node) QueueList() (string, error) {
+	return n.queueList()
+}
+
+// TextMarkRead 标记文本已读, 对方通过 Callback.OnOpTextRead 获取
+//
+// id 节点标识
+//
+// uuid Callback.OnOpTextReceiveDone 中的唯一标识
+func (n *Node) TextMarkRead(id, uuid string) error {
+	return n.textMarkRead(id, uuid)
+}
+
+// HistoryQuery 查询消息记录
+//
+// 记录发送和接收的文本和文件, 保存在私有文件夹
+//
+// peerID 节点标识
+//
+// before 只返回此时间之前的记录, 毫秒时间戳, 0表示不限. 翻页时使用上一页最后一条记录的 time
+//
+// beforeUUID 翻页时使用上一页最后一条记录的 uuid, 继续返回和它同一毫秒但更早写入的记录. 为空时不返回 before 这一毫秒的记录
+//
+// limit 最多返回数量, 0表示默认20条
+//
+// 返回JSON数组, 按时间从新到旧. 方向 direction: send 发送, receive 接收; 类型 kind: text 文本, file 文件;
+// 状态 state: wait 等待, send 正在发送, receive 正在接收, done 完成, error 出错, cancel 取消, reject 拒绝接收;
+// 文本回执 deliverTime 送达时间, readTime 已读时间
+func (n *Node) HistoryQuery(peerID string, before int64, beforeUUID string, limit int64) (string, error) {
+	return n.historyQuery(peerID, before, beforeUUID, limit)
+}
+
+// DirSend 文件夹发送
+//
+// 先发送包含相对路径, 大小和哈希的清单, 再依次发送每个文件, 每个文件都可以续传. 只发送普通文件, 不发送空文件夹和链接
+//
+// uuid 唯一标识, 用于跟踪状态
+//
+// id 节点标识
+//
+// dirPath 文件夹绝对路径
+//
+// 和 FileSend 使用相同的回调, 进度为所有文件的总大小和已经发送大小, 完成时的哈希为清单哈希
+//
+// 对方通过文件接收回调获取, 文件名称为文件夹名称, 完成时的路径为文件夹路径
+func (n *Node) DirSend(uuid, id, dirPath string) {
+	go n.dirSend(uuid, id, dirPath)
+}
+
+// SendCancel 取消发送
+//
+// uuid 文本或文件发送时设置的唯一标识, 发送队列中的项目会被移除
+//
+// 文本取消通过 Callback.OnOpTextSendCancel 获取
+//
+// 文件取消通过 Callback.OnOpFileSendCancel 获取, 对方通过 Callback.OnOpFileReceiveCancel 获取
+func (n *Node) SendCancel(uuid string) error {
+	return n.sendCancel(uuid)
+}
+
+// FileReceiveAccept 接收文件
+//
+// uuid Callback.OnOpFileReceiveOffer 中的唯一标识
+func (n *Node) FileReceiveAccept(uuid string) error {
+	return n.offerDecide(uuid, offerDecision{accept: true})
+}
+
+// FileReceiveReject 拒绝文件
+//
+// uuid Callback.OnOpFileReceiveOffer 中的唯一标识
+//
+// reason 拒绝原因, 对方通过 Callback.OnOpFileSendError 获取, 错误代码为 ErrorCodeReject
+func (n *Node) FileReceiveReject(uuid, reason string) error {
+	return n.offerDecide(uuid, offerDecision{accept: false, reason: reason})
+}
+
+// FileReceiveAutoAcceptSet 设置自动接收等待秒数
+//
+// 收到文件后等待 FileReceiveAccept 或 FileReceiveReject 的秒数, 超时自动接收
+//
+// 小于0(默认)表示一直等待, 0表示立即接收不再等待决定
+func (n *Node) FileReceiveAutoAcceptSet(second int64) {
+	n.offerAutoAcceptSet(second)
+}
+
+// FilePathPolicySet 设置接收文件保存路径策略
+//
+// policy 为nil时保存到公共文件夹
+func (n *Node) FilePathPolicySet(policy FilePathPolicy) {
+	n.filePathPolicySet(policy)
 }
 
 // ConnStateCheckSet 设置需要检查连接状态的节点标识数组
 //
-// 通常应该将所有联系人的标识都设置进来
+// 通常应该将所有联系人的标识都设置进来, 断开的节点会按指数退避自动重连
 //
-// 连接状态通过 Callback.OnOpConnState 获取
-func ConnStateCheckSet(arrayText string) error {
+// 连接状态通过 Callback.OnOpConnState 获取, 设置后通知一次当前状态, 之后只在变化时通知
+func (n *Node) ConnStateCheckSet(arrayText string) error {
 	var array []string
 	e := json.Unmarshal([]byte(arrayText), &array)
 	if e != nil {
 		return e
 	}
 
-	connStateIdArraySet(array)
+	n.connStateIdArraySet(array)
 
 	return nil
 }
+
+// ConnList 节点连接信息JSON数组
+//
+// id 节点标识
+//
+// 连接信息: addr 对方多址, relay 是否通过中继连接, direction 方向(inbound 对方发起, outbound 我方发起), opened 建立时间
+func (n *Node) ConnList(id string) (string, error) {
+	return n.connList(id)
+}
+
+// RelayStats 中继服务状态JSON, 需要开启中继服务或者使用中继和引导服务器模式
+//
+// 状态: reserveCount 收到的预留请求次数, connectCount 收到的中继连接请求次数, circuitCount 当前中继连接数量,
+// dataSize 已经中继的字节数, dataRate 中继速率(字节每秒), nodeCount 节点数量, connCount 连接数量,
+// txtArray 公网多址(每个可以作为一条引导TXT记录)
+func (n *Node) RelayStats() (string, error) {
+	return n.relayStats()
+}
+
+// RateLimitSet 设置传输速率限制, 立即生效
+//
+// jt 速率限制JSON, 见 RateLimit, 例如 {"upload":1048576,"peerDownload":524288}, 0表示不限制.
+// 只限制文件和文件夹数据, 文本和控制消息优先传输. 当前限制和速率通过 Callback.OnOpState 获取
+func (n *Node) RateLimitSet(jt string) error {
+	return n.rateLimitSet(jt)
+}
+
+// PeerAllow 将节点加入白名单, 同时移出黑名单
+//
+// 信任模式为 TrustModeAllow 时只接收白名单中节点的文本和文件. 信任列表保存在私有文件夹, 需要启动后调用
+func (n *Node) PeerAllow(id string) error {
+	return n.peerAllow(id)
+}
+
+// PeerBlock 将节点加入黑名单, 同时移出白名单
+//
+// 信任模式为 TrustModeBlock 或 TrustModeAllow 时拒绝黑名单中节点的连接, 已经建立的连接立即断开.
+// 被拒绝的尝试通过 Callback.OnOpPeerReject 获取
+func (n *Node) PeerBlock(id string) error {
+	return n.peerBlock(id)
+}
+
+// PeerForget 将节点移出白名单和黑名单
+func (n *Node) PeerForget(id string) error {
+	return n.peerForget(id)
+}
+
+// TrustModeSet 设置信任模式: TrustModeOpen(默认), TrustModeBlock 或 TrustModeAllow
+func (n *Node) TrustModeSet(mode string) error {
+	return n.trustModeSet(mode)
+}
+
+// TrustList 信任列表JSON: mode 信任模式, allowArray 白名单, blockArray 黑名单
+func (n *Node) TrustList() (string, error) {
+	return n.trustListJSON()
+}
+
+// PassphraseChange 修改密钥密码, 下次启动时使用新密码
+//
+// oldPassphrase 当前密码, 没有加密时为空. 错误时返回的错误代码为 ErrorCodePassphrase
+//
+// newPassphrase 新密码, 为空表示不加密
+func (n *Node) PassphraseChange(oldPassphrase, newPassphrase string) error {
+	return n.passphraseChange(oldPassphrase, newPassphrase)
+}
+
+// IdentityExport 导出身份, 用于更换设备时保持节点标识不变
+//
+// passphrase 备份密码, 不能为空. 返回加密的备份, 通过 IdentityImport 导入
+func (n *Node) IdentityExport(passphrase string) (string, error) {
+	return n.identityExport(passphrase)
+}
+
+// IdentityImport 导入身份, 覆盖现有的密钥, 返回导入的节点标识. 再次启动后生效
+//
+// 密码错误时返回的错误代码为 ErrorCodePassphrase. 导入的密钥使用启动密码加密保存
+func (n *Node) IdentityImport(blob, passphrase string) (string, error) {
+	return n.identityImport(blob, passphrase)
+}
+
+// IdentityMigrateReceive 新设备开始接收迁移, 返回二维码内容
+//
+// qrPath 二维码jpg保存路径, 为空时不保存. 旧设备扫描后调用 IdentityMigrateSend, 新设备调用 IdentityMigrateWait 等待
+func (n *Node) IdentityMigrateReceive(qrPath string) (string, error) {
+	return n.identityMigrateReceive(qrPath)
+}
+
+// IdentityMigrateWait 新设备等待接收迁移, 返回导入的节点标识. 再次启动后生效
+//
+// timeoutSecond 超时秒数, 必须大于0, 否则返回错误. 不会一直等待, 防止二维码中的一次性密码长期有效
+//
+// 超时或者二维码密码错误3次后停止接收, 需要重新调用 IdentityMigrateReceive
+func (n *Node) IdentityMigrateWait(timeoutSecond int64) (string, error) {
+	return n.identityMigrateWait(timeoutSecond)
+}
+
+// IdentityMigrateSend 旧设备将身份发送给新设备, 需要在同一局域网
+//
+// qrText 扫描新设备二维码得到的内容. 完成后旧设备不应该继续使用这个身份
+func (n *Node) IdentityMigrateSend(qrText string) error {
+	return n.identityMigrateSend(qrText)
+}
+
+// ContactCardCreate 创建自己的名片, 返回使用节点密钥签名的名片文本, 用于生成二维码
+//
+// name 显示名称. 名片包含节点标识, 当前地址和中继(可选), 有效期7天, 地址变化后需要重新创建
+func (n *Node) ContactCardCreate(name string) (string, error) {
+	return n.contactCardCreate(name)
+}
+
+// ContactCardVerify 验证名片, 返回名片JSON: id 节点标识, name 显示名称, addrs 地址数组, relay 中继地址, time 签发时间毫秒, expire 过期时间毫秒
+//
+// 签名错误或者已经过期时返回错误. 节点已经启动时将名片中的地址加入地址簿并在后台连接, 不需要通过DHT查找
+func (n *Node) ContactCardVerify(text string) (string, error) {
+	return n.contactCardVerify(text)
+}
+
+// ContactCardQrcodeCreate 创建名片并将二维码保存为jpg, 返回名片文本
+func (n *Node) ContactCardQrcodeCreate(path, name string) (string, error) {
+	return n.contactCardQrcodeCreate(path, name)
+}
+
+// ContactCardQrcodeVerify 识别二维码图片中的名片并验证, 见 ContactCardVerify
+func (n *Node) ContactCardQrcodeVerify(path string) (string, error) {
+	return n.contactCardQrcodeVerify(path)
+}
+
+// ProgressIntervalSet 设置进度通知间隔毫秒数
+//
+// 间隔内的进度合并为一次 Callback.OnOpFileSendProgress 或 Callback.OnOpFileReceiveProgress, 第一次和完成时总是通知.
+// 默认500, 0表示每次读写都通知, 小于0表示恢复默认
+func (n *Node) ProgressIntervalSet(millisecond int64) {
+	n.progressIntervalSet(millisecond)
+}
+
+// 设置引导, 见 Node.BootstrapSet
+func BootstrapSet(arrayText string) error {
+	return defaultNode.BootstrapSet(arrayText)
+}
+
+// TextSend 文本发送, 见 Node.TextSend
+func TextSend(uuid, id, text string) {
+	defaultNode.TextSend(uuid, id, text)
+}
+
+// FileSend 文件发送, 见 Node.FileSend
+func FileSend(uuid, id, filePath string) {
+	defaultNode.FileSend(uuid, id, filePath)
+}
+
+// QueueTextSend 通过发送队列发送文本, 见 Node.QueueTextSend
+func QueueTextSend(uuid, id, text string) error {
+	return defaultNode.QueueTextSend(uuid, id, text)
+}
+
+// QueueFileSend 通过发送队列发送文件, 见 Node.QueueFileSend
+func QueueFileSend(uuid, id, filePath string) error {
+	return defaultNode.QueueFileSend(uuid, id, filePath)
+}
+
+// QueueList 发送队列JSON数组, 见 Node.QueueList
+func QueueList() (string, error) {
+	return defaultNode.QueueList()
+}
+
+// TextMarkRead 标记文本已读, 见 Node.TextMarkRead
+func TextMarkRead(id, uuid string) error {
+	return defaultNode.TextMarkRead(id, uuid)
+}
+
+// HistoryQuery 查询消息记录, 见 Node.HistoryQuery
+func HistoryQuery(peerID string, before int64, beforeUUID string, limit int64) (string, error) {
+	return defaultNode.HistoryQuery(peerID, before, beforeUUID, limit)
+}
+
+// FileSendReader 发送数据流, 见 Node.FileSendReader
+func FileSendReader(uuid, id, fileName, fileHash string, fileSize int64, r io.Reader) error {
+	return defaultNode.FileSendReader(uuid, id, fileName, fileHash, fileSize, r)
+}
+
+// DirSend 文件夹发送, 见 Node.DirSend
+func DirSend(uuid, id, dirPath string) {
+	defaultNode.DirSend(uuid, id, dirPath)
+}
+
+// SendCancel 取消发送, 见 Node.SendCancel
+func SendCancel(uuid string) error {
+	return defaultNode.SendCancel(uuid)
+}
+
+// FileReceiveAccept 接收文件, 见 Node.FileReceiveAccept
+func FileReceiveAccept(uuid string) error {
+	return defaultNode.FileReceiveAccept(uuid)
+}
+
+// FileReceiveReject 拒绝文件, 见 Node.FileReceiveReject
+func FileReceiveReject(uuid, reason string) error {
+	return defaultNode.FileReceiveReject(uuid, reason)
+}
+
+// FileReceiveAutoAcceptSet 设置自动接收等待秒数, 见 Node.FileReceiveAutoAcceptSet
+func FileReceiveAutoAcceptSet(second int64) {
+	defaultNode.FileReceiveAutoAcceptSet(second)
+}
+
+// FilePathPolicySet 设置接收文件保存路径策略, 见 Node.FilePathPolicySet
+func FilePathPolicySet(policy FilePathPolicy) {
+	defaultNode.FilePathPolicySet(policy)
+}
+
+// ConnList 节点连接信息JSON数组, 见 Node.ConnList
+func ConnList(id string) (string, error) {
+	return defaultNode.ConnList(id)
+}
+
+// RelayStats 中继服务状态JSON, 见 Node.RelayStats
+func RelayStats() (string, error) {
+	return defaultNode.RelayStats()
+}
+
+// ConnStateCheckSet 设置需要检查连接状态的节点标识数组, 见 Node.ConnStateCheckSet
+func ConnStateCheckSet(arrayText string) error {
+	return defaultNode.ConnStateCheckSet(arrayText)
+}
+
+// RateLimitSet 设置传输速率限制, 见 Node.RateLimitSet
+func RateLimitSet(jt string) error {
+	return defaultNode.RateLimitSet(jt)
+}
+
+// ProgressIntervalSet 设置进度通知间隔毫秒数, 见 Node.ProgressIntervalSet
+func ProgressIntervalSet(millisecond int64) {
+	defaultNode.ProgressIntervalSet(millisecond)
+}
+
+// PeerAllow 将节点加入白名单, 见 Node.PeerAllow
+func PeerAllow(id string) error {
+	return defaultNode.PeerAllow(id)
+}
+
+// PeerBlock 将节点加入黑名单, 见 Node.PeerBlock
+func PeerBlock(id string) error {
+	return defaultNode.PeerBlock(id)
+}
+
+// PeerForget 将节点移出白名单和黑名单, 见 Node.PeerForget
+func PeerForget(id string) error {
+	return defaultNode.PeerForget(id)
+}
+
+// TrustModeSet 设置信任模式, 见 Node.TrustModeSet
+func TrustModeSet(mode string) error {
+	return defaultNode.TrustModeSet(mode)
+}
+
+// TrustList 信任列表JSON, 见 Node.TrustList
+func TrustList() (string, error) {
+	return defaultNode.TrustList()
+}
+
+// PassphraseChange 修改密钥密码, 见 Node.PassphraseChange
+func PassphraseChange(oldPassphrase, newPassphrase string) error {
+	return defaultNode.PassphraseChange(oldPassphrase, newPassphrase)
+}
+
+// IdentityExport 导出身份, 见 Node.IdentityExport
+func IdentityExport(passphrase string) (string, error) {
+	return defaultNode.IdentityExport(passphrase)
+}
+
+// IdentityImport 导入身份, 见 Node.IdentityImport
+func IdentityImport(blob, passphrase string) (string, error) {
+	return defaultNode.IdentityImport(blob, passphrase)
+}
+
+// IdentityMigrateReceive 开始接收迁移, 见 Node.IdentityMigrateReceive
+func IdentityMigrateReceive(qrPath string) (string, error) {
+	return defaultNode.IdentityMigrateReceive(qrPath)
+}
+
+// IdentityMigrateWait 等待接收迁移, 见 Node.IdentityMigrateWait
+func IdentityMigrateWait(timeoutSecond int64) (string, error) {
+	return defaultNode.IdentityMigrateWait(timeoutSecond)
+}
+
+// IdentityMigrateSend 发送迁移, 见 Node.IdentityMigrateSend
+func IdentityMigrateSend(qrText string) error {
+	return defaultNode.IdentityMigrateSend(qrText)
+}
+
+// ContactCardCreate 创建名片, 见 Node.ContactCardCreate
+func ContactCardCreate(name string) (string, error) {
+	return defaultNode.ContactCardCreate(name)
+}
+
+// ContactCardVerify 验证名片, 见 Node.ContactCardVerify
+func ContactCardVerify(text string) (string, error) {
+	return defaultNode.ContactCardVerify(text)
+}
+
+// ContactCardQrcodeCreate 创建名片二维码, 见 Node.ContactCardQrcodeCreate
+func ContactCardQrcodeCreate(path, name string) (string, error) {
+	return defaultNode.ContactCardQrcodeCreate(path, name)
+}
+
+// ContactCardQrcodeVerify 验证名片二维码, 见 Node.ContactCardQrcodeVerify
+func ContactCardQrcodeVerify(path string) (string, error) {
+	return defaultNode.ContactCardQrcodeVerify(path)
+}
@@ -0,0 +1,294 @@
+package op
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// 发送任务, 用于取消正在进行的发送
+type sendTask struct {
+	mutex    sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	host     host.Host
+	stream   network.Stream
+	peerID   peer.ID
+	fileHash string
+	canceled bool
+}
+
+// 接收任务, 用于识别对方主动取消
+type receiveTask struct {
+	mutex      sync.Mutex
+	stream     network.Stream
+	peerID     peer.ID
+	fileHash   string
+	sendUUID   string
+	canceled   bool
+	cancelChan chan struct{}
+}
+
+// 发送方先重置流再告知取消, 接收出错时等待告知的最长时间
+const receiveCancelWait = 3 * time.Second
+
+// 添加发送任务, 唯一标识已经存在时返回错误
+//
+// 注意: 成功时 defer n.sendTaskRemove(uuid)
+func (n *Node) sendTaskAdd(uuid string) (*sendTask, error) {
+	nodeCtx, h, e := n.started()
+	if e != nil {
+		return nil, e
+	}
+	n.sendTaskMutex.Lock()
+	defer n.sendTaskMutex.Unlock()
+	if _, ok := n.sendTaskMap[uuid]; ok {
+		return nil, fmt.Errorf("唯一标识已经存在: %s", uuid)
+	}
+	ctx, cancel := context.WithCancel(nodeCtx)
+	t := &sendTask{ctx: ctx, cancel: cancel, host: h}
+	n.sendTaskMap[uuid] = t
+	return t, nil
+}
+
+// 移除发送任务
+func (n *Node) sendTaskRemove(uuid string) {
+	n.sendTaskMutex.Lock()
+	t, ok := n.sendTaskMap[uuid]
+	if ok {
+		t.cancel()
+		delete(n.sendTaskMap, uuid)
+	}
+	n.sendTaskMutex.Unlock()
+}
+
+// 设置发送任务的流
+func (t *sendTask) streamSet(s network.Stream) {
+	t.mutex.Lock()
+	t.stream = s
+	t.mutex.Unlock()
+}
+
+// 设置发送任务的文件哈希, 取消时用于告知对方
+func (t *sendTask) fileHashSet(peerID peer.ID, fileHash string) {
+	t.mutex.Lock()
+	t.peerID = peerID
+	t.fileHash = fileHash
+	t.mutex.Unlock()
+}
+
+// 发送任务是否已经取消
+func (t *sendTask) isCanceled() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.canceled
+}
+
+// 取消发送
+//
+// 先重置流立即停止传输, 再告知对方取消. 对方接收出错时等待告知, 用于区分取消和网络错误
+func (n *Node) sendCancel(uuid string) error {
+	// 从发送队列中移除
+	queued := n.queueCancel(uuid)
+
+	n.sendTaskMutex.Lock()
+	t, ok := n.sendTaskMap[uuid]
+	n.sendTaskMutex.Unlock()
+	if !ok {
+		if queued {
+			return nil
+		}
+		return errors.New("没有找到发送任务")
+	}
+
+	t.mutex.Lock()
+	if t.canceled {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.canceled = true
+	s := t.stream
+	peerID := t.peerID
+	fileHash := t.fileHash
+	t.mutex.Unlock()
+	log.Println("取消发送", uuid)
+
+	t.cancel()
+	if s != nil {
+		_ = s.Reset()
+	}
+	if fileHash != "" {
+		// 第1版文件协议没有唯一标识, 只能通过文件哈希识别
+		cancelText := fileHash
+		if s == nil || s.Protocol() != protocolFile {
+			cancelText = fileHash + "/" + uuid
+		}
+		go func() {
+			e := n.cancelNotify(peerID, cancelText)
+			if e != nil {
+				log.Println("告知对方取消出错:", e)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// 告知对方取消文件接收
+//
+// cancelText 文件哈希, 对方支持时后面加上 /唯一标识
+func (n *Node) cancelNotify(peerID peer.ID, cancelText string) error {
+	ctx, h, e := n.started()
+	if e != nil {
+		return e
+	}
+	s, e := createStream(network.WithUseTransient(ctx, "cancel"), h, peerID.Pretty(), time.Second*10, protocolCancel)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(time.Second * 10))
+
+	// 创建读写器
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+
+	// 写入文件哈希和唯一标识
+	data := []byte(cancelText)
+	e = n.rateLimiter.priorityWrite(s, func() error {
+		return writeTextToReadWriter(rw, &data)
+	})
+	if e != nil {
+		return e
+	}
+
+	// 接收
+	var resultBytes *[]byte
+	e = n.rateLimiter.priorityRead(s, rw.Reader, time.Second*10, func() (e error) {
+		resultBytes, e = readTextFromReadWriter(rw)
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	resultText := string(*resultBytes)
+	if resultText != "成功" {
+		return fmt.Errorf("异常返回:%s", resultText)
+	}
+
+	return nil
+}
+
+// 添加接收任务, 每个流一个任务, 同一文件可以同时接收多次
+//
+// sendUUID 对方的唯一标识, 第1版文件协议没有
+//
+// 注意: defer n.receiveTaskRemove(s)
+func (n *Node) receiveTaskAdd(s network.Stream, fileHash, sendUUID string) *receiveTask {
+	t := &receiveTask{
+		stream:     s,
+		peerID:     s.Conn().RemotePeer(),
+		fileHash:   fileHash,
+		sendUUID:   sendUUID,
+		cancelChan: make(chan struct{}),
+	}
+	n.receiveTaskMutex.Lock()
+	n.receiveTaskMap[s.ID()] = t
+	n.receiveTaskMutex.Unlock()
+	return t
+}
+
+// 移除接收任务
+func (n *Node) receiveTaskRemove(s network.Stream) {
+	n.receiveTaskMutex.Lock()
+	delete(n.receiveTaskMap, s.ID())
+	n.receiveTaskMutex.Unlock()
+}
+
+// 接收任务是否已经被对方取消
+func (t *receiveTask) isCanceled() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.canceled
+}
+
+// 接收出错后等待对方告知取消, 返回是否已经被对方取消
+func (t *receiveTask) canceledWait() bool {
+	timer := time.NewTimer(receiveCancelWait)
+	defer timer.Stop()
+	select {
+	case <-t.cancelChan:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// 是否是对方要取消的任务, 对方没有唯一标识时只比较文件哈希
+func (t *receiveTask) cancelMatch(peerID peer.ID, fileHash, sendUUID string) bool {
+	if t.peerID != peerID || t.fileHash != fileHash {
+		return false
+	}
+	return sendUUID == "" || t.sendUUID == "" || t.sendUUID == sendUUID
+}
+
+// 取消处理
+func (n *Node) cancelStreamHandler(s network.Stream) {
+	remotePeerID := s.Conn().RemotePeer()
+	log.Println("取消处理, 对方ID:", remotePeerID)
+	defer func() {
+		_ = s.Close()
+	}()
+	if !n.trustStreamOk(s) {
+		return
+	}
+
+	// 创建读写器
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+
+	// 读取文件哈希和唯一标识
+	requestBytes, e := readTextFromReadWriter(rw)
+	if e != nil {
+		log.Println("取消处理, 读取对方文件哈希出错:", e)
+		return
+	}
+	fileHash, sendUUID, _ := strings.Cut(string(*requestBytes), "/")
+
+	// 标记取消并重置接收流
+	var taskArray []*receiveTask
+	n.receiveTaskMutex.Lock()
+	for _, t := range n.receiveTaskMap {
+		if t.cancelMatch(remotePeerID, fileHash, sendUUID) {
+			taskArray = append(taskArray, t)
+		}
+	}
+	n.receiveTaskMutex.Unlock()
+	for _, t := range taskArray {
+		t.mutex.Lock()
+		if !t.canceled {
+			t.canceled = true
+			close(t.cancelChan)
+		}
+		t.mutex.Unlock()
+
+		log.Println("取消处理, 对方取消文件:", fileHash, sendUUID)
+		_ = t.stream.Reset()
+	}
+
+	// 回复
+	responseBytes := []byte("成功")
+	e = writeTextToReadWriter(rw, &responseBytes)
+	if e != nil {
+		log.Println("取消处理, 回复对方成功时出错:", e)
+	}
+}
@@ -0,0 +1,154 @@
+package op
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// 文件头部
+type fileHeader struct {
+	uuid string
+	hash string
+	size int64
+	name string
+}
+
+// 交换编解码, 屏蔽协议版本差异
+type exchangeCodec interface {
+	// 读写器, 用于传输文件数据
+	readWriter() *bufio.ReadWriter
+	// 文本头部, 第1版没有唯一标识
+	writeTextHeader(uuid, text string) error
+	readTextHeader() (string, string, error)
+	// 文件头部, 第1版没有唯一标识
+	writeFileHeader(h fileHeader) error
+	readFileHeader() (fileHeader, error)
+	// 已经接收大小, e 不为nil时表示拒绝接收
+	writeFileOffset(offset int64, e error) error
+	readFileOffset() (int64, error)
+	// 结果, e 为nil表示成功
+	writeResult(e error) error
+	readResult() error
+}
+
+// 根据流协商的协议创建编解码
+func newExchangeCodec(s network.Stream) exchangeCodec {
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	switch s.Protocol() {
+	case protocolTextV2, protocolFileV2:
+		return &codecV2{rw: rw}
+	}
+	return &codecV1{rw: rw}
+}
+
+// 第1版编解码, 每个字段为一行base64文本
+type codecV1 struct {
+	rw *bufio.ReadWriter
+}
+
+func (c *codecV1) readWriter() *bufio.ReadWriter {
+	return c.rw
+}
+
+func (c *codecV1) writeLine(text string) error {
+	data := []byte(text)
+	return writeTextToReadWriter(c.rw, &data)
+}
+
+func (c *codecV1) readLine() (string, error) {
+	data, e := readTextFromReadWriter(c.rw)
+	if e != nil {
+		return "", e
+	}
+	return string(*data), nil
+}
+
+func (c *codecV1) writeTextHeader(uuid, text string) error {
+	return c.writeLine(text)
+}
+
+func (c *codecV1) readTextHeader() (string, string, error) {
+	text, e := c.readLine()
+	return "", text, e
+}
+
+func (c *codecV1) writeFileHeader(h fileHeader) error {
+	e := c.writeLine(h.hash)
+	if e != nil {
+		return e
+	}
+	e = c.writeLine(strconv.FormatInt(h.size, 10))
+	if e != nil {
+		return e
+	}
+	return c.writeLine(h.name)
+}
+
+func (c *codecV1) readFileHeader() (fileHeader, error) {
+	var h fileHeader
+	var e error
+
+	h.hash, e = c.readLine()
+	if e != nil {
+		return h, fmt.Errorf("读取文件哈希出错: %w", e)
+	}
+
+	sizeText, e := c.readLine()
+	if e != nil {
+		return h, fmt.Errorf("读取文件大小出错: %w", e)
+	}
+	h.size, e = strconv.ParseInt(sizeText, 10, 64)
+	if e != nil {
+		return h, fmt.Errorf("转换文件大小出错: %w", e)
+	}
+
+	h.name, e = c.readLine()
+	if e != nil {
+		return h, fmt.Errorf("读取文件名称出错: %w", e)
+	}
+
+	return h, nil
+}
+
+func (c *codecV1) writeFileOffset(offset int64, e error) error {
+	if e != nil {
+		return c.writeLine(e.Error())
+	}
+	return c.writeLine(strconv.FormatInt(offset, 10))
+}
+
+func (c *codecV1) readFileOffset() (int64, error) {
+	text, e := c.readLine()
+	if e != nil {
+		return 0, e
+	}
+	if ce := parseCodeError(text); ce != nil {
+		return 0, ce
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+func (c *codecV1) writeResult(e error) error {
+	if e != nil {
+		return c.writeLine(e.Error())
+	}
+	return c.writeLine("成功")
+}
+
+func (c *codecV1) readResult() error {
+	text, e := c.readLine()
+	if e != nil {
+		return e
+	}
+	if ce := parseCodeError(text); ce != nil {
+		return ce
+	}
+	if text != "成功" {
+		return errors.New(fmt.Sprint("异常返回:", text))
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package op
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 第2版协议版本号
+const codecV2Version = 2
+
+// 帧最大长度
+const frameMaxSize = 16 << 20
+
+// 第2版状态代码
+const (
+	statusOK uint64 = iota
+	statusError
+	statusReject
+	statusHashMismatch
+)
+
+// 第2版头部消息
+//
+//	message Header {
+//	  uint32 version = 1;
+//	  string uuid = 2;
+//	  string text = 3;
+//	  string file_hash = 4;
+//	  int64 file_size = 5;
+//	  string file_name = 6;
+//	}
+type frameHeader struct {
+	version  uint64
+	uuid     string
+	text     string
+	fileHash string
+	fileSize int64
+	fileName string
+}
+
+// 第2版状态消息
+//
+//	message Status {
+//	  uint32 code = 1;
+//	  string message = 2;
+//	  int64 offset = 3;
+//	}
+type frameStatus struct {
+	code    uint64
+	message string
+	offset  int64
+}
+
+func (h *frameHeader) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, h.version)
+	b = appendStringField(b, 2, h.uuid)
+	b = appendStringField(b, 3, h.text)
+	b = appendStringField(b, 4, h.fileHash)
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(h.fileSize))
+	b = appendStringField(b, 6, h.fileName)
+	return b
+}
+
+func (h *frameHeader) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			h.version = v
+		case 2:
+			h.uuid = s
+		case 3:
+			h.text = s
+		case 4:
+			h.fileHash = s
+		case 5:
+			h.fileSize = int64(v)
+		case 6:
+			h.fileName = s
+		}
+	})
+}
+
+func (st *frameStatus) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, st.code)
+	b = appendStringField(b, 2, st.message)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(st.offset))
+	return b
+}
+
+func (st *frameStatus) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			st.code = v
+		case 2:
+			st.message = s
+		case 3:
+			st.offset = int64(v)
+		}
+	})
+}
+
+// 错误转状态
+func statusFromError(e error) frameStatus {
+	if e == nil {
+		return frameStatus{code: statusOK}
+	}
+	var ce *codeError
+	if errors.As(e, &ce) {
+		switch ce.code {
+		case ErrorCodeReject:
+			return frameStatus{code: statusReject, message: ce.detail}
+		case ErrorCodeHashMismatch:
+			return frameStatus{code: statusHashMismatch, message: ce.detail}
+		}
+	}
+	return frameStatus{code: statusError, message: e.Error()}
+}
+
+// 状态转错误, 成功时返回nil
+func (st *frameStatus) err() error {
+	switch st.code {
+	case statusOK:
+		return nil
+	case statusReject:
+		return newCodeError(ErrorCodeReject, st.message)
+	case statusHashMismatch:
+		return newCodeError(ErrorCodeHashMismatch, st.message)
+	case statusError:
+		return errors.New(st.message)
+	}
+	return fmt.Errorf("未知状态%d: %s", st.code, st.message)
+}
+
+// 添加字符字段, 空时省略
+func appendStringField(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// 遍历字段, 忽略未知类型以便以后扩展
+func consumeFields(b []byte, f func(num protowire.Number, v uint64, s string)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, v, "")
+			b = b[n:]
+		case protowire.BytesType:
+			s, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, 0, s)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// 写入帧: 变长整数长度前缀+消息
+func writeFrame(w *bufio.Writer, data []byte) error {
+	_, e := w.Write(protowire.AppendVarint(nil, uint64(len(data))))
+	if e != nil {
+		return e
+	}
+	_, e = w.Write(data)
+	if e != nil {
+		return e
+	}
+	return w.Flush()
+}
+
+// 读取帧
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	size, e := binary.ReadUvarint(r)
+	if e != nil {
+		return nil, e
+	}
+	if size > frameMaxSize {
+		return nil, fmt.Errorf("帧长度%d超出限制", size)
+	}
+	data := make([]byte, size)
+	_, e = io.ReadFull(r, data)
+	if e != nil {
+		return nil, e
+	}
+	return data, nil
+}
+
+// 第2版编解码, 变长整数长度前缀的protobuf帧
+type codecV2 struct {
+	rw *bufio.ReadWriter
+}
+
+func (c *codecV2) readWriter() *bufio.ReadWriter {
+	return c.rw
+}
+
+func (c *codecV2) writeHeader(h frameHeader) error {
+	h.version = codecV2Version
+	return writeFrame(c.rw.Writer, h.marshal())
+}
+
+func (c *codecV2) readHeader() (frameHeader, error) {
+	var h frameHeader
+	data, e := readFrame(c.rw.Reader)
+	if e != nil {
+		return h, e
+	}
+	e = h.unmarshal(data)
+	if e != nil {
+		return h, e
+	}
+	if h.version != codecV2Version {
+		return h, fmt.Errorf("不支持的协议版本%d", h.version)
+	}
+	return h, nil
+}
+
+func (c *codecV2) writeStatus(st frameStatus) error {
+	return writeFrame(c.rw.Writer, st.marshal())
+}
+
+func (c *codecV2) readStatus() (frameStatus, error) {
+	var st frameStatus
+	data, e := readFrame(c.rw.Reader)
+	if e != nil {
+		return st, e
+	}
+	return st, st.unmarshal(data)
+}
+
+func (c *codecV2) writeTextHeader(uuid, text string) error {
+	return c.writeHeader(frameHeader{uuid: uuid, text: text})
+}
+
+func (c *codecV2) readTextHeader() (string, string, error) {
+	h, e := c.readHeader()
+	return h.uuid, h.text, e
+}
+
+func (c *codecV2) writeFileHeader(h fileHeader) error {
+	return c.writeHeader(frameHeader{uuid: h.uuid, fileHash: h.hash, fileSize: h.size, fileName: h.name})
+}
+
+func (c *codecV2) readFileHeader() (fileHeader, error) {
+	h, e := c.readHeader()
+	if e != nil {
+		return fileHeader{}, fmt.Errorf("读取文件头部出错: %w", e)
+	}
+	return fileHeader{uuid: h.uuid, hash: h.fileHash, size: h.fileSize, name: h.fileName}, nil
+}
+
+func (c *codecV2) writeFileOffset(offset int64, e error) error {
+	st := statusFromError(e)
+	st.offset = offset
+	return c.writeStatus(st)
+}
+
+func (c *codecV2) readFileOffset() (int64, error) {
+	st, e := c.readStatus()
+	if e != nil {
+		return 0, e
+	}
+	return st.offset, st.err()
+}
+
+func (c *codecV2) writeResult(e error) error {
+	return c.writeStatus(statusFromError(e))
+}
+
+func (c *codecV2) readResult() error {
+	st, e := c.readStatus()
+	if e != nil {
+		return e
+	}
+	return st.err()
+}
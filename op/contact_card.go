@@ -0,0 +1,292 @@
+package op
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go-open-p2p/qc"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 名片类型
+const contactCardType = "op-card"
+
+// 签名内容前缀, 防止签名被用于其他用途
+const contactCardSignPrefix = "lilu.red/op/card:"
+
+// 名片中最多的地址数量, 防止二维码过大
+const contactCardAddrMax = 8
+
+// 二维码尺寸
+const contactCardQrcodeSize = 512
+
+// 名片有效期
+const contactCardValidity = 7 * 24 * time.Hour
+
+// 允许的时钟偏差, 签发时间晚于当前时间超过这个值时拒绝
+const contactCardClockSkew = 5 * time.Minute
+
+// 名片, 签名内容为前缀加上原样传输的载荷, 验证时不需要重新编码
+type contactCard struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	// 载荷, 使用protobuf编码以减小二维码, JSON中为base64
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// 名片载荷, 验证后以JSON返回
+type contactCardPayload struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Addrs []string `json:"addrs"`
+	// 中继地址, 包含中继的标识, 可选
+	Relay string `json:"relay,omitempty"`
+	// 签发时间, 毫秒
+	Time int64 `json:"time"`
+	// 过期时间, 毫秒
+	Expire int64 `json:"expire"`
+}
+
+// 载荷编码, 字段: 1 节点标识, 2 显示名称, 3 地址(重复), 4 中继地址, 5 签发时间, 6 过期时间
+//
+// 节点标识和地址使用二进制形式
+func (c *contactCardPayload) marshal() ([]byte, error) {
+	peerID, e := peer.Decode(c.ID)
+	if e != nil {
+		return nil, e
+	}
+	var b []byte
+	b = appendStringField(b, 1, string(peerID))
+	b = appendStringField(b, 2, c.Name)
+	for _, v := range c.Addrs {
+		addr, e := multiaddr.NewMultiaddr(v)
+		if e != nil {
+			return nil, e
+		}
+		b = appendStringField(b, 3, string(addr.Bytes()))
+	}
+	if c.Relay != "" {
+		addr, e := multiaddr.NewMultiaddr(c.Relay)
+		if e != nil {
+			return nil, e
+		}
+		b = appendStringField(b, 4, string(addr.Bytes()))
+	}
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(c.Time))
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(c.Expire))
+	return b, nil
+}
+
+func (c *contactCardPayload) unmarshal(b []byte) error {
+	c.Addrs = []string{}
+	var fieldError error
+	e := consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			peerID, e := peer.IDFromBytes([]byte(s))
+			if e != nil {
+				fieldError = e
+				return
+			}
+			c.ID = peerID.Pretty()
+		case 2:
+			c.Name = s
+		case 3, 4:
+			addr, e := multiaddr.NewMultiaddrBytes([]byte(s))
+			if e != nil {
+				fieldError = e
+				return
+			}
+			if num == 3 {
+				c.Addrs = append(c.Addrs, addr.String())
+			} else {
+				c.Relay = addr.String()
+			}
+		case 5:
+			c.Time = int64(v)
+		case 6:
+			c.Expire = int64(v)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	return fieldError
+}
+
+// 签名内容
+func contactCardSignBytes(payload []byte) []byte {
+	return append([]byte(contactCardSignPrefix), payload...)
+}
+
+// 使用节点密钥签名载荷, 返回名片文本
+func contactCardSign(key crypto.PrivKey, p contactCardPayload) (string, error) {
+	payload, e := p.marshal()
+	if e != nil {
+		return "", e
+	}
+	signature, e := key.Sign(contactCardSignBytes(payload))
+	if e != nil {
+		return "", e
+	}
+	jsonBytes, e := json.Marshal(contactCard{Type: contactCardType, Version: 2, Payload: payload, Signature: signature})
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
+
+// 名片的地址信息, 包含通过中继连接的地址
+func (c *contactCardPayload) addrInfo() (peer.AddrInfo, *peer.AddrInfo, error) {
+	peerID, e := peer.Decode(c.ID)
+	if e != nil {
+		return peer.AddrInfo{}, nil, e
+	}
+	info := peer.AddrInfo{ID: peerID}
+	for _, v := range c.Addrs {
+		if addr, e := multiaddr.NewMultiaddr(v); e == nil {
+			info.Addrs = append(info.Addrs, addr)
+		}
+	}
+	if c.Relay == "" {
+		return info, nil, nil
+	}
+	relay, e := peer.AddrInfoFromString(c.Relay)
+	if e != nil {
+		return peer.AddrInfo{}, nil, fmt.Errorf("中继地址错误: %w", e)
+	}
+	circuit, _ := multiaddr.NewMultiaddr(fmt.Sprint("/p2p/", relay.ID.Pretty(), "/p2p-circuit"))
+	for _, addr := range relay.Addrs {
+		info.Addrs = append(info.Addrs, addr.Encapsulate(circuit))
+	}
+	return info, relay, nil
+}
+
+// 创建自己的名片
+//
+// 地址不包含中继地址, 中继使用正在使用的中继, 没有时使用静态中继
+func (n *Node) contactCardCreate(name string) (string, error) {
+	_, h, e := n.started()
+	if e != nil {
+		return "", e
+	}
+	now := time.Now()
+	c := contactCardPayload{ID: h.ID().Pretty(), Name: name, Addrs: []string{}, Time: now.UnixMilli(), Expire: now.Add(contactCardValidity).UnixMilli()}
+	for _, addr := range h.Addrs() {
+		if _, e := addr.ValueForProtocol(multiaddr.P_CIRCUIT); e == nil {
+			if c.Relay == "" {
+				c.Relay = addr.Decapsulate(multiaddr.StringCast("/p2p-circuit")).String()
+			}
+			continue
+		}
+		if len(c.Addrs) < contactCardAddrMax {
+			c.Addrs = append(c.Addrs, addr.String())
+		}
+	}
+	n.mutex.Lock()
+	relays := n.relays
+	n.mutex.Unlock()
+	if c.Relay == "" && len(relays) != 0 && len(relays[0].Addrs) != 0 {
+		addrs, e := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: relays[0].ID, Addrs: relays[0].Addrs[:1]})
+		if e == nil {
+			c.Relay = addrs[0].String()
+		}
+	}
+
+	return contactCardSign(h.Peerstore().PrivKey(h.ID()), c)
+}
+
+// 验证名片签名, 节点已经启动时保存地址并连接
+func (n *Node) contactCardVerify(text string) (string, error) {
+	var card contactCard
+	e := json.Unmarshal([]byte(text), &card)
+	if e != nil || card.Type != contactCardType {
+		return "", errors.New("不是名片")
+	}
+	if card.Version != 2 {
+		return "", fmt.Errorf("不支持的名片版本: %d", card.Version)
+	}
+	var c contactCardPayload
+	e = c.unmarshal(card.Payload)
+	if e != nil {
+		return "", fmt.Errorf("名片载荷错误: %w", e)
+	}
+	info, relay, e := c.addrInfo()
+	if e != nil {
+		return "", e
+	}
+	// 节点标识包含公钥
+	publicKey, e := info.ID.ExtractPublicKey()
+	if e != nil {
+		return "", fmt.Errorf("获取公钥出错: %w", e)
+	}
+	ok, e := publicKey.Verify(contactCardSignBytes(card.Payload), card.Signature)
+	if e != nil || !ok {
+		return "", errors.New("名片签名错误")
+	}
+	now := time.Now()
+	if c.Time > now.Add(contactCardClockSkew).UnixMilli() || c.Expire <= c.Time {
+		return "", errors.New("名片时间错误")
+	}
+	if c.Expire <= now.UnixMilli() {
+		return "", errors.New("名片已经过期")
+	}
+
+	if ctx, h, e := n.started(); e == nil && info.ID != h.ID() {
+		// 不需要通过DHT查找
+		if relay != nil {
+			h.Peerstore().AddAddrs(relay.ID, relay.Addrs, peerstore.AddressTTL)
+		}
+		h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.AddressTTL)
+		go func() {
+			e := connectPeer(ctx, h, info, time.Minute)
+			if e != nil {
+				log.Println("连接名片节点失败", info.ID, e)
+			}
+		}()
+	}
+
+	jsonBytes, e := json.Marshal(c)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
+
+// 创建名片并保存为二维码jpg
+func (n *Node) contactCardQrcodeCreate(path, name string) (string, error) {
+	text, e := n.contactCardCreate(name)
+	if e != nil {
+		return "", e
+	}
+	e = qc.Encode(path, text, contactCardQrcodeSize, contactCardQrcodeSize)
+	if e != nil {
+		return "", fmt.Errorf("生成二维码出错: %w", e)
+	}
+	return text, nil
+}
+
+// 从二维码图片读取名片并验证
+func (n *Node) contactCardQrcodeVerify(path string) (string, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return "", e
+	}
+	text, e := qc.DecodeBytes(data)
+	if e != nil {
+		return "", fmt.Errorf("识别二维码出错: %w", e)
+	}
+	return n.contactCardVerify(text)
+}
@@ -0,0 +1,695 @@
+package op
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 文件夹清单中的文件
+//
+//	message DirEntry {
+//	  string path = 1;
+//	  int64 size = 2;
+//	  string hash = 3;
+//	}
+type dirEntry struct {
+	// 相对路径, 使用/分隔
+	path string
+	size int64
+	hash string
+	// 发送方的绝对路径, 不传输
+	filePath string
+}
+
+// 文件夹清单
+//
+//	message DirManifest {
+//	  uint32 version = 1;
+//	  string uuid = 2;
+//	  string name = 3;
+//	  repeated DirEntry entry = 4;
+//	}
+type dirManifest struct {
+	version uint64
+	uuid    string
+	name    string
+	entries []dirEntry
+}
+
+// 文件夹各个文件已经接收大小
+//
+//	message DirOffset {
+//	  repeated int64 offset = 1;
+//	}
+type dirOffset struct {
+	offsets []int64
+}
+
+func (de *dirEntry) marshal() []byte {
+	var b []byte
+	b = appendStringField(b, 1, de.path)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(de.size))
+	b = appendStringField(b, 3, de.hash)
+	return b
+}
+
+func (de *dirEntry) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			de.path = s
+		case 2:
+			de.size = int64(v)
+		case 3:
+			de.hash = s
+		}
+	})
+}
+
+func (m *dirManifest) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.version)
+	b = appendStringField(b, 2, m.uuid)
+	b = appendStringField(b, 3, m.name)
+	for _, de := range m.entries {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, de.marshal())
+	}
+	return b
+}
+
+func (m *dirManifest) unmarshal(b []byte) error {
+	var entryError error
+	e := consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			m.version = v
+		case 2:
+			m.uuid = s
+		case 3:
+			m.name = s
+		case 4:
+			var de dirEntry
+			if e := de.unmarshal([]byte(s)); e != nil {
+				entryError = e
+			}
+			m.entries = append(m.entries, de)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	return entryError
+}
+
+// 清单哈希, 不包含唯一标识, 用于续传
+func (m *dirManifest) hash() string {
+	hm := *m
+	hm.uuid = ""
+	return fmt.Sprintf("%x", sha256.Sum256(hm.marshal()))
+}
+
+// 文件总大小
+func (m *dirManifest) size() int64 {
+	var size int64
+	for _, de := range m.entries {
+		size += de.size
+	}
+	return size
+}
+
+func (o *dirOffset) marshal() []byte {
+	var b []byte
+	for _, offset := range o.offsets {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(offset))
+	}
+	return b
+}
+
+func (o *dirOffset) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		if num == 1 {
+			o.offsets = append(o.offsets, int64(v))
+		}
+	})
+}
+
+// 检查清单中的相对路径, 防止写到文件夹外面
+func dirEntryPathOk(p string) bool {
+	if p == "" || strings.Contains(p, "\\") || strings.ContainsRune(p, 0) || path.IsAbs(p) {
+		return false
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, ":") {
+			return false
+		}
+	}
+	return true
+}
+
+// 读取文件夹清单, 只包含普通文件, 不包含空文件夹和链接
+func dirManifestGet(dirPath string) (*dirManifest, error) {
+	m := &dirManifest{version: codecV2Version, name: filepath.Base(dirPath)}
+	e := filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, e := d.Info()
+		if e != nil {
+			return e
+		}
+		relPath, e := filepath.Rel(dirPath, filePath)
+		if e != nil {
+			return e
+		}
+		fileHash, e := fileHashGet(filePath)
+		if e != nil {
+			return e
+		}
+		m.entries = append(m.entries, dirEntry{
+			path:     filepath.ToSlash(relPath),
+			size:     fileInfo.Size(),
+			hash:     fileHash,
+			filePath: filePath,
+		})
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if len(m.entries) == 0 {
+		return nil, errors.New("文件夹中没有文件")
+	}
+	return m, nil
+}
+
+// 文件夹发送
+func (n *Node) dirSend(uuid, id, dirPath string) {
+	t, e := n.sendTaskAdd(uuid)
+	if e != nil {
+		n.callback().OnOpFileSendError(uuid, e.Error())
+		return
+	}
+	defer n.sendTaskRemove(uuid)
+
+	n.historyWrite(historyRecord{
+		UUID:      uuid,
+		ID:        id,
+		Direction: historyDirectionSend,
+		Kind:      historyKindDir,
+		FileName:  filepath.Base(dirPath),
+		FilePath:  dirPath,
+		State:     historyStateSend,
+	})
+
+	// 读取清单
+	m, e := dirManifestGet(dirPath)
+	if e != nil {
+		n.fileSendError(t, id, uuid, e)
+		return
+	}
+	m.uuid = uuid
+
+	manifestHash, e := n.dirSendTry(t, id, m)
+	metricsSend(historyKindDir, e, t.isCanceled())
+	if e != nil {
+		n.fileSendError(t, id, uuid, e)
+		return
+	}
+
+	// 通知发送完毕
+	n.historyWrite(historyRecord{UUID: uuid, ID: id, Direction: historyDirectionSend, FileHash: manifestHash, FileSize: m.size(), State: historyStateDone})
+	n.callback().OnOpFileSendDone(uuid, manifestHash)
+}
+
+// 文件夹发送, 对方哈希不符时重新发送, 返回清单哈希
+func (n *Node) dirSendTry(t *sendTask, id string, m *dirManifest) (string, error) {
+	for tryCount := 0; ; tryCount++ {
+		manifestHash, e := n.dirSendOnce(t, id, m)
+		if e == nil {
+			return manifestHash, nil
+		}
+
+		// 哈希不符时对方已经删除这个文件的缓存, 重新发送一次
+		var ce *codeError
+		if errors.As(e, &ce) && ce.code == ErrorCodeHashMismatch && tryCount == 0 && !t.isCanceled() {
+			log.Println("文件夹发送, 对方文件哈希不符, 重新发送", m.uuid, ce.detail)
+			continue
+		}
+
+		return "", e
+	}
+}
+
+// 文件夹发送一次, 返回清单哈希
+func (n *Node) dirSendOnce(t *sendTask, id string, m *dirManifest) (string, error) {
+	s, e := createStream(t.ctx, t.host, id, time.Hour*24, protocolDir)
+	if e != nil {
+		return "", e
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	t.streamSet(s)
+
+	// 创建编解码
+	c := &codecV2{rw: bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))}
+
+	// 清单哈希用于续传和取消
+	manifestHash := m.hash()
+	if t.isCanceled() {
+		return "", context.Canceled
+	}
+	t.fileHashSet(s.Conn().RemotePeer(), manifestHash)
+
+	// 写入清单
+	e = writeFrame(c.rw.Writer, m.marshal())
+	if e != nil {
+		return "", e
+	}
+
+	// 接收是否同意
+	e = c.readResult()
+	if e != nil {
+		return "", e
+	}
+
+	// 接收各个文件已经接收大小
+	data, e := readFrame(c.rw.Reader)
+	if e != nil {
+		return "", e
+	}
+	var o dirOffset
+	e = o.unmarshal(data)
+	if e != nil {
+		return "", e
+	}
+	if len(o.offsets) != len(m.entries) {
+		return "", errors.New("已经接收大小数量和文件数量不符")
+	}
+
+	// 依次写入文件剩余数据
+	fileSize := m.size()
+	var sendSize int64
+	for _, offset := range o.offsets {
+		sendSize += offset
+	}
+	log.Println("文件夹发送, 已经完成大小", sendSize)
+	// 文件数据限速, 让文本优先
+	w := n.rateWriter(t.ctx, s.Conn().RemotePeer(), c.rw)
+	p := n.newProgress(fileSize, sendSize, func(size, speed, averageSpeed, etaSecond int64) {
+		n.callback().OnOpFileSendProgress(m.uuid, fileSize, size, speed, averageSpeed, etaSecond)
+	})
+	defer p.flush()
+	buf := make([]byte, 1048576)
+	for i, de := range m.entries {
+		offset := o.offsets[i]
+		if offset < 0 || offset > de.size {
+			return "", fmt.Errorf("已经接收大小错误: %s %d", de.path, offset)
+		}
+		if offset == de.size {
+			continue
+		}
+
+		e = func() error {
+			f, e := os.Open(de.filePath)
+			if e != nil {
+				return e
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			// 移动到续传位置
+			_, e = f.Seek(offset, 0)
+			if e != nil {
+				return e
+			}
+
+			remain := de.size - offset
+			for remain > 0 {
+				rn, e := f.Read(buf[:min64(remain, int64(len(buf)))])
+				if e != nil && (e != io.EOF || rn == 0) {
+					if e == io.EOF {
+						e = io.ErrUnexpectedEOF
+					}
+					return e
+				}
+				wn, e := w.Write(buf[:rn])
+				if e != nil {
+					return e
+				}
+				remain -= int64(wn)
+				sendSize += int64(wn)
+
+				// 通知发送进度
+				p.update(sendSize)
+			}
+			return nil
+		}()
+		if e != nil {
+			return "", e
+		}
+	}
+	e = c.rw.Flush()
+	if e != nil {
+		return "", e
+	}
+
+	// 接收结果
+	e = c.readResult()
+	if e != nil {
+		return "", e
+	}
+
+	return manifestHash, nil
+}
+
+// 文件夹处理
+func (n *Node) dirStreamHandler(s network.Stream) {
+	remotePeerID := s.Conn().RemotePeer()
+	log.Println("文件夹处理, 对方ID:", remotePeerID)
+	defer func() {
+		_ = s.Close()
+	}()
+	if !n.trustStreamOk(s) {
+		return
+	}
+
+	// 创建编解码
+	c := &codecV2{rw: bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))}
+
+	// 读取清单
+	manifestBytes, e := readFrame(c.rw.Reader)
+	if e != nil {
+		log.Println("文件夹处理, 读取清单出错:", e)
+		return
+	}
+	var m dirManifest
+	e = m.unmarshal(manifestBytes)
+	if e != nil {
+		log.Println("文件夹处理, 解析清单出错:", e)
+		_ = c.writeResult(e)
+		return
+	}
+	// 处理路径前计算哈希, 和对方保持一致
+	manifestHash := m.hash()
+	e = dirManifestCheck(&m)
+	if e != nil {
+		log.Println("文件夹处理, 清单错误:", e)
+		_ = c.writeResult(e)
+		return
+	}
+	fileSize := m.size()
+	dirName := m.name
+	log.Println("文件夹处理, 对方发来文件夹:", manifestHash, fileSize, dirName, len(m.entries))
+
+	// 添加接收任务, 用于识别对方主动取消
+	t := n.receiveTaskAdd(s, manifestHash, m.uuid)
+	defer n.receiveTaskRemove(s)
+
+	// 准备缓存文件夹, 每个文件使用序号作为缓存文件名
+	dirCachePath := filepath.Join(n.config.PublicDir, ".CACHE", remotePeerID.Pretty(), manifestHash)
+	e = os.MkdirAll(dirCachePath, 0700)
+	if e != nil {
+		log.Println("文件夹处理, 创建缓存文件夹出错:", e)
+		return
+	}
+	cachePath := func(i int) string {
+		return filepath.Join(dirCachePath, strconv.Itoa(i))
+	}
+
+	// 确定各个文件已经接收大小
+	o := dirOffset{offsets: make([]int64, len(m.entries))}
+	var finishSize int64
+	for i, de := range m.entries {
+		fileInfo, e := os.Stat(cachePath(i))
+		if e != nil {
+			continue
+		}
+		// 缓存超出文件大小时说明已经损坏, 重新接收
+		if fileInfo.Size() > de.size {
+			cacheRemove(cachePath(i))
+			continue
+		}
+		o.offsets[i] = fileInfo.Size()
+		finishSize += fileInfo.Size()
+	}
+	log.Println("文件夹处理, 已经接收大小:", dirCachePath, finishSize)
+
+	// 通知收到文件夹并等待决定
+	myUUID := uuid.New().String()
+	n.historyWrite(historyRecord{
+		UUID:      myUUID,
+		ID:        remotePeerID.Pretty(),
+		Direction: historyDirectionReceive,
+		Kind:      historyKindDir,
+		FileName:  dirName,
+		FileHash:  manifestHash,
+		FileSize:  fileSize,
+		State:     historyStateWait,
+	})
+	n.callback().OnOpFileReceiveOffer(
+		remotePeerID.Pretty(),
+		manifestHash,
+		dirName,
+		myUUID,
+		fileSize,
+	)
+	accept, reason := n.offerWait(myUUID, t)
+	if t.isCanceled() {
+		log.Println("文件夹处理, 等待决定时对方取消发送")
+		n.fileReceiveCancel(remotePeerID.Pretty(), myUUID)
+		return
+	}
+	if !accept {
+		log.Println("文件夹处理, 拒绝接收:", myUUID, reason)
+		if reason == "" {
+			reason = "拒绝接收"
+		}
+		n.historyReceiveState(remotePeerID.Pretty(), myUUID, historyStateReject, reason)
+		e = c.writeResult(newCodeError(ErrorCodeReject, reason))
+		if e != nil {
+			log.Println("文件夹处理, 写入拒绝接收出错:", e)
+		}
+		return
+	}
+
+	// 写入同意和已经接收大小
+	e = c.writeResult(nil)
+	if e == nil {
+		e = writeFrame(c.rw.Writer, o.marshal())
+	}
+	if e != nil {
+		log.Println("文件夹处理, 写入已经接收大小出错:", e)
+		return
+	}
+
+	// 通知开始接收
+	n.historyReceiveState(remotePeerID.Pretty(), myUUID, historyStateReceive, "")
+	n.callback().OnOpFileReceiveStart(
+		remotePeerID.Pretty(),
+		manifestHash,
+		dirName,
+		myUUID,
+		fileSize,
+	)
+
+	// 依次接收文件
+	receiveSize := finishSize
+	ctx, _ := n.current()
+	r := n.rateReader(ctx, remotePeerID, c.rw.Reader)
+	p := n.newProgress(fileSize, finishSize, func(size, speed, averageSpeed, etaSecond int64) {
+		n.callback().OnOpFileReceiveProgress(myUUID, fileSize, size, speed, averageSpeed, etaSecond)
+	})
+	buf := make([]byte, 1048576)
+	// 哈希不符时继续接收后面的文件, 对方写完全部数据后才读取结果
+	var hashError error
+	for i, de := range m.entries {
+		// 已经接收完的文件也需要校验
+		e = n.dirReceiveEntry(r, cachePath(i), o.offsets[i], de, buf, func(rn int) {
+			receiveSize += int64(rn)
+			p.update(receiveSize)
+		})
+		var ce *codeError
+		if errors.As(e, &ce) && ce.code == ErrorCodeHashMismatch {
+			log.Println("文件夹处理: 文件哈希不符, 继续接收后面的文件", de.path)
+			if hashError == nil {
+				hashError = e
+			}
+			continue
+		}
+		if e != nil {
+			// 对方主动取消, 其他代码错误不是读取出错, 不需要等待
+			isCodeError := errors.As(e, &ce)
+			if !isCodeError && t.canceledWait() {
+				log.Println("文件夹处理: 对方取消发送")
+				n.fileReceiveCancel(remotePeerID.Pretty(), myUUID)
+				return
+			}
+
+			log.Println("文件夹处理: 接收文件出错", de.path, e)
+			n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+			if isCodeError {
+				_ = c.writeResult(e)
+			}
+			return
+		}
+	}
+	if hashError != nil {
+		n.fileReceiveError(remotePeerID.Pretty(), myUUID, hashError.Error())
+		_ = c.writeResult(hashError)
+		return
+	}
+
+	// 移动缓存文件到正式文件夹
+	dirPath := n.fileReceivePath(remotePeerID.Pretty(), dirName, manifestHash)
+	for i, de := range m.entries {
+		filePath := filepath.Join(dirPath, filepath.FromSlash(de.path))
+		e = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if e == nil {
+			e = fileMove(cachePath(i), filePath)
+		}
+		if e != nil {
+			log.Println("文件夹处理, 移动缓存文件为正式文件出错:", e)
+			n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+			_ = c.writeResult(e)
+			return
+		}
+	}
+	_ = os.RemoveAll(dirCachePath)
+
+	// 告知接收完成
+	n.historyWrite(historyRecord{UUID: myUUID, ID: remotePeerID.Pretty(), Direction: historyDirectionReceive, FilePath: dirPath, State: historyStateDone})
+	n.callback().OnOpFileReceiveDone(myUUID, dirPath)
+
+	// 回复
+	e = c.writeResult(nil)
+	if e != nil {
+		log.Println("文件夹处理, 回复对方成功时出错:", e)
+	}
+}
+
+// 检查清单, 防止路径穿越和重复路径
+//
+// 文件夹名称和路径中的每一级名称都通过 fileNameSanitize 处理
+func dirManifestCheck(m *dirManifest) error {
+	if m.version != codecV2Version {
+		return fmt.Errorf("不支持的协议版本%d", m.version)
+	}
+	m.name = fileNameSanitize(m.name)
+	if len(m.entries) == 0 {
+		return errors.New("文件夹中没有文件")
+	}
+	pathMap := make(map[string]bool)
+	for i := range m.entries {
+		de := &m.entries[i]
+		if !dirEntryPathOk(de.path) {
+			return fmt.Errorf("文件路径无效: %s", de.path)
+		}
+		if de.size < 0 {
+			return fmt.Errorf("文件大小无效: %s", de.path)
+		}
+		names := strings.Split(de.path, "/")
+		for j, name := range names {
+			names[j] = fileNameSanitize(name)
+		}
+		de.path = strings.Join(names, "/")
+		// 不区分大小写, 兼容不区分大小写的文件系统
+		key := strings.ToLower(de.path)
+		if pathMap[key] {
+			return fmt.Errorf("文件路径重复: %s", de.path)
+		}
+		pathMap[key] = true
+	}
+	// 文件路径不能同时是文件夹路径
+	for _, de := range m.entries {
+		for p := path.Dir(de.path); p != "."; p = path.Dir(p) {
+			if pathMap[strings.ToLower(p)] {
+				return fmt.Errorf("文件路径冲突: %s", de.path)
+			}
+		}
+	}
+	return nil
+}
+
+// 接收文件夹中的一个文件到缓存, 完成后校验哈希
+func (n *Node) dirReceiveEntry(r io.Reader, fileCachePath string, offset int64, de dirEntry, buf []byte, progress func(rn int)) error {
+	// 恢复哈希状态, 接收时同时计算哈希
+	shaHash, e := cacheHashLoad(fileCachePath, offset)
+	if e != nil {
+		return fmt.Errorf("加载哈希状态出错: %w", e)
+	}
+
+	f, e := os.OpenFile(fileCachePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	remain := de.size - offset
+	for remain > 0 {
+		rn, e := r.Read(buf[:min64(remain, int64(len(buf)))])
+		if e != nil && (e != io.EOF || rn == 0) {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return e
+		}
+		wn, e := f.Write(buf[:rn])
+		if e != nil {
+			return e
+		}
+		_, _ = shaHash.Write(buf[:wn])
+		remain -= int64(wn)
+
+		// 保存哈希状态, 续传时不用重新读取缓存
+		e = cacheHashSave(fileCachePath, de.size-remain, shaHash)
+		if e != nil {
+			log.Println("文件夹处理: 保存哈希状态出错", e)
+		}
+		progress(wn)
+	}
+	_ = f.Close()
+
+	// 校验文件哈希, 不符时删除缓存让对方重新发送
+	receiveHash := fmt.Sprintf("%x", shaHash.Sum(nil))
+	if receiveHash != de.hash {
+		log.Println("文件夹处理, 文件哈希不符:", de.path, de.hash, receiveHash)
+		cacheRemove(fileCachePath)
+		return newCodeError(ErrorCodeHashMismatch, receiveHash)
+	}
+	_ = os.Remove(cacheHashStatePath(fileCachePath))
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
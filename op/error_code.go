@@ -0,0 +1,58 @@
+package op
+
+import (
+	"strings"
+)
+
+// 错误代码
+//
+// 带代码的错误文本格式为 "代码:说明", 通过 ErrorCode 获取其中的代码
+const (
+	// ErrorCodeReject 对方拒绝接收
+	ErrorCodeReject = "reject"
+	// ErrorCodeHashMismatch 接收的文件哈希不符, 说明为实际哈希
+	ErrorCodeHashMismatch = "hash"
+	// ErrorCodePassphrase 密钥密码错误或者需要密码
+	ErrorCodePassphrase = "passphrase"
+)
+
+// 带代码的错误
+type codeError struct {
+	code   string
+	detail string
+}
+
+func (ce *codeError) Error() string {
+	return ce.code + ":" + ce.detail
+}
+
+// 创建带代码的错误
+func newCodeError(code, detail string) error {
+	return &codeError{code: code, detail: detail}
+}
+
+// 从错误文本中解析带代码的错误, 不是已知代码时返回nil
+func parseCodeError(et string) *codeError {
+	code := ErrorCode(et)
+	if code == "" {
+		return nil
+	}
+	return &codeError{code: code, detail: strings.TrimPrefix(et, code+":")}
+}
+
+// ErrorCode 获取错误文本中的错误代码
+//
+// et 回调中的错误文本
+//
+// 不是已知代码时返回空
+func ErrorCode(et string) string {
+	i := strings.Index(et, ":")
+	if i == -1 {
+		return ""
+	}
+	switch code := et[:i]; code {
+	case ErrorCodeReject, ErrorCodeHashMismatch, ErrorCodePassphrase:
+		return code
+	}
+	return ""
+}
@@ -1,14 +1,13 @@
 package op
 
 import (
-	"bufio"
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,129 +15,186 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func initExchange(h host.Host) {
+func (n *Node) initExchange(h host.Host) {
 	log.Println("初始化交换")
-	h.SetStreamHandler(protocolText, textStreamHandler)
-	h.SetStreamHandler(protocolFile, fileStreamHandler)
+	h.SetStreamHandler(protocolText, n.textStreamHandler)
+	h.SetStreamHandler(protocolTextV2, n.textStreamHandler)
+	h.SetStreamHandler(protocolFile, n.fileStreamHandler)
+	h.SetStreamHandler(protocolFileV2, n.fileStreamHandler)
+	h.SetStreamHandler(protocolDir, n.dirStreamHandler)
+	h.SetStreamHandler(protocolCancel, n.cancelStreamHandler)
+	h.SetStreamHandler(protocolReceipt, n.receiptStreamHandler)
 }
 
 // 文本处理
-func textStreamHandler(s network.Stream) {
+func (n *Node) textStreamHandler(s network.Stream) {
 	remotePeerID := s.Conn().RemotePeer()
-	log.Println("文本处理, 对方ID:", remotePeerID)
+	log.Println("文本处理, 对方ID:", remotePeerID, s.Protocol())
 	defer func() {
 		_ = s.Close()
 	}()
+	if !n.trustStreamOk(s) {
+		return
+	}
 
-	// 创建读写器
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	// 创建编解码
+	c := newExchangeCodec(s)
 
-	// 读取
-	requestBytes, e := readTextFromReadWriter(rw)
+	// 读取, 读取时文件数据让出
+	var requestUUID, requestText string
+	e := n.rateLimiter.priorityRead(s, c.readWriter().Reader, time.Minute, func() (e error) {
+		requestUUID, requestText, e = c.readTextHeader()
+		return e
+	})
 	if e != nil {
 		log.Println("文本处理, 读取对方发来内容出错:", e)
 		return
 	}
-	requestText := string(*requestBytes)
 	log.Println("文本处理, 对方发来内容:", requestText)
 
+	// 记录, 第1版没有唯一标识, 也不支持回执
+	receiptEnable := requestUUID != ""
+	if !receiptEnable {
+		requestUUID = uuid.New().String()
+	}
+	n.historyWrite(historyRecord{
+		UUID:      requestUUID,
+		ID:        remotePeerID.Pretty(),
+		Direction: historyDirectionReceive,
+		Kind:      historyKindText,
+		Text:      requestText,
+		State:     historyStateDone,
+	})
+
 	// 通知收到
-	globalCallback.OnOpTextReceiveDone(remotePeerID.Pretty(), requestText)
+	n.callback().OnOpTextReceiveDone(remotePeerID.Pretty(), requestText, requestUUID)
 
 	// 回复
-	responseBytes := []byte("成功")
-	e = writeTextToReadWriter(rw, &responseBytes)
+	e = n.rateLimiter.priorityWrite(s, func() error {
+		return c.writeResult(nil)
+	})
 	if e != nil {
 		log.Println("文本处理, 回复对方成功时出错:", e)
+		return
+	}
+
+	// 应用已经处理, 告知对方送达
+	if receiptEnable {
+		e = n.receiptSend(remotePeerID.Pretty(), requestUUID, receiptDelivered)
+		if e != nil {
+			log.Println("文本处理, 发送送达回执出错:", e)
+		}
 	}
 }
 
 // 文本发送
-func textSend(uuid, id, text string) {
-	s, e := createStream(globalContext, globalHost, id, protocolText, time.Minute)
+func (n *Node) textSend(uuid, id, text string) {
+	t, e := n.sendTaskAdd(uuid)
 	if e != nil {
-		globalCallback.OnOpTextSendError(uuid, e.Error())
+		n.callback().OnOpTextSendError(uuid, e.Error())
 		return
 	}
-	defer func() {
-		_ = s.Close()
-	}()
+	defer n.sendTaskRemove(uuid)
 
-	// 创建读写器
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	n.historyWrite(historyRecord{
+		UUID:      uuid,
+		ID:        id,
+		Direction: historyDirectionSend,
+		Kind:      historyKindText,
+		Text:      text,
+		State:     historyStateSend,
+	})
 
-	// 写入
-	data := []byte(text)
-	e = writeTextToReadWriter(rw, &data)
+	e = n.textSendOnce(t, uuid, id, text)
+	metricsSend(historyKindText, e, t.isCanceled())
 	if e != nil {
-		globalCallback.OnOpTextSendError(uuid, e.Error())
+		n.textSendError(t, id, uuid, e)
 		return
 	}
 
-	// 接收
-	resultBytes, e := readTextFromReadWriter(rw)
+	// 通知发送完毕
+	n.historySendState(id, uuid, historyStateDone, nil)
+	n.callback().OnOpTextSendDone(uuid)
+}
+
+// 文本发送一次
+func (n *Node) textSendOnce(t *sendTask, uuid, id, text string) error {
+	// 文本较小, 允许使用有限制的中继连接
+	s, e := createStream(network.WithUseTransient(t.ctx, "text"), t.host, id, time.Minute, protocolTextV2, protocolText)
 	if e != nil {
-		globalCallback.OnOpTextSendError(uuid, e.Error())
-		return
+		return e
 	}
-	resultText := string(*resultBytes)
+	defer func() {
+		_ = s.Close()
+	}()
+	t.streamSet(s)
 
-	// 检查异常状态
-	if resultText != "成功" {
-		globalCallback.OnOpTextSendError(uuid, fmt.Sprint("异常返回:", resultText))
-		return
+	// 创建编解码
+	c := newExchangeCodec(s)
+
+	// 写入, 写入和读取结果时文件数据让出. 对方处理后才回复, 最多等待1分钟
+	e = n.rateLimiter.priorityWrite(s, func() error {
+		return c.writeTextHeader(uuid, text)
+	})
+	if e != nil {
+		return e
 	}
 
-	// 通知发送完毕
-	globalCallback.OnOpTextSendDone(uuid)
+	// 接收结果
+	return n.rateLimiter.priorityRead(s, c.readWriter().Reader, time.Minute, c.readResult)
+}
+
+// 文本发送出错, 区分取消和错误
+func (n *Node) textSendError(t *sendTask, id, uuid string, e error) {
+	if t.isCanceled() {
+		n.historySendState(id, uuid, historyStateCancel, nil)
+		n.callback().OnOpTextSendCancel(uuid)
+		return
+	}
+	n.historySendState(id, uuid, historyStateError, e)
+	n.callback().OnOpTextSendError(uuid, e.Error())
 }
 
 // 文件处理
-func fileStreamHandler(s network.Stream) {
+func (n *Node) fileStreamHandler(s network.Stream) {
 	remotePeerID := s.Conn().RemotePeer()
-	log.Println("文件处理, 对方ID:", remotePeerID)
+	log.Println("文件处理, 对方ID:", remotePeerID, s.Protocol())
 	defer func() {
 		_ = s.Close()
 	}()
-
-	// 创建读写器
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-
-	// 读取文件哈希
-	requestBytes, e := readTextFromReadWriter(rw)
-	if e != nil {
-		log.Println("文件处理, 读取对方文件哈希出错:", e)
+	if !n.trustStreamOk(s) {
 		return
 	}
-	fileHash := string(*requestBytes)
-	log.Println("文件处理, 对方发来文件哈希:", fileHash)
 
-	// 读取文件大小
-	requestBytes, e = readTextFromReadWriter(rw)
-	if e != nil {
-		log.Println("文件处理, 读取对方文件大小出错:", e)
-		return
-	}
-	fileSizeText := string(*requestBytes)
-	log.Println("文件处理, 对方发来文件大小:", fileSizeText)
-	fileSize, e := strconv.ParseInt(fileSizeText, 10, 64)
+	// 创建编解码
+	c := newExchangeCodec(s)
+	rw := c.readWriter()
+
+	// 读取文件头部
+	header, e := c.readFileHeader()
 	if e != nil {
-		log.Println("文件处理, 转换对方文件大小出错:", e)
+		log.Println("文件处理, 读取对方文件头部出错:", e)
 		return
 	}
+	fileHash := header.hash
+	fileSize := header.size
+	fileName := fileNameSanitize(header.name)
+	log.Println("文件处理, 对方发来文件:", fileHash, fileSize, fileName)
 
-	// 读取文件名称
-	requestBytes, e = readTextFromReadWriter(rw)
-	if e != nil {
-		log.Println("文件处理, 读取对方文件名称出错:", e)
+	// 文件哈希用作缓存文件名称, 必须检查
+	if !fileHashOk(fileHash) || fileSize < 0 {
+		log.Println("文件处理, 文件头部无效:", fileHash, fileSize)
+		_ = c.writeFileOffset(0, fmt.Errorf("文件头部无效: %q %d", fileHash, fileSize))
 		return
 	}
-	fileName := string(*requestBytes)
-	log.Println("文件处理, 对方发来文件名称:", fileName)
+
+	// 添加接收任务, 用于识别对方主动取消
+	t := n.receiveTaskAdd(s, fileHash, header.uuid)
+	defer n.receiveTaskRemove(s)
 
 	// 准备临时文件路径
-	fileCacheDir := filepath.Join(globalPublicDirectory, ".CACHE", remotePeerID.Pretty())
-	e = os.MkdirAll(fileCacheDir, os.ModePerm)
+	fileCacheDir := filepath.Join(n.config.PublicDir, ".CACHE", remotePeerID.Pretty())
+	e = os.MkdirAll(fileCacheDir, 0700)
 	if e != nil {
 		log.Println("文件处理, 创建缓存文件夹出错:", e)
 		return
@@ -151,18 +207,61 @@ func fileStreamHandler(s network.Stream) {
 	if e == nil {
 		finishSize = fileInfo.Size()
 	}
+	// 缓存超出文件大小时说明已经损坏, 重新接收
+	if finishSize > fileSize {
+		cacheRemove(fileCachePath)
+		finishSize = 0
+	}
 	log.Println("文件处理, 已经接收大小:", fileCachePath, finishSize)
+
+	// 通知收到文件并等待决定
+	myUUID := uuid.New().String()
+	n.historyWrite(historyRecord{
+		UUID:      myUUID,
+		ID:        remotePeerID.Pretty(),
+		Direction: historyDirectionReceive,
+		Kind:      historyKindFile,
+		FileName:  fileName,
+		FileHash:  fileHash,
+		FileSize:  fileSize,
+		State:     historyStateWait,
+	})
+	n.callback().OnOpFileReceiveOffer(
+		remotePeerID.Pretty(),
+		fileHash,
+		fileName,
+		myUUID,
+		fileSize,
+	)
+	accept, reason := n.offerWait(myUUID, t)
+	if t.isCanceled() {
+		log.Println("文件处理, 等待决定时对方取消发送")
+		n.fileReceiveCancel(remotePeerID.Pretty(), myUUID)
+		return
+	}
+	if !accept {
+		log.Println("文件处理, 拒绝接收:", myUUID, reason)
+		if reason == "" {
+			reason = "拒绝接收"
+		}
+		n.historyReceiveState(remotePeerID.Pretty(), myUUID, historyStateReject, reason)
+		e = c.writeFileOffset(0, newCodeError(ErrorCodeReject, reason))
+		if e != nil {
+			log.Println("文件处理, 写入拒绝接收出错:", e)
+		}
+		return
+	}
+
 	// 写入已经接收大小
-	data := []byte(strconv.FormatInt(finishSize, 10))
-	e = writeTextToReadWriter(rw, &data)
+	e = c.writeFileOffset(finishSize, nil)
 	if e != nil {
 		log.Println("文件处理, 写入已经接收大小出错:", e)
 		return
 	}
 
 	// 通知开始接收
-	myUUID := uuid.New().String()
-	globalCallback.OnOpFileReceiveStart(
+	n.historyReceiveState(remotePeerID.Pretty(), myUUID, historyStateReceive, "")
+	n.callback().OnOpFileReceiveStart(
 		remotePeerID.Pretty(),
 		fileHash,
 		fileName,
@@ -170,25 +269,50 @@ func fileStreamHandler(s network.Stream) {
 		fileSize,
 	)
 
+	// 恢复哈希状态, 接收时同时计算哈希
+	shaHash, e := cacheHashLoad(fileCachePath, finishSize)
+	if e != nil {
+		log.Println("文件处理, 加载哈希状态出错:", e)
+		n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+		return
+	}
+
 	// 开始接收文件
-	f, _ := os.OpenFile(fileCachePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	f, e := os.OpenFile(fileCachePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if e != nil {
+		log.Println("文件处理, 打开缓存文件出错:", e)
+		n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+		return
+	}
 	defer func() {
 		_ = f.Close()
 	}()
+	// 文件数据限速, 让文本优先
+	ctx, _ := n.current()
+	r := n.rateReader(ctx, remotePeerID, rw)
+	p := n.newProgress(fileSize, finishSize, func(size, speed, averageSpeed, etaSecond int64) {
+		n.callback().OnOpFileReceiveProgress(myUUID, fileSize, size, speed, averageSpeed, etaSecond)
+	})
 	var doneSum int64 //完成长度
 	buf := make([]byte, 1048576)
-	for {
+	for finishSize+doneSum < fileSize {
 		var rn int
-		rn, e = rw.Read(buf)
-		if e != nil {
-			if e == io.EOF {
-				log.Println("文件处理: 读取完毕")
-			} else {
-				log.Println("文件处理: 读取数据出错", e)
-				// 告知接收错误
-				globalCallback.OnOpFileReceiveError(myUUID, e.Error())
+		rn, e = r.Read(buf)
+		if e != nil && (e != io.EOF || rn == 0) {
+			// 对方主动取消
+			if t.canceledWait() {
+				log.Println("文件处理: 对方取消发送")
+				n.fileReceiveCancel(remotePeerID.Pretty(), myUUID)
 				return
 			}
+
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			log.Println("文件处理: 读取数据出错", e)
+			// 告知接收错误
+			n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+			return
 		}
 
 		var wn int
@@ -197,213 +321,325 @@ func fileStreamHandler(s network.Stream) {
 			if e != nil {
 				log.Println("文件处理: 保存数据出错", e)
 				// 告知接收错误
-				globalCallback.OnOpFileReceiveError(myUUID, e.Error())
+				n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
 				return
 			}
+			_, _ = shaHash.Write(buf[0:wn])
 		}
 
 		// 累加完成长度
 		doneSum += int64(wn)
 
-		// 告知接收进度
-		globalCallback.OnOpFileReceiveProgress(myUUID, fileSize, finishSize+doneSum)
+		// 保存哈希状态, 续传时不用重新读取缓存
+		e = cacheHashSave(fileCachePath, finishSize+doneSum, shaHash)
+		if e != nil {
+			log.Println("文件处理: 保存哈希状态出错", e)
+		}
 
-		// 判断是否完成
-		if finishSize+doneSum == fileSize {
-			break
+		// 告知接收进度
+		p.update(finishSize + doneSum)
+	}
+	_ = f.Close()
+
+	// 校验文件哈希, 不符时删除缓存让对方从头发送
+	receiveHash := fmt.Sprintf("%x", shaHash.Sum(nil))
+	if receiveHash != fileHash {
+		log.Println("文件处理, 文件哈希不符:", fileHash, receiveHash)
+		cacheRemove(fileCachePath)
+		ce := newCodeError(ErrorCodeHashMismatch, receiveHash)
+		n.fileReceiveError(remotePeerID.Pretty(), myUUID, ce.Error())
+		e = c.writeResult(ce)
+		if e != nil {
+			log.Println("文件处理, 回复对方哈希不符时出错:", e)
 		}
+		return
 	}
 
 	// 移动缓存文件为正式文件
-	filePath := filepath.Join(globalPublicDirectory, fileName)
-	_, e = os.Stat(filePath)
+	filePath := n.fileReceivePath(remotePeerID.Pretty(), fileName, fileHash)
+	e = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
 	if e == nil {
-		filePath = filepath.Join(globalPublicDirectory, fmt.Sprintf("[%d]%s", time.Now().Nanosecond(), fileName))
+		e = fileMove(fileCachePath, filePath)
 	}
-	// 某些Windows中最后移动时可能存在多个进程争用文件问题, 多试几次来解决
-	tryMoveCount := 0
-	for tryMoveCount < 3 {
-		e = os.Rename(fileCachePath, filePath)
-
-		if e != nil {
-			// 1秒后重试
-			if tryMoveCount < 3 {
-				tryMoveCount++
-				time.Sleep(time.Second)
-				continue
-			}
-
-			// 返回错误
-			log.Println("文件处理, 移动缓存文件为正式文件出错:", e)
-			// 告知接收错误
-			globalCallback.OnOpFileReceiveError(myUUID, e.Error())
-			return
-		}
-
-		// 移动成功跳出循环
-		break
+	if e != nil {
+		log.Println("文件处理, 移动缓存文件为正式文件出错:", e)
+		// 告知接收错误
+		n.fileReceiveError(remotePeerID.Pretty(), myUUID, e.Error())
+		return
 	}
+	_ = os.Remove(cacheHashStatePath(fileCachePath))
 
 	// 告知接收完成
-	globalCallback.OnOpFileReceiveDone(myUUID, filePath)
+	n.historyWrite(historyRecord{UUID: myUUID, ID: remotePeerID.Pretty(), Direction: historyDirectionReceive, FilePath: filePath, State: historyStateDone})
+	n.callback().OnOpFileReceiveDone(myUUID, filePath)
 
-	// 回复1
-	responseBytes := []byte("成功")
-	e = writeTextToReadWriter(rw, &responseBytes)
+	// 回复
+	e = c.writeResult(nil)
 	if e != nil {
 		log.Println("文件处理, 回复对方成功时出错:", e)
 	}
 }
 
+// 移动缓存文件为正式文件
+//
+// 某些Windows中最后移动时可能存在多个进程争用文件问题, 多试几次来解决
+func fileMove(fileCachePath, filePath string) error {
+	var e error
+	for tryMoveCount := 0; tryMoveCount < 3; tryMoveCount++ {
+		e = os.Rename(fileCachePath, filePath)
+		if e == nil {
+			return nil
+		}
+		// 1秒后重试
+		time.Sleep(time.Second)
+	}
+	return e
+}
+
+// 文件接收出错
+func (n *Node) fileReceiveError(id, uuid, et string) {
+	n.historyReceiveState(id, uuid, historyStateError, et)
+	n.callback().OnOpFileReceiveError(uuid, et)
+}
+
+// 文件接收取消(对方取消发送)
+func (n *Node) fileReceiveCancel(id, uuid string) {
+	n.historyReceiveState(id, uuid, historyStateCancel, "")
+	n.callback().OnOpFileReceiveCancel(uuid)
+}
+
 // 文件发送
-func fileSend(uuid, id, filePath string) {
-	s, e := createStream(globalContext, globalHost, id, protocolFile, time.Hour*24)
+func (n *Node) fileSend(uuid, id, filePath string) {
+	t, e := n.sendTaskAdd(uuid)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
+		n.callback().OnOpFileSendError(uuid, e.Error())
 		return
 	}
-	defer func() {
-		_ = s.Close()
-	}()
+	defer n.sendTaskRemove(uuid)
+
+	n.historyWrite(historyRecord{
+		UUID:      uuid,
+		ID:        id,
+		Direction: historyDirectionSend,
+		Kind:      historyKindFile,
+		FileName:  filepath.Base(filePath),
+		FilePath:  filePath,
+		State:     historyStateSend,
+	})
+
+	fileHash, e := n.fileSendTry(t, uuid, id, filePath)
+	metricsSend(historyKindFile, e, t.isCanceled())
+	if e != nil {
+		n.fileSendError(t, id, uuid, e)
+		return
+	}
+
+	// 通知发送完毕
+	n.historyWrite(historyRecord{UUID: uuid, ID: id, Direction: historyDirectionSend, FileHash: fileHash, State: historyStateDone})
+	n.callback().OnOpFileSendDone(uuid, fileHash)
+}
+
+// 文件发送, 对方哈希不符时重新发送, 返回文件哈希
+func (n *Node) fileSendTry(t *sendTask, uuid, id, filePath string) (string, error) {
+	for tryCount := 0; ; tryCount++ {
+		fileHash, e := n.fileSendOnce(t, uuid, id, filePath)
+		if e == nil {
+			return fileHash, nil
+		}
 
-	// 创建读写器
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+		// 哈希不符时对方已经删除缓存, 从头重新发送一次
+		var ce *codeError
+		if errors.As(e, &ce) && ce.code == ErrorCodeHashMismatch && tryCount == 0 && !t.isCanceled() {
+			log.Println("文件发送, 对方文件哈希不符, 重新发送", uuid)
+			continue
+		}
 
+		return "", e
+	}
+}
+
+// 文件发送一次, 返回文件哈希
+func (n *Node) fileSendOnce(t *sendTask, uuid, id, filePath string) (string, error) {
 	// 获取文件信息
 	fileInfo, e := os.Stat(filePath)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return "", e
 	}
-	fileSize := fileInfo.Size()
-	fileName := fileInfo.Name()
 
 	// 获取文件哈希
-	f1, e := os.Open(filePath)
+	fileHash, e := fileHashGet(filePath)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return "", e
 	}
-	shaHash := sha256.New()
-	if _, e := io.Copy(shaHash, f1); e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
-	}
-	fileHash := fmt.Sprintf("%x", shaHash.Sum(nil))
-	e = f1.Close()
-	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+
+	// 计算哈希期间可能已经取消
+	if t.isCanceled() {
+		return "", context.Canceled
 	}
 
-	// 写入文件哈希
-	data := []byte(fileHash)
-	e = writeTextToReadWriter(rw, &data)
+	h := fileHeader{uuid: uuid, hash: fileHash, size: fileInfo.Size(), name: fileInfo.Name()}
+	e = n.fileSendData(t, id, h, func(sendSize int64) (io.ReadCloser, error) {
+		f, e := os.Open(filePath)
+		if e != nil {
+			return nil, e
+		}
+		// 移动到续传位置
+		_, e = f.Seek(sendSize, 0)
+		if e != nil {
+			_ = f.Close()
+			return nil, e
+		}
+		return f, nil
+	})
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return "", e
 	}
+	return fileHash, nil
+}
 
-	// 写入文件大小
-	data = []byte(strconv.FormatInt(fileSize, 10))
-	e = writeTextToReadWriter(rw, &data)
+// 写入文件头部并发送数据
+//
+// open 返回从续传位置开始的数据
+func (n *Node) fileSendData(t *sendTask, id string, h fileHeader, open func(sendSize int64) (io.ReadCloser, error)) error {
+	s, e := createStream(t.ctx, t.host, id, time.Hour*24, protocolFileV2, protocolFile)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return e
 	}
+	defer func() {
+		_ = s.Close()
+	}()
+	t.streamSet(s)
+	t.fileHashSet(s.Conn().RemotePeer(), h.hash)
+
+	// 创建编解码
+	c := newExchangeCodec(s)
+	rw := c.readWriter()
 
-	// 写入文件名称
-	data = []byte(fileName)
-	e = writeTextToReadWriter(rw, &data)
+	// 写入文件头部
+	e = c.writeFileHeader(h)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return e
 	}
 
 	// 接收已经发送大小
-	resultBytes, e := readTextFromReadWriter(rw)
+	sendSize, e := c.readFileOffset()
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
-	}
-	resultText := string(*resultBytes)
-	sendSize, e := strconv.ParseInt(resultText, 10, 64)
-	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return e
 	}
 	log.Println("文件发送, 已经完成大小", sendSize)
 
 	// 写入文件数据
-	f2, e := os.Open(filePath)
+	r, e := open(sendSize)
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return e
 	}
 	defer func() {
-		_ = f2.Close()
+		_ = r.Close()
 	}()
 
-	// 移动到续传位置
-	_, e = f2.Seek(sendSize, 0)
-	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
-	}
-
+	// 文件数据限速, 让文本优先
+	w := n.rateWriter(t.ctx, s.Conn().RemotePeer(), rw)
+	p := n.newProgress(h.size, sendSize, func(size, speed, averageSpeed, etaSecond int64) {
+		n.callback().OnOpFileSendProgress(h.uuid, h.size, size, speed, averageSpeed, etaSecond)
+	})
+	defer p.flush()
 	var doneSum int64 //完成长度
 	buf := make([]byte, 1048576)
-	for {
-		rn, e := f2.Read(buf)
-		if e != nil {
+	for sendSize+doneSum < h.size {
+		rn, e := r.Read(buf)
+		if e != nil && (e != io.EOF || rn == 0) {
 			if e == io.EOF {
-				log.Println("发送文件数据读取完毕")
-			} else {
-				log.Println("发送文件读取数据出错", e)
-				globalCallback.OnOpFileSendError(uuid, e.Error())
-				return
+				e = io.ErrUnexpectedEOF
 			}
+			log.Println("发送文件读取数据出错", e)
+			return e
+		}
+		// 忽略超过文件大小的数据
+		if remain := h.size - sendSize - doneSum; int64(rn) > remain {
+			rn = int(remain)
 		}
 
-		var wn int
-		if rn > 0 {
-			wn, e = rw.Write(buf[0:rn])
-			if e != nil {
-				globalCallback.OnOpFileSendError(uuid, e.Error())
-				return
-			}
+		wn, e := w.Write(buf[0:rn])
+		if e != nil {
+			return e
 		}
 
 		// 累加完成长度
 		doneSum += int64(wn)
 
 		// 通知发送进度
-		globalCallback.OnOpFileSendProgress(uuid, fileSize, sendSize+doneSum)
-
-		if sendSize+doneSum == fileSize {
-			break
-		}
+		p.update(sendSize + doneSum)
 	}
 	e = rw.Flush()
 	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+		return e
 	}
 
 	// 接收结果
-	resultBytes, e = readTextFromReadWriter(rw)
-	if e != nil {
-		globalCallback.OnOpFileSendError(uuid, e.Error())
-		return
+	return c.readResult()
+}
+
+// 数据流发送, 阻塞直到完成
+//
+// 数据只能读取一次, 出错时不会重试
+func (n *Node) fileSendReader(uuid, id, fileName, fileHash string, fileSize int64, r io.Reader) error {
+	if _, _, e := n.started(); e != nil {
+		return e
+	}
+	if !IdOk(id) {
+		return errors.New("节点标识无效")
+	}
+	if !fileHashOk(fileHash) || fileSize < 0 {
+		return errors.New("文件哈希或者大小无效")
 	}
-	resultText = string(*resultBytes)
 
-	// 检查异常状态
-	if resultText != "成功" {
-		globalCallback.OnOpFileSendError(uuid, fmt.Sprint("异常返回:", resultText))
-		return
+	t, e := n.sendTaskAdd(uuid)
+	if e != nil {
+		return e
+	}
+	defer n.sendTaskRemove(uuid)
+
+	n.historyWrite(historyRecord{
+		UUID:      uuid,
+		ID:        id,
+		Direction: historyDirectionSend,
+		Kind:      historyKindFile,
+		FileName:  fileName,
+		FileHash:  fileHash,
+		FileSize:  fileSize,
+		State:     historyStateSend,
+	})
+
+	// 读取时校验哈希, 不符时中止发送
+	r = newHashCheckReader(r, fileHash, fileSize)
+	h := fileHeader{uuid: uuid, hash: fileHash, size: fileSize, name: fileName}
+	e = n.fileSendData(t, id, h, func(sendSize int64) (io.ReadCloser, error) {
+		// 跳过对方已经接收的部分
+		_, e := io.CopyN(io.Discard, r, sendSize)
+		if e != nil {
+			return nil, e
+		}
+		return io.NopCloser(r), nil
+	})
+	metricsSend(historyKindFile, e, t.isCanceled())
+	if e != nil {
+		n.fileSendError(t, id, uuid, e)
+		return e
 	}
 
 	// 通知发送完毕
-	globalCallback.OnOpFileSendDone(uuid, fileHash)
+	n.historyWrite(historyRecord{UUID: uuid, ID: id, Direction: historyDirectionSend, State: historyStateDone})
+	n.callback().OnOpFileSendDone(uuid, fileHash)
+	return nil
+}
+
+// 文件发送出错, 区分取消和错误
+func (n *Node) fileSendError(t *sendTask, id, uuid string, e error) {
+	if t.isCanceled() {
+		n.historySendState(id, uuid, historyStateCancel, nil)
+		n.callback().OnOpFileSendCancel(uuid)
+		return
+	}
+	n.historySendState(id, uuid, historyStateError, e)
+	n.callback().OnOpFileSendError(uuid, e.Error())
 }
@@ -0,0 +1,130 @@
+package op
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// 计算文件哈希
+func fileHashGet(filePath string) (string, error) {
+	f, e := os.Open(filePath)
+	if e != nil {
+		return "", e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	shaHash := sha256.New()
+	if _, e := io.Copy(shaHash, f); e != nil {
+		return "", e
+	}
+	return fmt.Sprintf("%x", shaHash.Sum(nil)), nil
+}
+
+// 读取时计算哈希的读取器, 最多读取 remain 字节
+//
+// 读取到最后时哈希不符则返回错误, 不返回最后一次读取的数据, 防止对方收到完整的错误数据
+type hashCheckReader struct {
+	r        io.Reader
+	shaHash  hash.Hash
+	remain   int64
+	fileHash string
+}
+
+func newHashCheckReader(r io.Reader, fileHash string, fileSize int64) *hashCheckReader {
+	return &hashCheckReader{r: r, shaHash: sha256.New(), remain: fileSize, fileHash: fileHash}
+}
+
+func (hr *hashCheckReader) Read(p []byte) (int, error) {
+	if hr.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > hr.remain {
+		p = p[:hr.remain]
+	}
+	rn, e := hr.r.Read(p)
+	_, _ = hr.shaHash.Write(p[:rn])
+	hr.remain -= int64(rn)
+	if hr.remain == 0 {
+		readHash := fmt.Sprintf("%x", hr.shaHash.Sum(nil))
+		if readHash != hr.fileHash {
+			return 0, newCodeError(ErrorCodeHashMismatch, "数据哈希和文件哈希不符: "+readHash)
+		}
+	}
+	return rn, e
+}
+
+// 检查文件哈希格式, 小写十六进制的SHA-256
+func fileHashOk(fileHash string) bool {
+	if len(fileHash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range fileHash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// 缓存文件哈希状态路径
+func cacheHashStatePath(fileCachePath string) string {
+	return fileCachePath + ".sha256"
+}
+
+// 加载缓存文件的哈希状态, 用于续传时继续计算哈希
+//
+// 哈希状态和缓存大小不一致时重新读取缓存文件计算
+func cacheHashLoad(fileCachePath string, cacheSize int64) (hash.Hash, error) {
+	shaHash := sha256.New()
+	if cacheSize == 0 {
+		return shaHash, nil
+	}
+
+	stateBytes, e := os.ReadFile(cacheHashStatePath(fileCachePath))
+	if e == nil && len(stateBytes) > 8 && int64(binary.BigEndian.Uint64(stateBytes[:8])) == cacheSize {
+		e = shaHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(stateBytes[8:])
+		if e == nil {
+			return shaHash, nil
+		}
+		shaHash.Reset()
+	}
+
+	// 重新计算
+	f, e := os.Open(fileCachePath)
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, e = io.CopyN(shaHash, f, cacheSize)
+	if e != nil {
+		return nil, e
+	}
+	return shaHash, nil
+}
+
+// 保存缓存文件的哈希状态
+func cacheHashSave(fileCachePath string, cacheSize int64, shaHash hash.Hash) error {
+	stateBytes, e := shaHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if e != nil {
+		return e
+	}
+	data := make([]byte, 8, 8+len(stateBytes))
+	binary.BigEndian.PutUint64(data, uint64(cacheSize))
+	data = append(data, stateBytes...)
+	return os.WriteFile(cacheHashStatePath(fileCachePath), data, 0600)
+}
+
+// 删除缓存文件及其哈希状态
+func cacheRemove(fileCachePath string) {
+	_ = os.Remove(fileCachePath)
+	_ = os.Remove(cacheHashStatePath(fileCachePath))
+}
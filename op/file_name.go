@@ -0,0 +1,136 @@
+package op
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 文件名称最大字节数, 大部分文件系统限制为255字节
+const fileNameMaxSize = 255
+
+// 接收时没有有效名称的默认名称
+const fileNameDefault = "unnamed"
+
+// FilePathPolicy 接收文件保存路径策略
+type FilePathPolicy interface {
+	// FileReceivePath 返回接收文件或文件夹的保存绝对路径, 返回空时保存到公共文件夹
+	//
+	// id 节点标识
+	//
+	// fileName 已经处理过的安全名称
+	//
+	// fileHash 文件哈希, 文件夹时为清单哈希
+	//
+	// 路径已经存在时会自动添加序号
+	FileReceivePath(id, fileName, fileHash string) string
+}
+
+// Windows保留名称, 不区分大小写, 带扩展名也不行
+var fileNameReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 处理对方发来的文件名称
+//
+// 去掉文件夹部分, 替换控制字符和Windows保留字符, 处理保留名称, 限制长度
+func fileNameSanitize(name string) string {
+	// 去掉文件夹部分, 同时支持两种分隔符
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows不允许结尾是点或空格
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return fileNameDefault
+	}
+
+	base := name
+	if i := strings.Index(base, "."); i != -1 {
+		base = base[:i]
+	}
+	if fileNameReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+
+	return fileNameTruncate(name, fileNameMaxSize)
+}
+
+// 限制名称字节数, 尽量保留扩展名
+func fileNameTruncate(name string, maxSize int) string {
+	if len(name) <= maxSize {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxSize/2 {
+		ext = ""
+	}
+	base := name[:maxSize-len(ext)]
+	// 不要截断多字节字符
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
+
+// 获取不存在的路径, 存在时在名称后面添加序号
+func fileNameUnique(dirPath, name string) string {
+	filePath := filepath.Join(dirPath, name)
+	if _, e := os.Lstat(filePath); os.IsNotExist(e) {
+		return filePath
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i < 1000; i++ {
+		suffix := fmt.Sprintf("(%d)%s", i, ext)
+		filePath = filepath.Join(dirPath, fileNameTruncate(base, fileNameMaxSize-len(suffix))+suffix)
+		if _, e := os.Lstat(filePath); os.IsNotExist(e) {
+			return filePath
+		}
+	}
+	suffix := fmt.Sprintf("(%d)%s", time.Now().UnixNano(), ext)
+	return filepath.Join(dirPath, fileNameTruncate(base, fileNameMaxSize-len(suffix))+suffix)
+}
+
+// 设置接收文件保存路径策略
+func (n *Node) filePathPolicySet(policy FilePathPolicy) {
+	n.filePathPolicyMutex.Lock()
+	n.filePathPolicy = policy
+	n.filePathPolicyMutex.Unlock()
+}
+
+// 确定接收文件或文件夹的保存路径
+//
+// fileName 对方发来的名称, 会先进行处理
+func (n *Node) fileReceivePath(id, fileName, fileHash string) string {
+	fileName = fileNameSanitize(fileName)
+
+	n.filePathPolicyMutex.Lock()
+	policy := n.filePathPolicy
+	n.filePathPolicyMutex.Unlock()
+	if policy != nil {
+		filePath := policy.FileReceivePath(id, fileName, fileHash)
+		if filePath != "" && filepath.IsAbs(filePath) {
+			return fileNameUnique(filepath.Dir(filePath), filepath.Base(filePath))
+		}
+	}
+
+	return fileNameUnique(n.config.PublicDir, fileName)
+}
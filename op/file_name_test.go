@@ -0,0 +1,135 @@
+package op
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFileNameSanitize(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.txt":                "a.txt",
+		"../../private/my.key": "my.key",
+		`..\..\private\my.key`: "my.key",
+		"C:my.key":             "C_my.key",
+		"/etc/passwd":          "passwd",
+		"..":                   fileNameDefault,
+		".":                    fileNameDefault,
+		"":                     fileNameDefault,
+		"dir/":                 fileNameDefault,
+		"a\x00b\nc.txt":        "a_b_c.txt",
+		`a<b>c"d|e?f*.txt`:     "a_b_c_d_e_f_.txt",
+		"CON":                  "_CON",
+		"con.txt":              "_con.txt",
+		"LPT1.tar.gz":          "_LPT1.tar.gz",
+		"CONSOLE.txt":          "CONSOLE.txt",
+		"a.txt. . ":            "a.txt",
+		"文件.txt":               "文件.txt",
+	} {
+		if got := fileNameSanitize(name); got != want {
+			t.Errorf("fileNameSanitize(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	// 限制长度, 保留扩展名, 不截断多字节字符
+	got := fileNameSanitize(strings.Repeat("文", 200) + ".txt")
+	if len(got) > fileNameMaxSize || !strings.HasSuffix(got, ".txt") || !utf8.ValidString(got) {
+		t.Error("长度限制错误", len(got), got)
+	}
+}
+
+// 测试策略
+type testFilePathPolicy struct {
+	dir string
+}
+
+func (p *testFilePathPolicy) FileReceivePath(id, fileName, fileHash string) string {
+	return filepath.Join(p.dir, id, fileName)
+}
+
+// 直接写入对方发来的文件头部, 模拟恶意节点
+func testFileSendRaw(t *testing.T, a *Node, b *Node, name string, data []byte) {
+	s, e := createStream(a.ctx, a.host, b.ID(), time.Minute, protocolFileV2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	c := newExchangeCodec(s)
+	e = c.writeFileHeader(fileHeader{uuid: "test", hash: fmt.Sprintf("%x", sha256.Sum256(data)), size: int64(len(data)), name: name})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = c.readFileOffset()
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = c.readWriter().Write(data)
+	if e == nil {
+		e = c.readWriter().Flush()
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.readResult()
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestNodeFileReceiveHostileName(t *testing.T) {
+	a, _, b, bCallback := startTestNodePair(t)
+
+	for i, item := range []struct{ name, want string }{
+		{"../../private/my.key", "my.key"},
+		{`..\..\my.key`, "my(1).key"},
+		{"CON", "_CON"},
+		{"a\x00b", "a_b"},
+		{"..", fileNameDefault},
+		{"a.txt", "a.txt"},
+		{"a.txt", "a(1).txt"},
+	} {
+		testFileSendRaw(t, a, b, item.name, []byte{byte(i)})
+		select {
+		case receivePath := <-bCallback.fileReceiveChan:
+			if receivePath != filepath.Join(b.config.PublicDir, item.want) {
+				t.Fatalf("接收路径错误 %q: %s", item.name, receivePath)
+			}
+		case <-time.After(time.Minute):
+			t.Fatal("接收超时")
+		}
+	}
+
+	// 文件哈希用作缓存文件名称
+	s, e := createStream(a.ctx, a.host, b.ID(), time.Minute, protocolFileV2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c := newExchangeCodec(s)
+	e = c.writeFileHeader(fileHeader{uuid: "test", hash: "../../my.key", size: 1, name: "a.txt"})
+	if e == nil {
+		_, e = c.readFileOffset()
+	}
+	_ = s.Close()
+	if e == nil {
+		t.Fatal("没有拒绝无效的文件哈希")
+	}
+
+	// 策略决定路径
+	policyDir := t.TempDir()
+	b.FilePathPolicySet(&testFilePathPolicy{dir: policyDir})
+	testFileSendRaw(t, a, b, "../b.txt", []byte("b"))
+	select {
+	case receivePath := <-bCallback.fileReceiveChan:
+		if receivePath != filepath.Join(policyDir, a.ID(), "b.txt") {
+			t.Fatal("策略路径错误", receivePath)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+}
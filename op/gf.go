@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	libp2p_dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -20,10 +21,12 @@ import (
 )
 
 // 获取密钥(没有时生成, 存在时加载)
-func getPrivateKey(privateKeyPath string) (*crypto.PrivKey, error) {
+//
+// passphrase 不为空时加密保存, 已经存在的未加密密钥自动加密. 旧版本保存的密钥文件权限自动改为只有自己可以读写
+func getPrivateKey(privateKeyPath, passphrase string) (*crypto.PrivKey, error) {
 	var privateKey crypto.PrivKey
 	var privateKeyBytes []byte
-	_, e := os.Stat(privateKeyPath)
+	fileInfo, e := os.Stat(privateKeyPath)
 	if os.IsNotExist(e) {
 		privateKey, _, e = crypto.GenerateKeyPair(
 			crypto.Ed25519, // Select your key type. Ed25519 are nice short
@@ -36,19 +39,40 @@ func getPrivateKey(privateKeyPath string) (*crypto.PrivKey, error) {
 		if e != nil {
 			return nil, e
 		}
-		e = os.WriteFile(privateKeyPath, privateKeyBytes, os.ModePerm)
+		e = keyWrite(privateKeyPath, privateKeyBytes, passphrase)
 		if e != nil {
 			return nil, e
 		}
+	} else if e != nil {
+		return nil, e
 	} else {
-		privateKeyBytes, e = os.ReadFile(privateKeyPath)
+		data, e := os.ReadFile(privateKeyPath)
 		if e != nil {
 			return nil, e
 		}
+		privateKeyBytes = data
+		if keyEncrypted(data) {
+			privateKeyBytes, e = keyDecrypt(data, passphrase)
+			if e != nil {
+				return nil, e
+			}
+		}
 		privateKey, e = crypto.UnmarshalPrivateKey(privateKeyBytes)
 		if e != nil {
 			return nil, e
 		}
+
+		// 迁移旧版本的密钥文件
+		if !keyEncrypted(data) && passphrase != "" {
+			log.Println("加密保存密钥")
+			e = keyWrite(privateKeyPath, privateKeyBytes, passphrase)
+		} else if fileInfo.Mode().Perm()&0077 != 0 {
+			log.Println("修改密钥文件权限")
+			e = os.Chmod(privateKeyPath, 0600)
+		}
+		if e != nil {
+			return nil, e
+		}
 	}
 	return &privateKey, nil
 }
@@ -65,13 +89,6 @@ func multiaddrToAddrInfo(multiaddrText string) (*peer.AddrInfo, error) {
 		return nil, fmt.Errorf("多址字符转节点地址出错: %w", e)
 	}
 
-	// 在节点地址中添加中继多址
-	relayMultiAddr, e := multiaddr.NewMultiaddr(fmt.Sprint("/p2p-circuit/p2p/", addrInfo.ID.Pretty()))
-	if e != nil {
-		return nil, fmt.Errorf("创建中继多址出错: %w", e)
-	}
-	addrInfo.Addrs = append(addrInfo.Addrs, relayMultiAddr)
-
 	return addrInfo, nil
 }
 
@@ -125,22 +142,18 @@ func connectBootstrap(gc context.Context, h host.Host, multiaddrText string) {
 }
 
 // 从DHT中查找节点地址信息
-func findAddrInfoFromDHT(gc context.Context, id peer.ID) (*peer.AddrInfo, error) {
+func findAddrInfoFromDHT(gc context.Context, dht *libp2p_dht.IpfsDHT, id peer.ID) (*peer.AddrInfo, error) {
 	localContext, localContextCancel := context.WithTimeout(gc, time.Second)
 	defer localContextCancel()
-	addrInfo, e := globalDHT.FindPeer(localContext, id)
-	if e != nil {
-		return nil, e
-	}
-
-	// 地址信息中添加中继地址, 支持没有公网IP的用户
-	//参考 https://github.com/libp2p/go-libp2p-examples/blob/master/relay/main.go
-	relayMultiAddr, e := multiaddr.NewMultiaddr(fmt.Sprint("/p2p-circuit/ipfs/", id.Pretty()))
+	start := time.Now()
+	addrInfo, e := dht.FindPeer(localContext, id)
 	if e != nil {
+		metricsDHTLookupSeconds.WithLabelValues("error").Observe(time.Since(start).Seconds())
 		return nil, e
 	}
-	addrInfo.Addrs = append(addrInfo.Addrs, relayMultiAddr)
+	metricsDHTLookupSeconds.WithLabelValues("ok").Observe(time.Since(start).Seconds())
 
+	// 对方通过中继预留的地址已经包含在其中
 	return &addrInfo, nil
 }
 
@@ -152,11 +165,13 @@ func connectCount(h host.Host, id peer.ID) int {
 // 创建节点的流
 //
 // 注意: defer s.Close()
-func createStream(gc context.Context, h host.Host, id string, protocolID protocol.ID, timeout time.Duration) (network.Stream, error) {
+//
+// protocolIDs 按优先顺序协商
+func createStream(gc context.Context, h host.Host, id string, timeout time.Duration, protocolIDs ...protocol.ID) (network.Stream, error) {
 	peerID, _ := peer.Decode(id)
 	lc, lcCancel := context.WithTimeout(gc, timeout)
 	defer lcCancel()
-	return h.NewStream(lc, peerID, protocolID)
+	return h.NewStream(lc, peerID, protocolIDs...)
 }
 
 // 从读写器中获取文本
@@ -0,0 +1,383 @@
+package op
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 记录方向
+const (
+	historyDirectionSend    = "send"
+	historyDirectionReceive = "receive"
+)
+
+// 记录类型
+const (
+	historyKindText = "text"
+	historyKindFile = "file"
+	historyKindDir  = "dir"
+)
+
+// 记录状态
+const (
+	// 在发送队列中等待, 或者等待决定是否接收
+	historyStateWait = "wait"
+	// 正在发送
+	historyStateSend = "send"
+	// 正在接收
+	historyStateReceive = "receive"
+	// 完成
+	historyStateDone = "done"
+	// 出错
+	historyStateError = "error"
+	// 取消
+	historyStateCancel = "cancel"
+	// 拒绝接收
+	historyStateReject = "reject"
+)
+
+// 默认查询数量
+const historyQueryLimit = 20
+
+// 消息记录
+//
+// 每个节点一个文件, 每行一条JSON. 状态变化时追加相同唯一标识的记录, 查询时合并
+type historyRecord struct {
+	UUID       string `json:"uuid"`
+	ID         string `json:"id"`
+	Direction  string `json:"direction"`
+	Kind       string `json:"kind,omitempty"`
+	Text       string `json:"text,omitempty"`
+	FileName   string `json:"fileName,omitempty"`
+	FilePath   string `json:"filePath,omitempty"`
+	FileHash   string `json:"fileHash,omitempty"`
+	FileSize   int64  `json:"fileSize,omitempty"`
+	State      string `json:"state"`
+	Error      string `json:"error,omitempty"`
+	Time       int64  `json:"time"`                 // 创建时间, 毫秒时间戳
+	UpdateTime int64  `json:"updateTime,omitempty"` // 状态更新时间, 毫秒时间戳
+	// 文本送达时间, 毫秒时间戳
+	DeliverTime int64 `json:"deliverTime,omitempty"`
+	// 文本已读时间, 毫秒时间戳
+	ReadTime int64 `json:"readTime,omitempty"`
+}
+
+// 记录文件路径
+func (n *Node) historyPath(id string) string {
+	return filepath.Join(n.config.PrivateDir, "history", id+".jsonl")
+}
+
+// 写入记录, 只需要设置变化的字段, 状态为空表示不变
+func (n *Node) historyWrite(r historyRecord) {
+	if !IdOk(r.ID) {
+		log.Println("写入消息记录时节点标识无效", r.ID)
+		return
+	}
+	r.Time = time.Now().UnixMilli()
+	data, e := json.Marshal(r)
+	if e != nil {
+		log.Println("消息记录转换JSON出错", e)
+		return
+	}
+	data = append(data, '\n')
+
+	n.historyMutex.Lock()
+	defer n.historyMutex.Unlock()
+	historyPath := n.historyPath(r.ID)
+	e = os.MkdirAll(filepath.Dir(historyPath), 0700)
+	if e != nil {
+		log.Println("创建消息记录文件夹出错", e)
+		return
+	}
+	f, e := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if e != nil {
+		log.Println("打开消息记录出错", e)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	// 写入都在锁中, 没有换行结尾说明上次写入中断, 先结束中断的行, 避免新记录接在后面
+	info, e := f.Stat()
+	if e != nil {
+		log.Println("读取消息记录信息出错", e)
+		return
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		_, e = f.ReadAt(last, info.Size()-1)
+		if e != nil {
+			log.Println("读取消息记录出错", e)
+			return
+		}
+		if last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	_, e = f.Write(data)
+	if e != nil {
+		log.Println("写入消息记录出错", e)
+	}
+}
+
+// 写入发送状态
+func (n *Node) historySendState(id, uuid, state string, e error) {
+	r := historyRecord{UUID: uuid, ID: id, Direction: historyDirectionSend, State: state}
+	if e != nil {
+		r.Error = e.Error()
+	}
+	n.historyWrite(r)
+}
+
+// 写入接收状态
+func (n *Node) historyReceiveState(id, uuid, state, et string) {
+	n.historyWrite(historyRecord{UUID: uuid, ID: id, Direction: historyDirectionReceive, State: state, Error: et})
+}
+
+// 记录在文件中的一行
+type historyLine struct {
+	offset int64
+	length int64
+}
+
+// 记录的索引项, 包含相同唯一标识的所有行
+type historyIndexItem struct {
+	key   string
+	time  int64
+	lines []historyLine
+}
+
+// 记录文件索引, 避免查找和查询时读取整个文件
+//
+// 文件只会追加, 每次使用前从上次索引的位置继续读取
+type historyIndex struct {
+	size    int64
+	itemMap map[string]*historyIndexItem
+	// 按创建时间从旧到新
+	items []*historyIndexItem
+}
+
+// 记录的索引键
+func historyKey(direction, uuid string) string {
+	return direction + "/" + uuid
+}
+
+// 添加一行到索引
+func (idx *historyIndex) add(r *historyRecord, line historyLine) {
+	key := historyKey(r.Direction, r.UUID)
+	item, ok := idx.itemMap[key]
+	if ok {
+		item.lines = append(item.lines, line)
+		return
+	}
+	item = &historyIndexItem{key: key, time: r.Time, lines: []historyLine{line}}
+	idx.itemMap[key] = item
+	// 时间通常递增, 系统时间调整时插入到对应位置
+	i := len(idx.items)
+	for i > 0 && idx.items[i-1].time > item.time {
+		i--
+	}
+	idx.items = append(idx.items, nil)
+	copy(idx.items[i+1:], idx.items[i:])
+	idx.items[i] = item
+}
+
+// 更新记录文件索引, 需要在锁中调用
+func (n *Node) historyIndexUpdate(f *os.File, path string) (*historyIndex, error) {
+	info, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+	idx, ok := n.historyIndexMap[path]
+	if !ok || info.Size() < idx.size {
+		idx = &historyIndex{itemMap: make(map[string]*historyIndexItem)}
+		n.historyIndexMap[path] = idx
+	}
+	if info.Size() == idx.size {
+		return idx, nil
+	}
+
+	_, e = f.Seek(idx.size, io.SeekStart)
+	if e != nil {
+		return nil, e
+	}
+	reader := bufio.NewReader(f)
+	for {
+		data, e := reader.ReadBytes('\n')
+		if e == io.EOF {
+			// 没有换行的是正在写入或者写入中断的行, 下次再读取
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		line := historyLine{offset: idx.size, length: int64(len(data))}
+		idx.size += line.length
+		var r historyRecord
+		e = json.Unmarshal(data, &r)
+		if e != nil {
+			// 忽略写入中断的行
+			log.Println("解析消息记录出错", e)
+			continue
+		}
+		idx.add(&r, line)
+	}
+	return idx, nil
+}
+
+// 读取索引项的所有行, 合并状态变化
+func historyReadItem(f *os.File, item *historyIndexItem) (*historyRecord, error) {
+	var result *historyRecord
+	for _, line := range item.lines {
+		data := make([]byte, line.length)
+		_, e := f.ReadAt(data, line.offset)
+		if e != nil {
+			return nil, e
+		}
+		var r historyRecord
+		e = json.Unmarshal(data, &r)
+		if e != nil {
+			return nil, e
+		}
+		if result == nil {
+			result = &r
+			continue
+		}
+		historyMerge(result, &r)
+	}
+	return result, nil
+}
+
+// 合并状态变化到已有记录
+func historyMerge(old, r *historyRecord) {
+	if r.State != "" {
+		old.State = r.State
+		old.Error = r.Error
+	}
+	old.UpdateTime = r.Time
+	if r.FileName != "" {
+		old.FileName = r.FileName
+	}
+	if r.FilePath != "" {
+		old.FilePath = r.FilePath
+	}
+	if r.FileHash != "" {
+		old.FileHash = r.FileHash
+	}
+	if r.FileSize != 0 {
+		old.FileSize = r.FileSize
+	}
+	if r.DeliverTime != 0 {
+		old.DeliverTime = r.DeliverTime
+	}
+	if r.ReadTime != 0 {
+		old.ReadTime = r.ReadTime
+	}
+}
+
+// 使用索引读取节点的记录
+//
+// 按创建时间从新到旧调用pick, 第一个返回值表示是否读取该记录, 第二个表示是否继续
+func (n *Node) historyRead(id string, pick func(item *historyIndexItem) (bool, bool)) ([]*historyRecord, error) {
+	n.historyMutex.Lock()
+	defer n.historyMutex.Unlock()
+
+	path := n.historyPath(id)
+	f, e := os.Open(path)
+	if os.IsNotExist(e) {
+		delete(n.historyIndexMap, path)
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	idx, e := n.historyIndexUpdate(f, path)
+	if e != nil {
+		return nil, e
+	}
+
+	var array []*historyRecord
+	for i := len(idx.items) - 1; i >= 0; i-- {
+		ok, next := pick(idx.items[i])
+		if ok {
+			r, e := historyReadItem(f, idx.items[i])
+			if e != nil {
+				return nil, e
+			}
+			array = append(array, r)
+		}
+		if !next {
+			break
+		}
+	}
+	return array, nil
+}
+
+// 查找记录, 不存在时返回nil
+func (n *Node) historyFind(id, direction, uuid string) (*historyRecord, error) {
+	key := historyKey(direction, uuid)
+	array, e := n.historyRead(id, func(item *historyIndexItem) (bool, bool) {
+		found := item.key == key
+		return found, !found
+	})
+	if e != nil || len(array) == 0 {
+		return nil, e
+	}
+	return array[0], nil
+}
+
+// 查询记录JSON数组, 按时间从新到旧
+//
+// before和beforeUUID是上一页最后一条记录的时间和唯一标识, 相同毫秒的记录按索引顺序翻页
+func (n *Node) historyQuery(id string, before int64, beforeUUID string, limit int64) (string, error) {
+	if !IdOk(id) {
+		return "", errors.New("节点标识无效")
+	}
+	if limit <= 0 {
+		limit = historyQueryLimit
+	}
+
+	var beforeKeys []string
+	if beforeUUID != "" {
+		beforeKeys = []string{historyKey(historyDirectionSend, beforeUUID), historyKey(historyDirectionReceive, beforeUUID)}
+	}
+	// 是否已经经过上一页最后一条记录
+	passed := false
+	var count int64
+	result, e := n.historyRead(id, func(item *historyIndexItem) (bool, bool) {
+		if before > 0 && item.time > before {
+			return false, true
+		}
+		if before > 0 && item.time == before && !passed {
+			for _, key := range beforeKeys {
+				if item.key == key {
+					passed = true
+				}
+			}
+			return false, true
+		}
+		count++
+		return true, count < limit
+	})
+	if e != nil {
+		return "", e
+	}
+	if result == nil {
+		result = []*historyRecord{}
+	}
+
+	jsonBytes, e := json.Marshal(result)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
@@ -0,0 +1,122 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestHistoryIndex(t *testing.T) {
+	n := NewNode(&NodeConfig{PrivateDir: t.TempDir()})
+	key, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	peerID, _ := peer.IDFromPrivateKey(key)
+	id := peerID.Pretty()
+	query := func(before int64, beforeUUID string, limit int64) []historyRecord {
+		jt, e := n.historyQuery(id, before, beforeUUID, limit)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var records []historyRecord
+		e = json.Unmarshal([]byte(jt), &records)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return records
+	}
+
+	if len(query(0, "", 0)) != 0 {
+		t.Fatal("没有记录时查询结果不为空")
+	}
+	for i := 0; i < 5; i++ {
+		n.historyWrite(historyRecord{UUID: fmt.Sprint(i), ID: id, Direction: historyDirectionSend, Kind: historyKindText, Text: fmt.Sprint("文本", i), State: historyStateWait})
+	}
+	fileInfo, e := os.Stat(n.historyPath(id))
+	if e != nil {
+		t.Fatal(e)
+	}
+	dirInfo, e := os.Stat(filepath.Dir(n.historyPath(id)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if fileInfo.Mode().Perm() != 0600 || dirInfo.Mode().Perm() != 0700 {
+		t.Fatal("消息记录权限错误", fileInfo.Mode(), dirInfo.Mode())
+	}
+	records := query(0, "", 2)
+	if len(records) != 2 || records[0].UUID != "4" || records[1].UUID != "3" {
+		t.Fatal("查询数量或者顺序错误", records)
+	}
+
+	// 索引之后追加的状态变化和写入中断的行
+	n.historySendState(id, "1", historyStateDone, nil)
+	f, e := os.OpenFile(n.historyPath(id), os.O_APPEND|os.O_WRONLY, 0600)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, _ = f.WriteString("{\"uuid\":\"中断\n{\"uuid\":")
+	_ = f.Close()
+	r, e := n.historyFind(id, historyDirectionSend, "1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if r == nil || r.State != historyStateDone || r.Text != "文本1" || r.UpdateTime == 0 {
+		t.Fatal("没有合并状态变化", r)
+	}
+	r, e = n.historyFind(id, historyDirectionReceive, "1")
+	if e != nil || r != nil {
+		t.Fatal("找到了不存在的记录", r, e)
+	}
+
+	// 写入中断的行之后继续写入
+	n.historyWrite(historyRecord{UUID: "5", ID: id, Direction: historyDirectionReceive, Kind: historyKindText, Text: "文本5", State: historyStateDone})
+	r, e = n.historyFind(id, historyDirectionReceive, "5")
+	if e != nil || r == nil || r.Text != "文本5" {
+		t.Fatal("中断的行之后写入的记录丢失", r, e)
+	}
+
+	records = query(0, "", 0)
+	if len(records) != 6 {
+		t.Fatal("查询数量错误", len(records))
+	}
+	before := records[1].Time + 1
+	for _, r := range query(before, "", 0) {
+		if r.Time >= before {
+			t.Fatal("查询结果不早于指定时间", r)
+		}
+	}
+
+	// 同一毫秒的记录翻页时不能跳过
+	f, e = os.OpenFile(n.historyPath(id), os.O_APPEND|os.O_WRONLY, 0600)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 6; i < 9; i++ {
+		data, _ := json.Marshal(historyRecord{UUID: fmt.Sprint(i), ID: id, Direction: historyDirectionSend, Kind: historyKindText, State: historyStateDone, Time: 1})
+		_, _ = f.Write(append(data, '\n'))
+	}
+	_ = f.Close()
+	var uuids []string
+	var last *historyRecord
+	for {
+		var page []historyRecord
+		if last == nil {
+			page = query(0, "", 2)
+		} else {
+			page = query(last.Time, last.UUID, 2)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, r := range page {
+			uuids = append(uuids, r.UUID)
+		}
+		last = &page[len(page)-1]
+	}
+	if fmt.Sprint(uuids) != "[5 4 3 2 1 0 8 7 6]" {
+		t.Fatal("翻页结果错误", uuids)
+	}
+}
@@ -0,0 +1,314 @@
+package op
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go-open-p2p/qc"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// 迁移二维码类型
+const identityMigrateType = "op-migrate"
+
+// 迁移密码错误次数上限, 超过后停止接收
+const identityMigrateAttemptMax = 3
+
+// 迁移二维码内容
+type identityMigrateText struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id"`
+	Addrs  []string `json:"addrs"`
+	Secret string   `json:"secret"`
+}
+
+// 迁移结果
+type identityMigrateResult struct {
+	id string
+	e  error
+}
+
+// 等待中的迁移接收
+type identityMigrate struct {
+	secret   string
+	host     host.Host
+	attempts int
+	done     chan identityMigrateResult
+}
+
+// 读取自己的密钥, 加密时使用启动密码解密
+func (n *Node) identityKeyBytes() ([]byte, error) {
+	if n.config.PrivateDir == "" {
+		return nil, errors.New("没有设置私有文件夹")
+	}
+	data, e := os.ReadFile(filepath.Join(n.config.PrivateDir, "my.key"))
+	if e != nil {
+		return nil, e
+	}
+	if !keyEncrypted(data) {
+		return data, nil
+	}
+	n.mutex.Lock()
+	passphrase := n.config.Passphrase
+	n.mutex.Unlock()
+	return keyDecrypt(data, passphrase)
+}
+
+// 检查并保存密钥, 使用启动密码加密. 返回密钥对应的节点标识
+func (n *Node) identityWrite(keyBytes []byte) (string, error) {
+	if n.config.PrivateDir == "" {
+		return "", errors.New("没有设置私有文件夹")
+	}
+	key, e := crypto.UnmarshalPrivateKey(keyBytes)
+	if e != nil {
+		return "", fmt.Errorf("解析密钥出错: %w", e)
+	}
+	peerID, e := peer.IDFromPrivateKey(key)
+	if e != nil {
+		return "", e
+	}
+	n.mutex.Lock()
+	passphrase := n.config.Passphrase
+	n.mutex.Unlock()
+	e = keyWrite(filepath.Join(n.config.PrivateDir, "my.key"), keyBytes, passphrase)
+	if e != nil {
+		return "", fmt.Errorf("保存密钥出错: %w", e)
+	}
+	log.Println("导入身份, 再次启动后生效", peerID)
+	return peerID.Pretty(), nil
+}
+
+// 导出身份, 备份使用密码加密
+func (n *Node) identityExport(passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", newCodeError(ErrorCodePassphrase, "导出身份需要密码")
+	}
+	keyBytes, e := n.identityKeyBytes()
+	if e != nil {
+		return "", e
+	}
+	data, e := keyEncrypt(keyBytes, passphrase)
+	if e != nil {
+		return "", e
+	}
+	log.Println("导出身份")
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// 导入身份, 覆盖现有的密钥
+func (n *Node) identityImport(blob, passphrase string) (string, error) {
+	data, e := base64.RawURLEncoding.DecodeString(blob)
+	if e != nil || !keyEncrypted(data) {
+		return "", errors.New("身份备份格式错误")
+	}
+	keyBytes, e := keyDecrypt(data, passphrase)
+	if e != nil {
+		return "", e
+	}
+	return n.identityWrite(keyBytes)
+}
+
+// 开始接收迁移, 返回二维码内容. qrPath 不为空时将二维码保存为jpg
+//
+// 二维码包含自己的标识, 局域网地址和一次性密码, 再次调用时之前的二维码失效
+func (n *Node) identityMigrateReceive(qrPath string) (string, error) {
+	_, h, e := n.started()
+	if e != nil {
+		return "", e
+	}
+	secretBytes := make([]byte, 16)
+	_, e = rand.Read(secretBytes)
+	if e != nil {
+		return "", e
+	}
+	t := identityMigrateText{Type: identityMigrateType, ID: h.ID().Pretty(), Addrs: []string{}, Secret: hex.EncodeToString(secretBytes)}
+	for _, addr := range h.Addrs() {
+		// 只使用局域网的直连地址
+		if manet.IsPublicAddr(addr) {
+			continue
+		}
+		if _, e := addr.ValueForProtocol(multiaddr.P_CIRCUIT); e == nil {
+			continue
+		}
+		t.Addrs = append(t.Addrs, addr.String())
+	}
+	if len(t.Addrs) == 0 {
+		return "", errors.New("没有局域网地址")
+	}
+	jsonBytes, e := json.Marshal(t)
+	if e != nil {
+		return "", e
+	}
+	text := string(jsonBytes)
+	if qrPath != "" {
+		e = qc.Encode(qrPath, text, 512, 512)
+		if e != nil {
+			return "", fmt.Errorf("生成二维码出错: %w", e)
+		}
+	}
+
+	n.migrateMutex.Lock()
+	if n.migrate != nil {
+		n.migrate.done <- identityMigrateResult{e: errors.New("已经重新开始接收迁移")}
+	}
+	n.migrate = &identityMigrate{secret: t.Secret, host: h, done: make(chan identityMigrateResult, 1)}
+	n.migrateMutex.Unlock()
+	h.SetStreamHandler(protocolMigrate, n.identityMigrateStreamHandler)
+	log.Println("开始接收迁移")
+	return text, nil
+}
+
+// 结束接收迁移, 需要在锁中调用
+func (n *Node) identityMigrateFinish(result identityMigrateResult) {
+	if n.migrate == nil {
+		return
+	}
+	n.migrate.done <- result
+	n.migrate.host.RemoveStreamHandler(protocolMigrate)
+	n.migrate = nil
+}
+
+// 等待接收迁移, 超时或者失败时停止接收
+//
+// 一次性密码不能一直有效, 超时秒数必须大于0, 否则返回错误并且不影响接收
+func (n *Node) identityMigrateWait(timeoutSecond int64) (string, error) {
+	if timeoutSecond <= 0 {
+		return "", fmt.Errorf("超时秒数必须大于0: %d", timeoutSecond)
+	}
+	n.migrateMutex.Lock()
+	m := n.migrate
+	n.migrateMutex.Unlock()
+	if m == nil {
+		return "", errors.New("没有开始接收迁移")
+	}
+
+	ctx, _ := n.current()
+	var result identityMigrateResult
+	select {
+	case result = <-m.done:
+	case <-time.After(time.Duration(timeoutSecond) * time.Second):
+		result.e = errors.New("等待迁移超时")
+	case <-ctx.Done():
+		result.e = errors.New("节点已经停止")
+	}
+	n.migrateMutex.Lock()
+	if n.migrate == m {
+		n.identityMigrateFinish(identityMigrateResult{})
+		<-m.done
+	}
+	n.migrateMutex.Unlock()
+	if result.e != nil {
+		log.Println("接收迁移失败:", result.e)
+	}
+	return result.id, result.e
+}
+
+// 迁移流处理, 使用二维码中的一次性密码验证对方
+func (n *Node) identityMigrateStreamHandler(s network.Stream) {
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+
+	c := &codecV2{rw: bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))}
+	data, e := readFrame(c.rw.Reader)
+	if e != nil {
+		log.Println("迁移处理, 读取出错:", e)
+		return
+	}
+
+	n.migrateMutex.Lock()
+	defer n.migrateMutex.Unlock()
+	m := n.migrate
+	if m == nil {
+		_ = s.Reset()
+		return
+	}
+	keyBytes, e := keyDecrypt(data, m.secret)
+	if e != nil {
+		m.attempts++
+		log.Println("迁移处理, 密码错误", s.Conn().RemotePeer(), m.attempts)
+		_ = c.writeResult(e)
+		if m.attempts >= identityMigrateAttemptMax {
+			n.identityMigrateFinish(identityMigrateResult{e: errors.New("迁移密码错误次数过多")})
+		}
+		return
+	}
+	id, e := n.identityWrite(keyBytes)
+	_ = c.writeResult(e)
+	n.identityMigrateFinish(identityMigrateResult{id: id, e: e})
+}
+
+// 将自己的身份发送给扫描到二维码的节点
+func (n *Node) identityMigrateSend(qrText string) error {
+	ctx, h, e := n.started()
+	if e != nil {
+		return e
+	}
+	var t identityMigrateText
+	e = json.Unmarshal([]byte(qrText), &t)
+	if e != nil || t.Type != identityMigrateType || t.Secret == "" {
+		return errors.New("不是迁移二维码")
+	}
+	peerID, e := peer.Decode(t.ID)
+	if e != nil {
+		return e
+	}
+	if peerID == h.ID() {
+		return errors.New("不能迁移到自己")
+	}
+	addr := peer.AddrInfo{ID: peerID}
+	for _, v := range t.Addrs {
+		if a, e := multiaddr.NewMultiaddr(v); e == nil {
+			addr.Addrs = append(addr.Addrs, a)
+		}
+	}
+	keyBytes, e := n.identityKeyBytes()
+	if e != nil {
+		return e
+	}
+	data, e := keyEncrypt(keyBytes, t.Secret)
+	if e != nil {
+		return e
+	}
+
+	e = connectPeer(ctx, h, addr, time.Second*10)
+	if e != nil {
+		return fmt.Errorf("连接迁移节点出错: %w", e)
+	}
+	s, e := createStream(ctx, h, t.ID, time.Second*10, protocolMigrate)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+
+	c := &codecV2{rw: bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))}
+	e = writeFrame(c.rw.Writer, data)
+	if e != nil {
+		return e
+	}
+	e = c.readResult()
+	if e != nil {
+		return e
+	}
+	log.Println("迁移身份完成", t.ID)
+	return nil
+}
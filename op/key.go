@@ -0,0 +1,155 @@
+package op
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 密钥加密参数, 手机上大约需要0.1秒
+const (
+	keyScryptN = 1 << 15
+	keyScryptR = 8
+	keyScryptP = 1
+)
+
+// 加密的密钥文件, 未加密时文件内容为 crypto.MarshalPrivateKey 的结果
+//
+// 密码通过scrypt得到密钥, 使用XChaCha20-Poly1305加密
+type keyFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// 是否是加密的密钥文件
+//
+// 未加密的密钥是protobuf, 第一个字节不会是 {
+func keyEncrypted(data []byte) bool {
+	return len(data) != 0 && data[0] == '{'
+}
+
+// 加密密钥
+func keyEncrypt(keyBytes []byte, passphrase string) ([]byte, error) {
+	f := keyFile{Version: 1, KDF: "scrypt", N: keyScryptN, R: keyScryptR, P: keyScryptP, Salt: make([]byte, 16)}
+	_, e := rand.Read(f.Salt)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := f.aead(passphrase)
+	if e != nil {
+		return nil, e
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	_, e = rand.Read(f.Nonce)
+	if e != nil {
+		return nil, e
+	}
+	f.Data = aead.Seal(nil, f.Nonce, keyBytes, nil)
+	return json.Marshal(f)
+}
+
+// 解密密钥, 密码错误时返回 ErrorCodePassphrase
+func keyDecrypt(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, newCodeError(ErrorCodePassphrase, "密钥已经加密, 需要密码")
+	}
+	var f keyFile
+	e := json.Unmarshal(data, &f)
+	if e != nil {
+		return nil, fmt.Errorf("解析加密的密钥出错: %w", e)
+	}
+	if f.Version != 1 || f.KDF != "scrypt" {
+		return nil, fmt.Errorf("不支持的密钥文件: %d %s", f.Version, f.KDF)
+	}
+	aead, e := f.aead(passphrase)
+	if e != nil {
+		return nil, e
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, errors.New("密钥文件损坏")
+	}
+	keyBytes, e := aead.Open(nil, f.Nonce, f.Data, nil)
+	if e != nil {
+		return nil, newCodeError(ErrorCodePassphrase, "密码错误")
+	}
+	return keyBytes, nil
+}
+
+func (f *keyFile) aead(passphrase string) (cipher.AEAD, error) {
+	key, e := scrypt.Key([]byte(passphrase), f.Salt, f.N, f.R, f.P, chacha20poly1305.KeySize)
+	if e != nil {
+		return nil, e
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// 保存密钥文件, 只有自己可以读写. 密码不为空时加密
+//
+// 先写入临时文件再替换, 防止中断时丢失密钥
+func keyWrite(keyPath string, keyBytes []byte, passphrase string) error {
+	data := keyBytes
+	if passphrase != "" {
+		var e error
+		data, e = keyEncrypt(keyBytes, passphrase)
+		if e != nil {
+			return e
+		}
+	}
+	tempPath := keyPath + ".tmp"
+	e := os.WriteFile(tempPath, data, 0600)
+	if e != nil {
+		return e
+	}
+	// 临时文件已经存在时不会修改权限
+	e = os.Chmod(tempPath, 0600)
+	if e != nil {
+		return e
+	}
+	return os.Rename(tempPath, keyPath)
+}
+
+// 修改密钥密码, 新密码为空时不加密
+func (n *Node) passphraseChange(oldPassphrase, newPassphrase string) error {
+	if n.config.PrivateDir == "" {
+		return errors.New("没有设置私有文件夹")
+	}
+	keyPath := filepath.Join(n.config.PrivateDir, "my.key")
+	data, e := os.ReadFile(keyPath)
+	if e != nil {
+		return e
+	}
+	keyBytes := data
+	if keyEncrypted(data) {
+		keyBytes, e = keyDecrypt(data, oldPassphrase)
+		if e != nil {
+			return e
+		}
+	} else if oldPassphrase != "" {
+		return newCodeError(ErrorCodePassphrase, "密钥没有加密")
+	}
+
+	e = keyWrite(keyPath, keyBytes, newPassphrase)
+	if e != nil {
+		return fmt.Errorf("保存密钥出错: %w", e)
+	}
+	// 再次启动时使用新密码
+	n.mutex.Lock()
+	n.config.Passphrase = newPassphrase
+	n.mutex.Unlock()
+	log.Println("修改密钥密码, 是否加密:", newPassphrase != "")
+	return nil
+}
@@ -0,0 +1,95 @@
+package op
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func TestPrivateKey(t *testing.T) {
+	privateDir := t.TempDir()
+	keyPath := filepath.Join(privateDir, "my.key")
+	readKey := func(passphrase string) (crypto.PrivKey, error) {
+		key, e := getPrivateKey(keyPath, passphrase)
+		if e != nil {
+			return nil, e
+		}
+		return *key, nil
+	}
+	checkFile := func(encrypted bool) {
+		fileInfo, e := os.Stat(keyPath)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if fileInfo.Mode().Perm() != 0600 {
+			t.Fatal("密钥文件权限错误", fileInfo.Mode())
+		}
+		data, _ := os.ReadFile(keyPath)
+		if keyEncrypted(data) != encrypted {
+			t.Fatal("密钥文件加密状态错误", encrypted)
+		}
+	}
+
+	// 旧版本未加密且权限过大的密钥
+	oldKey, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	oldKeyBytes, _ := crypto.MarshalPrivateKey(oldKey)
+	_ = os.WriteFile(keyPath, oldKeyBytes, 0777)
+	_ = os.Chmod(keyPath, 0777)
+	key, e := readKey("")
+	if e != nil || !key.Equals(oldKey) {
+		t.Fatal("加载旧版本密钥出错", e)
+	}
+	checkFile(false)
+
+	// 设置密码时自动加密
+	key, e = readKey("密码")
+	if e != nil || !key.Equals(oldKey) {
+		t.Fatal("加密旧版本密钥出错", e)
+	}
+	checkFile(true)
+
+	// 密码错误或者没有密码
+	for _, passphrase := range []string{"", "错误"} {
+		_, e = readKey(passphrase)
+		if ErrorCode(fmt.Sprint(e)) != ErrorCodePassphrase {
+			t.Fatal("没有发现密码错误", passphrase, e)
+		}
+	}
+
+	// 修改密码
+	n := NewNode(&NodeConfig{PrivateDir: privateDir})
+	if ErrorCode(fmt.Sprint(n.PassphraseChange("错误", "新密码"))) != ErrorCodePassphrase {
+		t.Fatal("使用错误的密码修改了密码")
+	}
+	e = n.PassphraseChange("密码", "新密码")
+	if e != nil {
+		t.Fatal(e)
+	}
+	key, e = readKey("新密码")
+	if e != nil || !key.Equals(oldKey) {
+		t.Fatal("使用新密码加载密钥出错", e)
+	}
+	checkFile(true)
+
+	// 取消密码
+	e = n.PassphraseChange("新密码", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkFile(false)
+	key, e = readKey("")
+	if e != nil || !key.Equals(oldKey) {
+		t.Fatal("取消密码后加载密钥出错", e)
+	}
+
+	// 新生成的密钥
+	_ = os.Remove(keyPath)
+	_, e = readKey("密码")
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkFile(true)
+}
@@ -0,0 +1,171 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 进程中所有节点共用的指标, 注册到 prometheus.DefaultRegisterer
+var (
+	// 发送结果
+	metricsSendTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "op_send_total",
+		Help: "Send attempts by kind, result and error type",
+	}, []string{"kind", "result", "error"})
+	// DHT查找节点耗时
+	metricsDHTLookupSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "op_dht_lookup_seconds",
+		Help:    "DHT peer lookup latency",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"result"})
+	// MDNS发现节点
+	metricsMDNSPeerTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "op_mdns_peer_total",
+		Help: "Peers discovered by mDNS",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricsSendTotal, metricsDHTLookupSeconds, metricsMDNSPeerTotal)
+}
+
+// 记录一次发送结果
+//
+// kind 为 historyKindText, historyKindFile 或 historyKindDir
+func metricsSend(kind string, e error, canceled bool) {
+	switch {
+	case canceled:
+		metricsSendTotal.WithLabelValues(kind, "cancel", "").Inc()
+	case e == nil:
+		metricsSendTotal.WithLabelValues(kind, "done", "").Inc()
+	default:
+		metricsSendTotal.WithLabelValues(kind, "error", metricsErrorType(e)).Inc()
+	}
+}
+
+// 错误类型, 数量有限, 用作指标标签
+func metricsErrorType(e error) string {
+	var ce *codeError
+	switch {
+	case errors.As(e, &ce):
+		return ce.code
+	case errors.Is(e, os.ErrNotExist):
+		return "not_exist"
+	case errors.Is(e, context.DeadlineExceeded), errors.Is(e, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(e, network.ErrNoConn), errors.Is(e, network.ErrNoRemoteAddrs):
+		return "no_conn"
+	}
+	return "other"
+}
+
+// 节点指标, 启动时注册, 停止时注销
+var (
+	metricsProtocolBytesDesc = prometheus.NewDesc("op_protocol_bytes_total", "Bytes transferred by protocol and direction", []string{"protocol", "direction"}, nil)
+	metricsStreamsDesc       = prometheus.NewDesc("op_streams", "Active streams by protocol and direction", []string{"protocol", "direction"}, nil)
+	metricsConnsDesc         = prometheus.NewDesc("op_conns", "Connections by transport and direction", []string{"transport", "direction"}, nil)
+	metricsPeersDesc         = prometheus.NewDesc("op_peers", "Peers in the peerstore", nil, nil)
+	metricsRcmgrStreamsDesc  = prometheus.NewDesc("op_rcmgr_streams", "Resource manager streams by scope and direction", []string{"scope", "direction"}, nil)
+	metricsRcmgrConnsDesc    = prometheus.NewDesc("op_rcmgr_conns", "Resource manager connections by scope and direction", []string{"scope", "direction"}, nil)
+	metricsRcmgrFDsDesc      = prometheus.NewDesc("op_rcmgr_fds", "Resource manager file descriptors by scope", []string{"scope"}, nil)
+	metricsRcmgrMemoryDesc   = prometheus.NewDesc("op_rcmgr_memory_bytes", "Resource manager reserved memory by scope", []string{"scope"}, nil)
+)
+
+type metricsCollector struct {
+	h                host.Host
+	bandwidthCounter *metrics.BandwidthCounter
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		metricsProtocolBytesDesc, metricsStreamsDesc, metricsConnsDesc, metricsPeersDesc,
+		metricsRcmgrStreamsDesc, metricsRcmgrConnsDesc, metricsRcmgrFDsDesc, metricsRcmgrMemoryDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	h := c.h
+
+	for p, stats := range c.bandwidthCounter.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(metricsProtocolBytesDesc, prometheus.CounterValue, float64(stats.TotalIn), string(p), "in")
+		ch <- prometheus.MustNewConstMetric(metricsProtocolBytesDesc, prometheus.CounterValue, float64(stats.TotalOut), string(p), "out")
+	}
+
+	type key struct{ name, direction string }
+	streamMap := make(map[key]int)
+	connMap := make(map[key]int)
+	for _, conn := range h.Network().Conns() {
+		connMap[key{metricsTransport(conn.RemoteMultiaddr()), metricsDirection(conn.Stat().Direction)}]++
+		for _, s := range conn.GetStreams() {
+			streamMap[key{string(s.Protocol()), metricsDirection(s.Stat().Direction)}]++
+		}
+	}
+	for k, v := range streamMap {
+		ch <- prometheus.MustNewConstMetric(metricsStreamsDesc, prometheus.GaugeValue, float64(v), k.name, k.direction)
+	}
+	for k, v := range connMap {
+		ch <- prometheus.MustNewConstMetric(metricsConnsDesc, prometheus.GaugeValue, float64(v), k.name, k.direction)
+	}
+	ch <- prometheus.MustNewConstMetric(metricsPeersDesc, prometheus.GaugeValue, float64(h.Peerstore().Peers().Len()))
+
+	// 资源管理器
+	state, ok := h.Network().ResourceManager().(rcmgr.ResourceManagerState)
+	if !ok {
+		return
+	}
+	stat := state.Stat()
+	scopeMap := map[string]network.ScopeStat{"system": stat.System, "transient": stat.Transient}
+	for name, v := range stat.Services {
+		scopeMap["service:"+name] = v
+	}
+	for p, v := range stat.Protocols {
+		scopeMap["protocol:"+string(p)] = v
+	}
+	for scope, v := range scopeMap {
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrStreamsDesc, prometheus.GaugeValue, float64(v.NumStreamsInbound), scope, "inbound")
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrStreamsDesc, prometheus.GaugeValue, float64(v.NumStreamsOutbound), scope, "outbound")
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrConnsDesc, prometheus.GaugeValue, float64(v.NumConnsInbound), scope, "inbound")
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrConnsDesc, prometheus.GaugeValue, float64(v.NumConnsOutbound), scope, "outbound")
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrFDsDesc, prometheus.GaugeValue, float64(v.NumFD), scope)
+		ch <- prometheus.MustNewConstMetric(metricsRcmgrMemoryDesc, prometheus.GaugeValue, float64(v.Memory), scope)
+	}
+}
+
+// 连接的传输
+func metricsTransport(ma multiaddr.Multiaddr) string {
+	for _, v := range []struct {
+		code      int
+		transport string
+	}{
+		{multiaddr.P_CIRCUIT, "relay"},
+		{multiaddr.P_WEBTRANSPORT, TransportWebTransport},
+		{multiaddr.P_QUIC, TransportQUIC},
+		{multiaddr.P_WS, TransportWebSocket},
+		{multiaddr.P_TCP, TransportTCP},
+	} {
+		if _, e := ma.ValueForProtocol(v.code); e == nil {
+			return v.transport
+		}
+	}
+	return "other"
+}
+
+func metricsDirection(d network.Direction) string {
+	return strings.ToLower(d.String())
+}
+
+// 节点指标的注册器, 通过 node 标签区分同一进程中的多个节点
+func metricsRegisterer(h host.Host) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"node": h.ID().Pretty()}, prometheus.DefaultRegisterer)
+}
@@ -1,78 +1,338 @@
 package op
 
 import (
-	"context"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
-var connStateMutex sync.RWMutex
+// 连接状态原因
+const (
+	// ConnReasonDirect 直接连接
+	ConnReasonDirect = "direct"
+	// ConnReasonRelay 只有中继连接
+	ConnReasonRelay = "relay"
+	// ConnReasonMDNS 通过MDNS发现的局域网直接连接
+	ConnReasonMDNS = "mdns"
+	// ConnReasonDrop 连接断开
+	ConnReasonDrop = "drop"
+)
+
+const (
+	// 重连最短间隔
+	connRetryMin = 5 * time.Second
+	// 重连最长间隔
+	connRetryMax = 10 * time.Minute
+	// 同时重连的最多节点数量
+	connRetryConcurrent = 8
+)
 
-// 不要使用! 通过connStateIdArraySet()进行设置
-var connStateIdArray []string
+// 连接状态通知
+type connNotice struct {
+	id     string
+	reason string
+}
+
+// 节点重连状态
+type connRetry struct {
+	tryCount int
+	nextTime time.Time
+	trying   bool
+}
 
-func connStateInit(gc context.Context, h host.Host, stopChan chan int, cb Callback) {
+// 启动连接状态
+//
+// 连接状态由连接和断开事件驱动, 只在变化时通知. 断开的节点按指数退避重连
+func (n *Node) connStateInit(h host.Host) {
 	log.Println("启动连接状态")
-	ticker := time.NewTicker(time.Second)
+	n.connStateMutex.Lock()
+	n.connStateMap = make(map[string]string)
+	n.connRetryMap = make(map[string]*connRetry)
+	n.connMdnsMap = make(map[string]map[string]bool)
+	n.connStateMutex.Unlock()
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go n.connStateUpdate(c.RemotePeer())
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			go n.connStateUpdate(c.RemotePeer())
+		},
+	})
+
+	// 设置检查标识数组后立即通知当前状态
+	n.connStateMutex.RLock()
+	idArray := n.connStateIdArray
+	n.connStateMutex.RUnlock()
+	for _, id := range idArray {
+		peerID, e := peer.Decode(id)
+		if e == nil {
+			go n.connStateUpdate(peerID)
+		}
+	}
 
+	ticker := time.NewTicker(time.Second)
+	stopChan := n.connStateStopChan
 	go func() {
 		for {
 			select {
 			case <-stopChan:
 				log.Println("停止连接状态")
-				_ = ticker.Stop
+				ticker.Stop()
 				return
 			case <-ticker.C:
-				connStateMutex.RLock()
-				for _, id := range connStateIdArray {
-					go connStateCheck(gc, h, id, cb)
-				}
-				connStateMutex.RUnlock()
+				n.connRetrySchedule()
 			}
 		}
 	}()
 }
 
-func connStateCheck(gc context.Context, h host.Host, id string, cb Callback) {
+// 当前连接状态原因, 需要在锁中调用
+//
+// 由实际的连接决定: 直接连接的对方IP是MDNS发现的地址时为MDNS
+func (n *Node) connStateReason(h host.Host, peerID peer.ID) string {
+	conns := h.Network().ConnsToPeer(peerID)
+	if len(conns) == 0 {
+		return ConnReasonDrop
+	}
+	reason := ConnReasonRelay
+	for _, c := range conns {
+		if connIsRelay(c) {
+			continue
+		}
+		ip, e := manet.ToIP(c.RemoteMultiaddr())
+		if e == nil && n.connMdnsMap[peerID.Pretty()][ip.String()] {
+			return ConnReasonMDNS
+		}
+		reason = ConnReasonDirect
+	}
+	return reason
+}
+
+// 连接或者断开时更新节点状态, 变化时通知
+func (n *Node) connStateUpdate(peerID peer.ID) {
+	id := peerID.Pretty()
+	_, h, e := n.started()
+	if e != nil {
+		return
+	}
+	n.connStateMutex.Lock()
+	if n.connStateMap == nil {
+		n.connStateMutex.Unlock()
+		return
+	}
+	reason := n.connStateReason(h, peerID)
+	if reason != ConnReasonDrop {
+		delete(n.connRetryMap, id)
+	}
+	send := false
+	if n.connStateWatched(id) && n.connStateMap[id] != reason {
+		n.connStateMap[id] = reason
+		// 在锁中记录变化, 保证通知顺序
+		send = n.connNoticeAdd(id, reason)
+	}
+	n.connStateMutex.Unlock()
+	if send {
+		n.connNoticeSend()
+	}
+
+	if reason != ConnReasonDrop {
+		n.queueTry(id)
+	}
+}
+
+// 是否需要通知状态, 需要在锁中调用
+func (n *Node) connStateWatched(id string) bool {
+	for _, v := range n.connStateIdArray {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 添加连接状态通知, 需要在锁中调用. 返回true时调用方需要调用 connNoticeSend
+func (n *Node) connNoticeAdd(id, reason string) bool {
+	n.connNoticeQueue = append(n.connNoticeQueue, connNotice{id: id, reason: reason})
+	if n.connNoticeSending {
+		return false
+	}
+	n.connNoticeSending = true
+	return true
+}
+
+// 在锁外按顺序发送连接状态通知, 直到没有通知. 回调中可以调用其他方法
+func (n *Node) connNoticeSend() {
+	for {
+		n.connStateMutex.Lock()
+		if len(n.connNoticeQueue) == 0 {
+			n.connNoticeSending = false
+			n.connStateMutex.Unlock()
+			return
+		}
+		notice := n.connNoticeQueue[0]
+		n.connNoticeQueue = n.connNoticeQueue[1:]
+		n.connStateMutex.Unlock()
+		n.callback().OnOpConnState(notice.id, notice.reason != ConnReasonDrop, notice.reason)
+	}
+}
+
+// MDNS发现节点, 连接前调用. 只记录地址, 连接后由连接通知确定原因
+func (n *Node) connStateMdnsFound(addr peer.AddrInfo) {
+	n.connStateMutex.Lock()
+	defer n.connStateMutex.Unlock()
+	if n.connMdnsMap == nil {
+		return
+	}
+	ipMap := make(map[string]bool)
+	for _, a := range addr.Addrs {
+		if ip, e := manet.ToIP(a); e == nil {
+			ipMap[ip.String()] = true
+		}
+	}
+	n.connMdnsMap[addr.ID.Pretty()] = ipMap
+}
+
+// 重连断开的检查节点和发送队列中的节点, 已经连接的发送队列节点直接发送
+func (n *Node) connRetrySchedule() {
+	_, h, e := n.started()
+	if e != nil {
+		return
+	}
+	n.connStateMutex.RLock()
+	idArray := append([]string{}, n.connStateIdArray...)
+	n.connStateMutex.RUnlock()
+	for _, id := range n.queueDueIdArray() {
+		peerID, e := peer.Decode(id)
+		if e == nil && connectCount(h, peerID) > 0 {
+			go n.queueTry(id)
+			continue
+		}
+		idArray = append(idArray, id)
+	}
+
+	now := time.Now()
+	n.connStateMutex.Lock()
+	defer n.connStateMutex.Unlock()
+	trying := 0
+	for _, retry := range n.connRetryMap {
+		if retry.trying {
+			trying++
+		}
+	}
+	for _, id := range idArray {
+		if trying >= connRetryConcurrent {
+			return
+		}
+		peerID, e := peer.Decode(id)
+		if e != nil || connectCount(h, peerID) > 0 {
+			continue
+		}
+		retry := n.connRetryMap[id]
+		if retry == nil {
+			retry = &connRetry{}
+			n.connRetryMap[id] = retry
+		}
+		if retry.trying || now.Before(retry.nextTime) {
+			continue
+		}
+		retry.trying = true
+		trying++
+		go n.connRetryTry(id, retry)
+	}
+}
+
+// 尝试重连, 失败时按指数退避
+func (n *Node) connRetryTry(id string, retry *connRetry) {
+	isConn := n.connStateConnect(id)
+	n.connStateMutex.Lock()
+	retry.trying = false
+	if isConn {
+		retry.tryCount = 0
+		retry.nextTime = time.Time{}
+	} else {
+		retry.tryCount++
+		wait := connRetryMin << (retry.tryCount - 1)
+		if retry.tryCount > 10 || wait > connRetryMax {
+			wait = connRetryMax
+		}
+		retry.nextTime = time.Now().Add(wait)
+	}
+	n.connStateMutex.Unlock()
+}
+
+// 检查是否连接, 没有连接时尝试连接
+func (n *Node) connStateConnect(id string) bool {
 	peerID, e := peer.Decode(id)
 	if e != nil {
 		log.Println("连接状态检查时解析节点标识出错", e)
-		return
+		return false
 	}
 
+	ctx, h, e := n.started()
+	if e != nil {
+		return false
+	}
 	connCount := connectCount(h, peerID)
 	if connCount > 0 {
-		// 通知正在连接
-		cb.OnOpConnState(id, true)
-		return
+		return true
 	}
 
-	// 尝试连接
-	addr, e := findAddrInfoFromDHT(gc, peerID)
+	// 尝试连接, 找不到地址时尝试通过静态中继连接
+	n.mutex.Lock()
+	dht := n.dht
+	n.mutex.Unlock()
+	addr, e := findAddrInfoFromDHT(ctx, dht, peerID)
 	if e != nil {
 		//log.Println("连接状态检查时获取连接地址出错", e)
-		// 通知连接断开
-		cb.OnOpConnState(id, false)
-		return
+		relayAddrs := n.relayAddrs(peerID)
+		if len(relayAddrs) == 0 {
+			return false
+		}
+		addr = &peer.AddrInfo{ID: peerID}
 	}
-	e = connectPeer(gc, h, *addr, time.Second)
+	addr.Addrs = append(addr.Addrs, n.relayAddrs(peerID)...)
+	e = connectPeer(ctx, h, *addr, 10*time.Second)
 	if e != nil {
 		//log.Println("连接状态检查时尝试进行连接失败", e)
-		// 通知连接断开
-		cb.OnOpConnState(id, false)
-		return
+		return false
 	}
-	// 通知正在连接
-	cb.OnOpConnState(id, true)
+	return true
 }
 
-func connStateIdArraySet(array []string) {
+// 设置检查标识数组, 新增的节点立即重连并通知当前状态
+func (n *Node) connStateIdArraySet(array []string) {
 	log.Println("设置状态检查标识数组", array)
-	connStateMutex.Lock()
-	connStateIdArray = array
-	connStateMutex.Unlock()
+	n.connStateMutex.Lock()
+	n.connStateIdArray = array
+	var peerIDArray []peer.ID
+	if n.connStateMap != nil {
+		exists := make(map[string]bool)
+		for _, id := range array {
+			exists[id] = true
+		}
+		for id := range n.connStateMap {
+			if !exists[id] {
+				delete(n.connStateMap, id)
+			}
+		}
+		for _, id := range array {
+			if _, ok := n.connStateMap[id]; ok {
+				continue
+			}
+			delete(n.connRetryMap, id)
+			if peerID, e := peer.Decode(id); e == nil {
+				peerIDArray = append(peerIDArray, peerID)
+			}
+		}
+	}
+	n.connStateMutex.Unlock()
+
+	for _, peerID := range peerIDArray {
+		go n.connStateUpdate(peerID)
+	}
 }
@@ -11,6 +11,9 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 )
 
+// MDNS服务名称
+const mdnsServiceName = "lilu-open-p2p"
+
 type discoveryNotifee struct {
 	PeerChan chan peer.AddrInfo
 }
@@ -20,10 +23,13 @@ func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 	n.PeerChan <- pi
 }
 
-func mdnsInit(gc context.Context, h host.Host, stopChan chan int, cb Callback) {
-	log.Println("启动MDNS")
+// serviceName 服务名称, 只能发现名称相同的节点
+//
+// found 在连接发现的节点前调用
+func mdnsInit(gc context.Context, h host.Host, serviceName string, stopChan chan int, cb Callback, found func(peer.AddrInfo)) {
+	log.Println("启动MDNS", serviceName)
 	n := &discoveryNotifee{PeerChan: make(chan peer.AddrInfo)}
-	s := mdns.NewMdnsService(h, "lilu-open-p2p", n)
+	s := mdns.NewMdnsService(h, serviceName, n)
 	e := s.Start()
 	if e != nil {
 		log.Panicln(e)
@@ -43,6 +49,8 @@ func mdnsInit(gc context.Context, h host.Host, stopChan chan int, cb Callback) {
 				}
 
 				log.Println("MDNS发现节点", addr.ID.Pretty())
+				metricsMDNSPeerTotal.Inc()
+				found(addr)
 				go func() {
 					e := connectPeer(gc, h, addr, time.Second)
 					if e != nil {
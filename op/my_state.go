@@ -6,29 +6,55 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
 )
 
 // 我的状态
 type MyState struct {
-	NodeCount int `json:"nodeCount"` // 节点数量
-	ConnCount int `json:"connCount"` // 连接数量
+	NodeCount    int                 `json:"nodeCount"`    // 节点数量
+	ConnCount    int                 `json:"connCount"`    // 连接数量
+	RateLimit    RateLimit           `json:"rateLimit"`    // 速率限制
+	UploadRate   int64               `json:"uploadRate"`   // 上传速率(字节每秒)
+	DownloadRate int64               `json:"downloadRate"` // 下载速率(字节每秒)
+	PeerRateMap  map[string]PeerRate `json:"peerRateMap"`  // 正在传输的节点速率, 键为节点标识
 }
 
-func initState(h host.Host, stopChan chan int, cb Callback) {
+// 节点速率
+type PeerRate struct {
+	UploadRate   int64 `json:"uploadRate"`   // 上传速率(字节每秒)
+	DownloadRate int64 `json:"downloadRate"` // 下载速率(字节每秒)
+}
+
+func (n *Node) initState(h host.Host, bandwidthCounter *metrics.BandwidthCounter) {
 	log.Println("启动状态")
 	ticker := time.NewTicker(time.Second)
+	stopChan := n.stateStopChan
+	cb := n.callback()
 
 	go func() {
 		for {
 			select {
 			case <-stopChan:
 				log.Println("停止状态")
-				_ = ticker.Stop
+				ticker.Stop()
 				return
 			case <-ticker.C:
-				nodeCount := h.Peerstore().Peers().Len()
-				connCount := len(h.Network().Conns())
-				jsonBytes, _ := json.Marshal(MyState{NodeCount: nodeCount, ConnCount: connCount})
+				state := MyState{
+					NodeCount:   h.Peerstore().Peers().Len(),
+					ConnCount:   len(h.Network().Conns()),
+					RateLimit:   n.rateLimiter.get(),
+					PeerRateMap: make(map[string]PeerRate),
+				}
+				totals := bandwidthCounter.GetBandwidthTotals()
+				state.UploadRate = int64(totals.RateOut)
+				state.DownloadRate = int64(totals.RateIn)
+				for peerID, stats := range bandwidthCounter.GetBandwidthByPeer() {
+					if int64(stats.RateIn) == 0 && int64(stats.RateOut) == 0 {
+						continue
+					}
+					state.PeerRateMap[peerID.Pretty()] = PeerRate{UploadRate: int64(stats.RateOut), DownloadRate: int64(stats.RateIn)}
+				}
+				jsonBytes, _ := json.Marshal(state)
 				cb.OnOpState(string(jsonBytes))
 			}
 		}
@@ -0,0 +1,1281 @@
+package op
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 测试回调, 只记录需要的事件
+type testCallback struct {
+	startChan       chan string
+	stopChan        chan int
+	textReceiveChan chan string
+	textSendChan    chan string
+	fileReceiveChan chan string
+	fileSendChan    chan string
+	receiptChan     chan string
+	connStateChan   chan string
+	rejectChan      chan string
+	cancelChan      chan string
+	offerChan       chan string
+}
+
+func newTestCallback() *testCallback {
+	return &testCallback{
+		startChan:       make(chan string, 10),
+		stopChan:        make(chan int, 1),
+		textReceiveChan: make(chan string, 10),
+		textSendChan:    make(chan string, 10),
+		fileReceiveChan: make(chan string, 10),
+		fileSendChan:    make(chan string, 10),
+		receiptChan:     make(chan string, 10),
+		connStateChan:   make(chan string, 10),
+		rejectChan:      make(chan string, 10),
+		cancelChan:      make(chan string, 10),
+		offerChan:       make(chan string, 10),
+	}
+}
+
+func (cb *testCallback) OnOpStart(id string, addrArray string) { cb.startChan <- id }
+func (cb *testCallback) OnOpStop()                             { cb.stopChan <- 1 }
+func (cb *testCallback) OnOpState(jt string)                   {}
+func (cb *testCallback) OnOpMDNSPeer(id string)                {}
+func (cb *testCallback) OnOpConnState(id string, isConn bool, reason string) {
+	select {
+	case cb.connStateChan <- reason:
+	default:
+	}
+}
+func (cb *testCallback) OnOpTextSendError(uuid, et string) { cb.textSendChan <- et }
+func (cb *testCallback) OnOpTextSendDone(uuid string)      { cb.textSendChan <- "成功" }
+func (cb *testCallback) OnOpTextSendCancel(uuid string)    {}
+func (cb *testCallback) OnOpTextDelivered(uuid string)     { cb.receiptChan <- "送达" }
+func (cb *testCallback) OnOpTextRead(uuid string)          { cb.receiptChan <- "已读" }
+func (cb *testCallback) OnOpTextReceiveDone(id, text, uuid string) {
+	cb.textReceiveChan <- text
+}
+func (cb *testCallback) OnOpFileSendError(uuid, et string) { cb.fileSendChan <- et }
+func (cb *testCallback) OnOpFileSendProgress(uuid string, fileSize, sendSize, speed, averageSpeed, etaSecond int64) {
+}
+func (cb *testCallback) OnOpFileSendDone(uuid, fileHash string) { cb.fileSendChan <- "成功" }
+func (cb *testCallback) OnOpFileSendCancel(uuid string)         { cb.cancelChan <- "发送" }
+func (cb *testCallback) OnOpFileReceiveOffer(id, fileHash, fileName, uuid string, fileSize int64) {
+	select {
+	case cb.offerChan <- uuid:
+	default:
+	}
+}
+func (cb *testCallback) OnOpFileReceiveStart(id, fileHash, fileName, uuid string, fileSize int64) {
+}
+func (cb *testCallback) OnOpFileReceiveError(uuid, et string) {}
+func (cb *testCallback) OnOpFileReceiveProgress(uuid string, fileSize, receiveSize, speed, averageSpeed, etaSecond int64) {
+}
+func (cb *testCallback) OnOpFileReceiveDone(uuid, filePath string) { cb.fileReceiveChan <- filePath }
+func (cb *testCallback) OnOpFileReceiveCancel(uuid string)         { cb.cancelChan <- "接收" }
+func (cb *testCallback) OnOpQueueChanged(jt string)                {}
+func (cb *testCallback) OnOpPeerReject(id, protocol string) {
+	select {
+	case cb.rejectChan <- protocol:
+	default:
+	}
+}
+
+// 启动测试节点
+func startTestNode(t *testing.T) (*Node, *testCallback) {
+	return startTestNodeWithOptions(t, nil)
+}
+
+// 使用启动选项启动测试节点
+func startTestNodeWithOptions(t *testing.T, options *Options) (*Node, *testCallback) {
+	return startTestNodeWithDir(t, t.TempDir(), options)
+}
+
+// 使用私有文件夹和启动选项启动测试节点
+func startTestNodeWithDir(t *testing.T, privateDir string, options *Options) (*Node, *testCallback) {
+	cb := newTestCallback()
+	n := NewNode(&NodeConfig{
+		PrivateDir: privateDir,
+		PublicDir:  t.TempDir(),
+		Callback:   cb,
+		Options:    options,
+	})
+	// 默认等待接收决定, 测试中立即接收
+	n.FileReceiveAutoAcceptSet(0)
+	go func() {
+		e := n.Start()
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+	select {
+	case <-cb.startChan:
+	case <-time.After(time.Minute):
+		t.Fatal("启动超时")
+	}
+	return n, cb
+}
+
+// 停止测试节点
+func stopTestNode(t *testing.T, n *Node, cb *testCallback) {
+	n.Stop()
+	select {
+	case <-cb.stopChan:
+	case <-time.After(time.Minute):
+		t.Fatal("停止超时")
+	}
+}
+
+// 启动两个相互连接的测试节点
+func startTestNodePair(t *testing.T) (*Node, *testCallback, *Node, *testCallback) {
+	a, aCallback := startTestNode(t)
+	t.Cleanup(func() { stopTestNode(t, a, aCallback) })
+	b, bCallback := startTestNode(t)
+	t.Cleanup(func() { stopTestNode(t, b, bCallback) })
+
+	e := connectPeer(a.ctx, a.host, peer.AddrInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}, time.Minute)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// 等待MDNS同时发起的连接稳定
+	time.Sleep(time.Second)
+	return a, aCallback, b, bCallback
+}
+
+func TestNodeTextSend(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+	testTextSend(t, a, aCallback, b, bCallback)
+}
+
+// 对方只支持第1版协议
+func TestNodeTextSendV1(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+	b.host.RemoveStreamHandler(protocolTextV2)
+	a.host.Peerstore().RemoveProtocols(b.host.ID(), protocolTextV2)
+	testTextSend(t, a, aCallback, b, bCallback)
+}
+
+func testTextSend(t *testing.T, a *Node, aCallback *testCallback, b *Node, bCallback *testCallback) {
+	// MDNS同时发起的连接可能会重置流, 失败时重试
+	for i := 0; ; i++ {
+		a.TextSend("test", b.ID(), "你好")
+		var result string
+		select {
+		case result = <-aCallback.textSendChan:
+		case <-time.After(time.Minute):
+			t.Fatal("发送超时")
+		}
+		if result == "成功" {
+			break
+		}
+		if i == 3 {
+			t.Fatal("发送出错", result)
+		}
+		time.Sleep(time.Second)
+	}
+	select {
+	case text := <-bCallback.textReceiveChan:
+		if text != "你好" {
+			t.Fatal("接收内容错误", text)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+}
+
+func TestNodeRestart(t *testing.T) {
+	n, cb := startTestNode(t)
+	id := n.ID()
+	stopTestNode(t, n, cb)
+
+	// 停止后再次启动
+	go func() {
+		e := n.Start()
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+	select {
+	case restartID := <-cb.startChan:
+		if restartID != id {
+			t.Fatal("重启后节点标识变化", restartID)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("重启超时")
+	}
+	stopTestNode(t, n, cb)
+}
+
+// 重启时其他协程仍在调用接口, 使用 -race 检查
+func TestNodeRestartConcurrent(t *testing.T) {
+	n, cb := startTestNode(t)
+	otherID := n.ID()
+	_ = n.ConnStateCheckSet(fmt.Sprintf(`["%s"]`, otherID))
+
+	done := make(chan struct{})
+	callDone := make(chan struct{})
+	go func() {
+		defer close(callDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = n.ID()
+			_, _ = n.ConnList(otherID)
+			_, _ = n.TrustList()
+			_ = n.BootstrapSet("[]")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		stopTestNode(t, n, cb)
+		go func() {
+			e := n.Start()
+			if e != nil {
+				t.Error(e)
+			}
+		}()
+		select {
+		case <-cb.startChan:
+		case <-time.After(time.Minute):
+			t.Fatal("重启超时")
+		}
+	}
+	close(done)
+	<-callDone
+	stopTestNode(t, n, cb)
+}
+
+func TestNodeFileSendCorruptCache(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	// 准备文件
+	fileBytes := make([]byte, 3*1048576+7)
+	_, _ = rand.Read(fileBytes)
+	filePath := filepath.Join(t.TempDir(), "test.bin")
+	e := os.WriteFile(filePath, fileBytes, os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+	fileHash, e := fileHashGet(filePath)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 对方缓存中放入损坏的部分数据
+	fileCacheDir := filepath.Join(b.config.PublicDir, ".CACHE", a.ID())
+	_ = os.MkdirAll(fileCacheDir, os.ModePerm)
+	e = os.WriteFile(filepath.Join(fileCacheDir, fileHash), make([]byte, 1048576), os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	a.FileSend("test", b.ID(), filePath)
+	select {
+	case result := <-aCallback.fileSendChan:
+		if result != "成功" {
+			t.Fatal("发送出错", result)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("发送超时")
+	}
+	select {
+	case receivePath := <-bCallback.fileReceiveChan:
+		receiveBytes, e := os.ReadFile(receivePath)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(receiveBytes, fileBytes) {
+			t.Fatal("接收内容错误")
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+}
+
+func TestNodeQueueTextSend(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	e := a.QueueTextSend("test", b.ID(), "你好")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// 出错时队列会自动重试
+	select {
+	case result := <-aCallback.textSendChan:
+		if result != "成功" {
+			t.Fatal("发送出错", result)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("发送超时")
+	}
+	select {
+	case text := <-bCallback.textReceiveChan:
+		if text != "你好" {
+			t.Fatal("接收内容错误", text)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+
+	jt, e := a.QueueList()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if jt != "[]" {
+		t.Fatal("发送完成后队列没有清空", jt)
+	}
+}
+
+func TestNodeQueuePersist(t *testing.T) {
+	n, cb := startTestNode(t)
+
+	// 不存在的节点
+	key, _, e := crypto.GenerateEd25519Key(rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	offlineID, e := peer.IDFromPrivateKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = n.QueueTextSend("test", offlineID.Pretty(), "你好")
+	if e != nil {
+		t.Fatal(e)
+	}
+	stopTestNode(t, n, cb)
+
+	// 重新启动后加载队列
+	go func() {
+		e := n.Start()
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+	select {
+	case <-cb.startChan:
+	case <-time.After(time.Minute):
+		t.Fatal("重启超时")
+	}
+	defer stopTestNode(t, n, cb)
+
+	var items []queueItem
+	jt, e := n.QueueList()
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = json.Unmarshal([]byte(jt), &items)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(items) != 1 || items[0].UUID != "test" || items[0].Text != "你好" {
+		t.Fatal("重启后队列内容错误", jt)
+	}
+
+	// 取消后从队列中移除
+	e = n.SendCancel("test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	jt, _ = n.QueueList()
+	if jt != "[]" {
+		t.Fatal("取消后队列没有清空", jt)
+	}
+}
+
+func TestNodeHistory(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+	testTextSend(t, a, aCallback, b, bCallback)
+
+	// 双方都有完成的记录
+	for _, item := range []struct {
+		n         *Node
+		id        string
+		direction string
+	}{
+		{a, b.ID(), historyDirectionSend},
+		{b, a.ID(), historyDirectionReceive},
+	} {
+		jt, e := item.n.HistoryQuery(item.id, 0, "", 0)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var records []historyRecord
+		e = json.Unmarshal([]byte(jt), &records)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(records) == 0 || records[0].Direction != item.direction || records[0].Text != "你好" || records[0].State != historyStateDone {
+			t.Fatal("消息记录错误", jt)
+		}
+
+		// 翻页
+		jt, e = item.n.HistoryQuery(item.id, records[len(records)-1].Time, records[len(records)-1].UUID, 0)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if jt != "[]" {
+			t.Fatal("翻页错误", jt)
+		}
+	}
+}
+
+func TestNodeTextReceipt(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+	testTextSend(t, a, aCallback, b, bCallback)
+
+	select {
+	case result := <-aCallback.receiptChan:
+		if result != "送达" {
+			t.Fatal("回执错误", result)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("送达回执超时")
+	}
+
+	e := b.TextMarkRead(a.ID(), "test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// 重试发送时可能有多个送达回执
+	for result := ""; result != "已读"; {
+		select {
+		case result = <-aCallback.receiptChan:
+		case <-time.After(time.Minute):
+			t.Fatal("已读回执超时")
+		}
+	}
+
+	// 只能标记收到的文本
+	e = b.TextMarkRead(a.ID(), "none")
+	if e == nil {
+		t.Fatal("标记不存在的文本没有出错")
+	}
+}
+
+func TestNodeDirSend(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	// 准备文件夹
+	dirPath := filepath.Join(t.TempDir(), "test")
+	fileMap := map[string][]byte{
+		"a.txt":         []byte("a"),
+		"sub/b.bin":     make([]byte, 1048576+3),
+		"sub/sub/c.txt": {},
+	}
+	_, _ = rand.Read(fileMap["sub/b.bin"])
+	for p, data := range fileMap {
+		filePath := filepath.Join(dirPath, filepath.FromSlash(p))
+		_ = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		e := os.WriteFile(filePath, data, os.ModePerm)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	a.DirSend("test", b.ID(), dirPath)
+	select {
+	case result := <-aCallback.fileSendChan:
+		if result != "成功" {
+			t.Fatal("发送出错", result)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("发送超时")
+	}
+	select {
+	case receivePath := <-bCallback.fileReceiveChan:
+		if filepath.Dir(receivePath) != b.config.PublicDir {
+			t.Fatal("接收路径错误", receivePath)
+		}
+		for p, data := range fileMap {
+			receiveBytes, e := os.ReadFile(filepath.Join(receivePath, filepath.FromSlash(p)))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !bytes.Equal(receiveBytes, data) {
+				t.Fatal("接收内容错误", p)
+			}
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+}
+
+// 对方缓存中前面的文件损坏, 后面的文件继续发送, 哈希不符后重新发送损坏的文件
+func TestNodeDirSendCorruptCache(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	// 准备文件夹
+	dirPath := filepath.Join(t.TempDir(), "test")
+	fileMap := map[string][]byte{
+		"a.bin": make([]byte, 2*1048576+5),
+		"b.bin": make([]byte, 1048576+3),
+	}
+	_ = os.MkdirAll(dirPath, os.ModePerm)
+	for p, data := range fileMap {
+		_, _ = rand.Read(data)
+		e := os.WriteFile(filepath.Join(dirPath, p), data, os.ModePerm)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	m, e := dirManifestGet(dirPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 对方缓存中放入第一个文件损坏的部分数据
+	dirCachePath := filepath.Join(b.config.PublicDir, ".CACHE", a.ID(), m.hash())
+	_ = os.MkdirAll(dirCachePath, os.ModePerm)
+	e = os.WriteFile(filepath.Join(dirCachePath, "0"), make([]byte, 1048576), os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	a.DirSend("test", b.ID(), dirPath)
+	select {
+	case result := <-aCallback.fileSendChan:
+		if result != "成功" {
+			t.Fatal("发送出错", result)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("发送超时")
+	}
+	select {
+	case receivePath := <-bCallback.fileReceiveChan:
+		for p, data := range fileMap {
+			receiveBytes, e := os.ReadFile(filepath.Join(receivePath, p))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !bytes.Equal(receiveBytes, data) {
+				t.Fatal("接收内容错误", p)
+			}
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+}
+
+func TestDirManifestCheck(t *testing.T) {
+	for _, p := range []string{"../a", "a/../../b", "/etc/passwd", "a//b", "a\\..\\b", "c:/a", "./a", ""} {
+		m := dirManifest{version: codecV2Version, name: "test", entries: []dirEntry{{path: p}}}
+		if dirManifestCheck(&m) == nil {
+			t.Fatal("没有发现无效路径", p)
+		}
+	}
+	m := dirManifest{version: codecV2Version, name: "../a", entries: []dirEntry{{path: "CON/b?.txt"}}}
+	if dirManifestCheck(&m) != nil || m.name != "a" || m.entries[0].path != "_CON/b_.txt" {
+		t.Fatal("名称处理错误", m.name, m.entries[0].path)
+	}
+	m = dirManifest{version: codecV2Version, name: "test", entries: []dirEntry{{path: "a"}, {path: "a/b"}}}
+	if dirManifestCheck(&m) == nil {
+		t.Fatal("没有发现路径冲突")
+	}
+}
+
+func TestNodePortPersist(t *testing.T) {
+	n, cb := startTestNode(t)
+	addrs := n.host.Network().ListenAddresses()
+	stopTestNode(t, n, cb)
+
+	// 重启后使用相同端口
+	go func() {
+		e := n.Start()
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+	select {
+	case <-cb.startChan:
+	case <-time.After(time.Minute):
+		t.Fatal("重启超时")
+	}
+	defer stopTestNode(t, n, cb)
+	restartAddrs := n.host.Network().ListenAddresses()
+	for _, ma := range addrs {
+		// IPv6的端口可能不同, 只比较IPv4
+		if _, e := ma.ValueForProtocol(multiaddr.P_IP4); e != nil {
+			continue
+		}
+		found := false
+		for _, restartMa := range restartAddrs {
+			found = found || ma.Equal(restartMa)
+		}
+		if !found {
+			t.Fatal("重启后端口变化", addrs, restartAddrs)
+		}
+	}
+}
+
+func TestNodeStaticRelay(t *testing.T) {
+	relay, relayCallback := startTestNodeWithOptions(t, &Options{Mode: ModeRelay})
+	defer stopTestNode(t, relay, relayCallback)
+	var relayAddr string
+	for _, ma := range relay.host.Addrs() {
+		if _, e := ma.ValueForProtocol(multiaddr.P_TCP); e == nil {
+			relayAddr = fmt.Sprint(ma, "/p2p/", relay.ID())
+			break
+		}
+	}
+
+	// 设置静态中继时可以开启AutoRelay
+	n, cb := startTestNodeWithOptions(t, &Options{StaticRelays: []string{relayAddr}})
+	defer stopTestNode(t, n, cb)
+
+	other, _ := peer.Decode(n.ID())
+	relayAddrs := n.relayAddrs(other)
+	if len(relayAddrs) != 1 || relayAddrs[0].String() != relayAddr+"/p2p-circuit" {
+		t.Fatal("中继地址错误", relayAddrs)
+	}
+	if len(n.relayAddrs(relay.host.ID())) != 0 {
+		t.Fatal("不应该通过中继自己连接中继")
+	}
+
+	_, e := parseRelayAddrs([]string{"/ip4/127.0.0.1/tcp/1"})
+	if e == nil {
+		t.Fatal("没有发现缺少节点标识的中继地址")
+	}
+
+	// 中继和引导服务器不传输文本和文件
+	_, e = createStream(n.ctx, n.host, relay.ID(), time.Minute, protocolTextV2)
+	if e == nil {
+		t.Fatal("中继和引导服务器不应该接收文本")
+	}
+
+	// 预留后统计
+	relayInfo, _ := peer.AddrInfoFromString(relayAddr)
+	_, e = client.Reserve(n.ctx, n.host, *relayInfo)
+	if e != nil {
+		t.Fatal(e)
+	}
+	jt, e := relay.RelayStats()
+	if e != nil {
+		t.Fatal(e)
+	}
+	var stats relayStats
+	e = json.Unmarshal([]byte(jt), &stats)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if stats.ReserveCount != 1 || stats.ConnCount == 0 {
+		t.Fatal("中继状态错误", jt)
+	}
+	if _, e := n.RelayStats(); e == nil {
+		t.Fatal("没有开启中继服务时不应该有中继状态")
+	}
+}
+
+func TestNodeConnState(t *testing.T) {
+	a, aCallback := startTestNode(t)
+	defer stopTestNode(t, a, aCallback)
+	b, bCallback := startTestNode(t)
+
+	e := a.ConnStateCheckSet(fmt.Sprintf("[%q]", b.ID()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	// 设置后通知一次当前状态, 之后只在变化时通知
+	e = connectPeer(a.ctx, a.host, peer.AddrInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}, time.Minute)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reason := ""
+	for reason != ConnReasonDirect && reason != ConnReasonMDNS {
+		select {
+		case reason = <-aCallback.connStateChan:
+		case <-time.After(time.Minute):
+			t.Fatal("没有通知连接")
+		}
+	}
+
+	stopTestNode(t, b, bCallback)
+	select {
+	case reason := <-aCallback.connStateChan:
+		if reason != ConnReasonDrop {
+			t.Fatal("连接状态错误", reason)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("没有通知断开")
+	}
+	select {
+	case reason := <-aCallback.connStateChan:
+		t.Fatal("状态没有变化时不应该通知", reason)
+	case <-time.After(3 * time.Second):
+	}
+}
+
+// 在连接状态回调中调用节点方法的回调
+type reentrantCallback struct {
+	*testCallback
+	n *Node
+}
+
+func (cb *reentrantCallback) OnOpConnState(id string, isConn bool, reason string) {
+	_ = cb.n.ConnStateCheckSet(fmt.Sprintf("[%q]", id))
+	_, _ = cb.n.ConnList(id)
+	cb.testCallback.OnOpConnState(id, isConn, reason)
+}
+
+// 连接状态回调在锁外调用, 回调中可以调用其他方法
+func TestNodeConnStateCallback(t *testing.T) {
+	cb := &reentrantCallback{testCallback: newTestCallback()}
+	a := NewNode(&NodeConfig{PrivateDir: t.TempDir(), PublicDir: t.TempDir(), Callback: cb})
+	cb.n = a
+	go func() {
+		e := a.Start()
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+	select {
+	case <-cb.startChan:
+	case <-time.After(time.Minute):
+		t.Fatal("启动超时")
+	}
+	defer stopTestNode(t, a, cb.testCallback)
+	b, bCallback := startTestNode(t)
+	defer stopTestNode(t, b, bCallback)
+
+	e := a.ConnStateCheckSet(fmt.Sprintf("[%q]", b.ID()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = connectPeer(a.ctx, a.host, peer.AddrInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}, time.Minute)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// 设置后先通知一次当前状态
+	for reason := ""; reason != ConnReasonDirect && reason != ConnReasonMDNS; {
+		select {
+		case reason = <-cb.connStateChan:
+		case <-time.After(10 * time.Second):
+			t.Fatal("没有通知连接")
+		}
+	}
+	if _, e := a.ConnList(b.ID()); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestNodeMetrics(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+	testTextSend(t, a, aCallback, b, bCallback)
+
+	families, e := prometheus.DefaultGatherer.Gather()
+	if e != nil {
+		t.Fatal(e)
+	}
+	found := make(map[string]bool)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch family.GetName() {
+			case "op_send_total":
+				if labels["kind"] == historyKindText && labels["result"] == "done" && m.GetCounter().GetValue() >= 1 {
+					found[family.GetName()] = true
+				}
+			case "op_conns", "op_protocol_bytes_total":
+				if labels["node"] == a.ID() {
+					found[family.GetName()] = true
+				}
+			}
+		}
+	}
+	for _, name := range []string{"op_send_total", "op_conns", "op_protocol_bytes_total"} {
+		if !found[name] {
+			t.Error("没有指标", name)
+		}
+	}
+}
+
+func TestNodeFileSendReader(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	fileBytes := make([]byte, 2*1048576+3)
+	_, _ = rand.Read(fileBytes)
+	fileHash := fmt.Sprintf("%x", sha256.Sum256(fileBytes))
+
+	e := a.FileSendReader("test", b.ID(), "reader.bin", fileHash, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result := <-aCallback.fileSendChan; result != "成功" {
+		t.Fatal("发送出错", result)
+	}
+	select {
+	case receivePath := <-bCallback.fileReceiveChan:
+		receiveBytes, e := os.ReadFile(receivePath)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if filepath.Base(receivePath) != "reader.bin" || !bytes.Equal(receiveBytes, fileBytes) {
+			t.Fatal("接收内容错误", receivePath)
+		}
+		// 接收的文件不可执行
+		info, e := os.Stat(receivePath)
+		if e != nil || info.Mode().Perm()&0111 != 0 {
+			t.Fatal("接收文件权限错误", info, e)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("接收超时")
+	}
+
+	// 读取时发现哈希不符, 中止发送并且不会重试
+	e = a.FileSendReader("test2", b.ID(), "bad.bin", fileHash, 3, bytes.NewReader([]byte("bad")))
+	if ErrorCode(fmt.Sprint(e)) != ErrorCodeHashMismatch {
+		t.Fatal("没有发现哈希不符", e)
+	}
+}
+
+// 接收前等待决定: 拒绝, 同意和超时自动接收
+func TestNodeFileReceiveOffer(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	filePath := filepath.Join(t.TempDir(), "offer.txt")
+	e := os.WriteFile(filePath, []byte("文件接收决定"), os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+	offerUUID := func() string {
+		select {
+		case uuid := <-bCallback.offerChan:
+			return uuid
+		case <-time.After(10 * time.Second):
+			t.Fatal("没有通知收到文件")
+			return ""
+		}
+	}
+
+	// 默认一直等待决定
+	if NewNode(&NodeConfig{}).offerAutoAcceptSecond >= 0 {
+		t.Fatal("默认没有等待接收决定")
+	}
+
+	// 拒绝, 对方得到拒绝代码和原因
+	b.FileReceiveAutoAcceptSet(-1)
+	if b.FileReceiveAccept("不存在") == nil {
+		t.Fatal("接收了不存在的文件")
+	}
+	a.FileSend("reject", b.ID(), filePath)
+	e = b.FileReceiveReject(offerUUID(), "不需要")
+	if e != nil {
+		t.Fatal(e)
+	}
+	result := <-aCallback.fileSendChan
+	if ErrorCode(result) != ErrorCodeReject || !strings.Contains(result, "不需要") {
+		t.Fatal("没有得到拒绝原因", result)
+	}
+
+	// 同意
+	a.FileSend("accept", b.ID(), filePath)
+	e = b.FileReceiveAccept(offerUUID())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result := <-aCallback.fileSendChan; result != "成功" {
+		t.Fatal("同意后发送出错", result)
+	}
+	<-bCallback.fileReceiveChan
+
+	// 超时自动接收
+	b.FileReceiveAutoAcceptSet(1)
+	start := time.Now()
+	a.FileSend("timeout", b.ID(), filePath)
+	offerUUID()
+	if result := <-aCallback.fileSendChan; result != "成功" {
+		t.Fatal("超时自动接收出错", result)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("没有等待决定", time.Since(start))
+	}
+	<-bCallback.fileReceiveChan
+}
+
+// 发送中取消, 双方都得到通知, 缓存可以续传
+func TestNodeFileSendCancel(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	fileBytes := make([]byte, 3*1048576)
+	_, _ = rand.Read(fileBytes)
+	filePath := filepath.Join(t.TempDir(), "cancel.bin")
+	e := os.WriteFile(filePath, fileBytes, os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+	fileHash := fmt.Sprintf("%x", sha256.Sum256(fileBytes))
+	fileCachePath := filepath.Join(b.config.PublicDir, ".CACHE", a.ID(), fileHash)
+
+	// 限速, 保证取消时还在传输
+	_ = a.RateLimitSet(`{"peerUpload":524288}`)
+	a.FileSend("cancel", b.ID(), filePath)
+	for i := 0; ; i++ {
+		if fileInfo, e := os.Stat(fileCachePath); e == nil && fileInfo.Size() > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("没有开始接收")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// 唯一标识不能重复
+	a.TextSend("cancel", b.ID(), "你好")
+	if result := <-aCallback.textSendChan; !strings.Contains(result, "唯一标识已经存在") {
+		t.Fatal("没有拒绝重复的唯一标识", result)
+	}
+	e = a.SendCancel("cancel")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, cb := range []*testCallback{aCallback, bCallback} {
+		select {
+		case <-cb.cancelChan:
+		case <-time.After(10 * time.Second):
+			t.Fatal("没有通知取消")
+		}
+	}
+	fileInfo, e := os.Stat(fileCachePath)
+	if e != nil || fileInfo.Size() == 0 || fileInfo.Size() >= int64(len(fileBytes)) {
+		t.Fatal("取消后缓存错误", e)
+	}
+
+	// 再次发送时续传
+	_ = a.RateLimitSet(`{}`)
+	a.FileSend("resume", b.ID(), filePath)
+	if result := <-aCallback.fileSendChan; result != "成功" {
+		t.Fatal("续传出错", result)
+	}
+	receivePath := <-bCallback.fileReceiveChan
+	receiveBytes, _ := os.ReadFile(receivePath)
+	if !bytes.Equal(receiveBytes, fileBytes) {
+		t.Fatal("续传后文件内容错误")
+	}
+}
+
+func TestNodeRateLimit(t *testing.T) {
+	a, aCallback, b, _ := startTestNodePair(t)
+
+	if a.RateLimitSet(`{"upload":-1}`) == nil {
+		t.Fatal("没有拒绝无效的速率限制")
+	}
+	e := a.RateLimitSet(`{"peerUpload":262144}`)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 1MiB文件按256KiB每秒至少需要3秒
+	fileBytes := make([]byte, 1048576)
+	_, _ = rand.Read(fileBytes)
+	fileHash := fmt.Sprintf("%x", sha256.Sum256(fileBytes))
+	start := time.Now()
+	go func() {
+		_ = a.FileSendReader("file", b.ID(), "limit.bin", fileHash, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	}()
+
+	// 文本优先, 不用等待文件
+	time.Sleep(500 * time.Millisecond)
+	a.TextSend("text", b.ID(), "你好")
+	if result := <-aCallback.textSendChan; result != "成功" {
+		t.Fatal("文本发送出错", result)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("文本等待了文件", time.Since(start))
+	}
+
+	if result := <-aCallback.fileSendChan; result != "成功" {
+		t.Fatal("文件发送出错", result)
+	}
+	if time.Since(start) < 2500*time.Millisecond {
+		t.Fatal("文件没有限速", time.Since(start))
+	}
+}
+
+// 只在读写文本时让出, 打开后不写入的流和无法连接的节点不影响文件数据
+func TestNodeRatePriority(t *testing.T) {
+	a, _, b, _ := startTestNodePair(t)
+	priority := func(n *Node) int32 {
+		return atomic.LoadInt32(&n.rateLimiter.priority)
+	}
+
+	s, e := a.host.NewStream(a.ctx, b.host.ID(), protocolTextV2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		_ = s.Reset()
+	}()
+	// 完成协议协商, 对方开始处理但是不写入内容
+	_, _ = s.Write(nil)
+
+	key, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	offlineID, _ := peer.IDFromPrivateKey(key)
+	a.TextSend("offline", offlineID.Pretty(), "你好")
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if priority(a) != 0 || priority(b) != 0 {
+			t.Fatal("没有读写文本时文件数据让出", priority(a), priority(b))
+		}
+	}
+}
+
+func TestNodePrivateNetwork(t *testing.T) {
+	startPrivate := func(key string) (*Node, *testCallback) {
+		privateDir := t.TempDir()
+		e := os.WriteFile(filepath.Join(privateDir, privateNetworkKeyName), []byte(key), 0600)
+		if e != nil {
+			t.Fatal(e)
+		}
+		n, cb := startTestNodeWithDir(t, privateDir, &Options{PrivateNetwork: true})
+		t.Cleanup(func() { stopTestNode(t, n, cb) })
+		return n, cb
+	}
+	key, e := PrivateNetworkKeyGenerate()
+	if e != nil {
+		t.Fatal(e)
+	}
+	otherKey, _ := PrivateNetworkKeyGenerate()
+
+	// 没有密钥时不能启动
+	n := NewNode(&NodeConfig{PrivateDir: t.TempDir(), PublicDir: t.TempDir(), Callback: newTestCallback(), Options: &Options{PrivateNetwork: true}})
+	if n.Start() == nil {
+		t.Fatal("没有密钥时启动了私有网络")
+	}
+	// 私有网络不支持quic
+	n = NewNode(&NodeConfig{PrivateDir: t.TempDir(), PublicDir: t.TempDir(), Callback: newTestCallback(), Options: &Options{PrivateNetwork: true, Transports: []string{TransportQUIC}}})
+	if n.Start() == nil {
+		t.Fatal("私有网络使用了quic")
+	}
+
+	a, aCallback := startPrivate(key)
+	b, bCallback := startPrivate(key)
+	c, _ := startPrivate(otherKey)
+
+	// 相同密钥的节点可以连接
+	e = connectPeer(a.ctx, a.host, peer.AddrInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}, time.Minute)
+	if e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(time.Second)
+	testTextSend(t, a, aCallback, b, bCallback)
+
+	// 不同密钥的节点不能连接
+	e = connectPeer(a.ctx, a.host, peer.AddrInfo{ID: c.host.ID(), Addrs: c.host.Addrs()}, 5*time.Second)
+	if e == nil {
+		t.Fatal("连接了其他私有网络的节点")
+	}
+}
+
+func TestNodeTrust(t *testing.T) {
+	a, aCallback, b, bCallback := startTestNodePair(t)
+
+	// 白名单模式拒绝其他节点的文本
+	e := b.TrustModeSet(TrustModeAllow)
+	if e != nil {
+		t.Fatal(e)
+	}
+	a.TextSend("reject", b.ID(), "你好")
+	if result := <-aCallback.textSendChan; result == "成功" {
+		t.Fatal("白名单模式接收了其他节点的文本")
+	}
+	select {
+	case protocol := <-bCallback.rejectChan:
+		if protocol != protocolTextV2 {
+			t.Fatal("拒绝的协议错误", protocol)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("没有通知拒绝")
+	}
+
+	// 取消通知也需要信任
+	if a.cancelNotify(b.host.ID(), "hash/uuid") == nil {
+		t.Fatal("白名单模式接收了其他节点的取消")
+	}
+	select {
+	case protocol := <-bCallback.rejectChan:
+		if protocol != protocolCancel {
+			t.Fatal("拒绝的协议错误", protocol)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("没有通知拒绝取消")
+	}
+
+	// 加入白名单后接收
+	e = b.PeerAllow(a.ID())
+	if e != nil {
+		t.Fatal(e)
+	}
+	testTextSend(t, a, aCallback, b, bCallback)
+
+	// 黑名单中的节点立即断开且不能连接
+	e = b.PeerBlock(a.ID())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if connectCount(b.host, a.host.ID()) != 0 {
+		t.Fatal("没有断开黑名单中的节点")
+	}
+	// 等待对方发现连接断开后再尝试连接
+	for i := 0; i < 50 && connectCount(a.host, b.host.ID()) != 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	_ = connectPeer(a.ctx, a.host, peer.AddrInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if connectCount(b.host, a.host.ID()) != 0 {
+		t.Fatal("连接了黑名单中的节点")
+	}
+	select {
+	case protocol := <-bCallback.rejectChan:
+		if protocol != trustRejectConn {
+			t.Fatal("拒绝的协议错误", protocol)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("没有通知拒绝连接")
+	}
+
+	// 保存在私有文件夹
+	e = b.trustLoad()
+	if e != nil {
+		t.Fatal(e)
+	}
+	jt, e := b.TrustList()
+	if e != nil {
+		t.Fatal(e)
+	}
+	var l trustList
+	_ = json.Unmarshal([]byte(jt), &l)
+	if l.Mode != TrustModeAllow || len(l.AllowArray) != 0 || len(l.BlockArray) != 1 || l.BlockArray[0] != a.ID() {
+		t.Fatal("信任列表错误", jt)
+	}
+}
+
+func TestNodeIdentity(t *testing.T) {
+	a, _, b, _ := startTestNodePair(t)
+
+	// 导出和导入
+	blob, e := a.IdentityExport("备份")
+	if e != nil {
+		t.Fatal(e)
+	}
+	c := NewNode(&NodeConfig{PrivateDir: t.TempDir()})
+	_, e = c.IdentityImport(blob, "错误")
+	if ErrorCode(fmt.Sprint(e)) != ErrorCodePassphrase {
+		t.Fatal("没有发现密码错误", e)
+	}
+	id, e := c.IdentityImport(blob, "备份")
+	if e != nil || id != a.ID() {
+		t.Fatal("导入身份出错", id, e)
+	}
+
+	// 通过二维码迁移
+	qrPath := filepath.Join(t.TempDir(), "migrate.jpg")
+	qrText, e := b.IdentityMigrateReceive(qrPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(qrPath); e != nil {
+		t.Fatal("没有生成二维码", e)
+	}
+	var qt identityMigrateText
+	_ = json.Unmarshal([]byte(qrText), &qt)
+	qt.Secret = "错误"
+	wrongText, _ := json.Marshal(qt)
+	if e := a.IdentityMigrateSend(string(wrongText)); e == nil {
+		t.Fatal("使用错误的二维码迁移成功")
+	}
+	// 超时秒数无效时不影响接收
+	if _, e := b.IdentityMigrateWait(0); e == nil {
+		t.Fatal("接受了无效的超时秒数")
+	}
+	sendChan := make(chan error, 1)
+	go func() {
+		sendChan <- a.IdentityMigrateSend(qrText)
+	}()
+	id, e = b.IdentityMigrateWait(30)
+	if e != nil || id != a.ID() {
+		t.Fatal("迁移身份出错", id, e)
+	}
+	if e := <-sendChan; e != nil {
+		t.Fatal(e)
+	}
+	key, e := getPrivateKey(filepath.Join(b.config.PrivateDir, "my.key"), "")
+	if e != nil || !(*key).Equals(a.host.Peerstore().PrivKey(a.host.ID())) {
+		t.Fatal("迁移的密钥错误", e)
+	}
+	if _, e := b.IdentityMigrateWait(1); e == nil {
+		t.Fatal("迁移完成后仍在接收")
+	}
+}
+
+func TestNodeContactCard(t *testing.T) {
+	a, aCallback := startTestNode(t)
+	t.Cleanup(func() { stopTestNode(t, a, aCallback) })
+	b, bCallback := startTestNode(t)
+	t.Cleanup(func() { stopTestNode(t, b, bCallback) })
+
+	qrPath := filepath.Join(t.TempDir(), "card.jpg")
+	text, e := a.ContactCardQrcodeCreate(qrPath, "名片")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 修改后签名错误
+	var card contactCard
+	_ = json.Unmarshal([]byte(text), &card)
+	var c contactCardPayload
+	_ = c.unmarshal(card.Payload)
+	c.Name = "修改"
+	card.Payload, _ = c.marshal()
+	changedText, _ := json.Marshal(card)
+	if _, e := b.ContactCardVerify(string(changedText)); e == nil {
+		t.Fatal("验证了修改过的名片")
+	}
+
+	// 过期的名片
+	key := a.host.Peerstore().PrivKey(a.host.ID())
+	c.Time = time.Now().Add(-2 * contactCardValidity).UnixMilli()
+	c.Expire = time.Now().Add(-contactCardValidity).UnixMilli()
+	expiredText, e := contactCardSign(key, c)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := b.ContactCardVerify(expiredText); e == nil {
+		t.Fatal("验证了过期的名片")
+	}
+
+	// 扫描后直接连接
+	jt, e := b.ContactCardQrcodeVerify(qrPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_ = json.Unmarshal([]byte(jt), &c)
+	if c.ID != a.ID() || c.Name != "名片" {
+		t.Fatal("名片内容错误", jt)
+	}
+	for i := 0; connectCount(b.host, a.host.ID()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("没有连接名片节点")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,82 @@
+package op
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// 文件接收决定
+// 默认自动接收等待秒数, 一直等待 FileReceiveAccept 或 FileReceiveReject
+const offerAutoAcceptDefault = -1
+
+type offerDecision struct {
+	accept bool
+	reason string
+}
+
+// 等待文件接收决定
+//
+// 返回是否接收及拒绝原因
+func (n *Node) offerWait(uuid string, t *receiveTask) (bool, string) {
+	n.offerMutex.Lock()
+	second := n.offerAutoAcceptSecond
+	if second == 0 {
+		n.offerMutex.Unlock()
+		return true, ""
+	}
+	decisionChan := make(chan offerDecision, 1)
+	n.offerMap[uuid] = decisionChan
+	n.offerMutex.Unlock()
+
+	defer func() {
+		n.offerMutex.Lock()
+		delete(n.offerMap, uuid)
+		n.offerMutex.Unlock()
+	}()
+
+	// 小于0时不会自动接收
+	var timeoutChan <-chan time.Time
+	if second > 0 {
+		timer := time.NewTimer(time.Second * time.Duration(second))
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	ctx, _ := n.current()
+	select {
+	case d := <-decisionChan:
+		return d.accept, d.reason
+	case <-timeoutChan:
+		log.Println("文件接收等待超时, 自动接收", uuid)
+		return true, ""
+	case <-t.cancelChan:
+		return false, "对方取消"
+	case <-ctx.Done():
+		return false, "节点停止"
+	}
+}
+
+// 作出文件接收决定
+func (n *Node) offerDecide(uuid string, d offerDecision) error {
+	n.offerMutex.Lock()
+	decisionChan, ok := n.offerMap[uuid]
+	if ok {
+		delete(n.offerMap, uuid)
+	}
+	n.offerMutex.Unlock()
+	if !ok {
+		return errors.New("没有找到等待决定的文件接收")
+	}
+
+	decisionChan <- d
+	return nil
+}
+
+// 设置自动接收等待秒数
+func (n *Node) offerAutoAcceptSet(second int64) {
+	log.Println("设置自动接收等待秒数", second)
+	n.offerMutex.Lock()
+	n.offerAutoAcceptSecond = second
+	n.offerMutex.Unlock()
+}
@@ -3,20 +3,23 @@ package op
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-open-p2p/dns"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
 	libp2p_dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
-	"github.com/libp2p/go-libp2p/p2p/security/noise"
-	libp2p_tls "github.com/libp2p/go-libp2p/p2p/security/tls"
 )
 
 type Callback interface {
@@ -26,28 +29,46 @@ type Callback interface {
 	OnOpState(jt string)
 	// OnOpMDNSPeer MDNS发现节点
 	OnOpMDNSPeer(id string)
-	// OnOpConnState 节点连接状态变化
-	OnOpConnState(id string, isConn bool)
+	// OnOpConnState 节点连接状态变化, 只在变化时通知.
+	// reason 为 ConnReasonDirect, ConnReasonRelay, ConnReasonMDNS 或 ConnReasonDrop, 详细连接通过 ConnList 获取
+	OnOpConnState(id string, isConn bool, reason string)
 	// OnOpTextSendError 文本发送出错
 	OnOpTextSendError(uuid, et string)
 	// OnOpTextSendDone 文本发送完成
 	OnOpTextSendDone(uuid string)
-	// OnOpTextReceiveDone 文本接收完毕
-	OnOpTextReceiveDone(id, text string)
-	// OnOpFileSendError 文件发送出错
+	// OnOpTextSendCancel 文本发送取消
+	OnOpTextSendCancel(uuid string)
+	// OnOpTextDelivered 文本已经送达对方应用
+	OnOpTextDelivered(uuid string)
+	// OnOpTextRead 文本已经被对方阅读
+	OnOpTextRead(uuid string)
+	// OnOpTextReceiveDone 文本接收完毕, uuid 为对方发送时的唯一标识, 用于 TextMarkRead
+	OnOpTextReceiveDone(id, text, uuid string)
+	// OnOpFileSendError 文件发送出错, et 可以通过 ErrorCode 获取错误代码
 	OnOpFileSendError(uuid, et string)
-	// OnOpFileSendProgress 文件发送进度
-	OnOpFileSendProgress(uuid string, fileSize, sendSize int64)
+	// OnOpFileSendProgress 文件发送进度, 按 ProgressIntervalSet 设置的间隔合并, 第一次和完成时总是通知.
+	// speed 当前速度, averageSpeed 平均速度(字节每秒), etaSecond 剩余秒数, -1表示未知
+	OnOpFileSendProgress(uuid string, fileSize, sendSize, speed, averageSpeed, etaSecond int64)
 	// OnOpFileSendDone 文件发送完成
 	OnOpFileSendDone(uuid, fileHash string)
+	// OnOpFileSendCancel 文件发送取消
+	OnOpFileSendCancel(uuid string)
+	// OnOpFileReceiveOffer 收到文件, 通过 FileReceiveAccept 或 FileReceiveReject 决定是否接收
+	OnOpFileReceiveOffer(id, fileHash, fileName, uuid string, fileSize int64)
 	// OnOpFileReceiveStart 文件接收开始
 	OnOpFileReceiveStart(id, fileHash, fileName, uuid string, fileSize int64)
 	// OnOpFileReceiveError 文件接收错误
 	OnOpFileReceiveError(uuid, et string)
-	// OnOpFileReceiveProgress 文件接收进度
-	OnOpFileReceiveProgress(uuid string, fileSize, receiveSize int64)
+	// OnOpFileReceiveProgress 文件接收进度, 参数同 OnOpFileSendProgress
+	OnOpFileReceiveProgress(uuid string, fileSize, receiveSize, speed, averageSpeed, etaSecond int64)
 	// OnOpFileReceiveDone 文件接收完毕
 	OnOpFileReceiveDone(uuid, filePath string)
+	// OnOpFileReceiveCancel 文件接收取消(对方取消发送)
+	OnOpFileReceiveCancel(uuid string)
+	// OnOpQueueChanged 发送队列项目变化, jt 为队列项目JSON
+	OnOpQueueChanged(jt string)
+	// OnOpPeerReject 根据信任列表拒绝了节点, protocol 为 conn(连接) 或者被拒绝的协议. 同一节点的同一协议每分钟最多通知一次
+	OnOpPeerReject(id, protocol string)
 }
 
 const (
@@ -57,57 +78,331 @@ const (
 	protocolText = "/lilu.red/op/1/text"
 	// 协议：文件
 	protocolFile = "/lilu.red/op/1/file"
+	// 协议：取消
+	protocolCancel = "/lilu.red/op/1/cancel"
+	// 协议：文本, 第2版
+	protocolTextV2 = "/lilu.red/op/2/text"
+	// 协议：文件, 第2版
+	protocolFileV2 = "/lilu.red/op/2/file"
+	// 协议：文件夹
+	protocolDir = "/lilu.red/op/2/dir"
+	// 协议：回执
+	protocolReceipt = "/lilu.red/op/2/receipt"
+	// 协议：身份迁移, 只在等待迁移时处理
+	protocolMigrate = "/lilu.red/op/2/migrate"
 )
 
-var globalCallback Callback
-var globalContext context.Context
-var globalContextCancel context.CancelFunc
-var globalHost host.Host
-var globalDHT *libp2p_dht.IpfsDHT
-var globalPublicDirectory string
-var mdnsStopChan = make(chan int, 1)
-var stateStopChan = make(chan int, 1)
-var connStateStopChan = make(chan int, 1)
-
-// Start 启动
-//
-// privateDirArg 私有文件夹绝对路径, 用于存放密钥等私密内容
-//
-// publicDirArg 公共文件夹绝对路径, 用于存放接收文件等公开内容
-//
-// nameArg 我的名称, 用于对方分辨自己
+// NodeConfig 节点配置
+type NodeConfig struct {
+	// PrivateDir 私有文件夹绝对路径, 用于存放密钥等私密内容
+	PrivateDir string
+	// PublicDir 公共文件夹绝对路径, 用于存放接收文件等公开内容
+	PublicDir string
+	// Callback 回调, 用于传递异步状态数据
+	Callback Callback
+	// Options 启动选项, 为nil时使用默认选项
+	Options *Options
+	// Passphrase 密钥密码, 为空时不加密
+	Passphrase string
+}
+
+// Node 节点
 //
-// callbackArg 回调, 用于传递异步状态数据
+// 同一进程中可以运行多个节点, 停止后可以再次启动
+type Node struct {
+	config *NodeConfig
+
+	mutex             sync.Mutex
+	running           bool
+	ctx               context.Context
+	ctxCancel         context.CancelFunc
+	host              host.Host
+	dht               *libp2p_dht.IpfsDHT
+	mdnsStopChan      chan int
+	stateStopChan     chan int
+	connStateStopChan chan int
+
+	sendTaskMutex    sync.Mutex
+	sendTaskMap      map[string]*sendTask
+	receiveTaskMutex sync.Mutex
+	receiveTaskMap   map[string]*receiveTask
+
+	offerMutex sync.Mutex
+	// 等待决定的文件接收
+	offerMap map[string]chan offerDecision
+	// 自动接收等待秒数, 0表示立即接收, 小于0(默认)表示一直等待
+	offerAutoAcceptSecond int64
+
+	historyMutex sync.Mutex
+	// 记录文件索引, 键为文件路径
+	historyIndexMap map[string]*historyIndex
+
+	queueMutex sync.Mutex
+	// 发送队列, 保存在私有文件夹
+	queueItems []*queueItem
+
+	filePathPolicyMutex sync.Mutex
+	filePathPolicy      FilePathPolicy
+
+	// 静态中继
+	relays []peer.AddrInfo
+	// 中继服务统计, 没有开启中继服务时为nil
+	relayCounter *relayCounter
+	// 流量统计
+	bandwidthCounter *metrics.BandwidthCounter
+	// 速率限制
+	rateLimiter *rateLimiter
+	// 进度通知间隔, 原子操作
+	progressInterval int64
+
+	trustMutex sync.RWMutex
+	// 信任状态, 启动时加载
+	trust *trustState
+	// 上次通知拒绝的时间
+	trustReportMap map[trustReportKey]time.Time
+
+	migrateMutex sync.Mutex
+	// 等待中的身份迁移
+	migrate *identityMigrate
+
+	connStateMutex sync.RWMutex
+	// 不要使用! 通过connStateIdArraySet()进行设置
+	connStateIdArray []string
+	// 上次通知的连接状态原因, 键为节点标识
+	connStateMap map[string]string
+	// 重连状态, 键为节点标识
+	connRetryMap map[string]*connRetry
+	// 通过MDNS发现的节点地址IP, 键为节点标识
+	connMdnsMap map[string]map[string]bool
+	// 等待发送的连接状态通知, 在锁外按顺序发送
+	connNoticeQueue []connNotice
+	// 是否有协程正在发送通知
+	connNoticeSending bool
+}
+
+// 默认节点, 用于包函数
+var defaultNode = NewNode(&NodeConfig{})
+
+// NewNode 创建节点
+func NewNode(config *NodeConfig) *Node {
+	return &Node{
+		config:           config,
+		sendTaskMap:      make(map[string]*sendTask),
+		receiveTaskMap:   make(map[string]*receiveTask),
+		offerMap:         make(map[string]chan offerDecision),
+		historyIndexMap:  make(map[string]*historyIndex),
+		rateLimiter:      newRateLimiter(),
+		progressInterval: int64(progressIntervalDefault),
+
+		offerAutoAcceptSecond: offerAutoAcceptDefault,
+	}
+}
+
+// 回调
+func (n *Node) callback() Callback {
+	return n.config.Callback
+}
+
+// Start 启动, 阻塞直到停止
 //
 // 存在问题
 //
 // 如果targetSdk设置为30以上, 部分手机会出现下面问题:
 // GoLog: 2021-10-19T12:29:24.041Z	ERROR	basichost	basic/basic_host.go:289	failed to resolve local interface addresses	{"error": "route ip+net: netlinkrib: permission denied"}
-func Start(privateDirArg string, publicDirArg string, callbackArg Callback) error {
+func (n *Node) Start() error {
+	n.mutex.Lock()
+	if n.running {
+		n.mutex.Unlock()
+		return errors.New("节点已经启动")
+	}
+	n.running = true
+	// 创建节点上下文
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	n.ctx, n.ctxCancel = ctx, ctxCancel
+	n.mdnsStopChan = make(chan int, 1)
+	n.stateStopChan = make(chan int, 1)
+	n.connStateStopChan = make(chan int, 1)
+	n.host, n.dht, n.relayCounter = nil, nil, nil
+	mdnsStopChan := n.mdnsStopChan
+	passphrase := n.config.Passphrase
+	n.mutex.Unlock()
+	defer func() {
+		n.mutex.Lock()
+		ctxCancel()
+		// 告知停止后可能已经再次启动, 不能修改新的运行状态
+		if n.ctx == ctx {
+			n.running = false
+		}
+		n.mutex.Unlock()
+	}()
+
 	log.Println("启动开放点对点")
-	log.Println("私有文件夹", privateDirArg)
-	log.Println("公共文件夹", publicDirArg)
-	globalPublicDirectory = publicDirArg
-	globalCallback = callbackArg
+	log.Println("私有文件夹", n.config.PrivateDir)
+	log.Println("公共文件夹", n.config.PublicDir)
 
-	e := os.MkdirAll(privateDirArg, os.ModePerm)
+	e := os.MkdirAll(n.config.PrivateDir, 0700)
 	if e != nil {
 		return fmt.Errorf("%w\n创建私有文件夹出错", e)
 	}
-	e = os.MkdirAll(publicDirArg, os.ModePerm)
+	e = os.MkdirAll(n.config.PublicDir, os.ModePerm)
 	if e != nil {
 		return fmt.Errorf("%w\n创建公共文件夹出错", e)
 	}
 
 	// 获取密钥
-	myKey, e := getPrivateKey(filepath.Join(privateDirArg, "my.key"))
+	myKey, e := getPrivateKey(filepath.Join(n.config.PrivateDir, "my.key"), passphrase)
 	if e != nil {
 		return fmt.Errorf("%w\n获取密钥出错", e)
 	}
 
-	// 创建全局上下文
-	globalContext, globalContextCancel = context.WithCancel(context.Background())
+	// 启动选项
+	options := n.config.Options
+	if options == nil {
+		options = &Options{}
+	}
+	optionArray, e := options.libp2pOptions()
+	if e != nil {
+		return e
+	}
+	relayOptionArray, e := n.relayOptions(options)
+	if e != nil {
+		return e
+	}
+	optionArray = append(optionArray, relayOptionArray...)
+	bandwidthCounter := metrics.NewBandwidthCounter()
+	optionArray = append(optionArray, libp2p.BandwidthReporter(bandwidthCounter))
+	relays, _ := parseRelayAddrs(options.StaticRelays)
+	if options.RateLimit != nil {
+		n.rateLimiter.set(*options.RateLimit)
+	}
+
+	// 信任列表, 通过连接过滤拒绝黑名单中的节点
+	e = n.trustLoad()
+	if e != nil {
+		return fmt.Errorf("加载信任列表出错: %w", e)
+	}
+	optionArray = append(optionArray, libp2p.ConnectionGater(&trustGater{n: n}))
+
+	// 私有网络使用预共享密钥, 私有的DHT和MDNS
+	dhtOptionArray := []libp2p_dht.Option{libp2p_dht.Mode(libp2p_dht.ModeAuto)}
+	if options.relayMode() {
+		dhtOptionArray = []libp2p_dht.Option{libp2p_dht.Mode(libp2p_dht.ModeServer)}
+	}
+	mdnsName := mdnsServiceName
+	if options.PrivateNetwork {
+		pn, e := privateNetworkLoad(n.config.PrivateDir)
+		if e != nil {
+			return e
+		}
+		optionArray = append(optionArray, libp2p.PrivateNetwork(pn.psk))
+		dhtOptionArray = append(dhtOptionArray, libp2p_dht.ProtocolPrefix(pn.dhtProtocolPrefix()))
+		mdnsName = pn.mdnsServiceName()
+	}
+
+	// 创建主机, 默认使用上次的端口, 被占用时改用随机端口
+	var ports listenPorts
+	if options.portSave() {
+		ports = listenPortsLoad(n.config.PrivateDir)
+	}
+	h, dht, e := n.newHost(ctx, *myKey, options.listenAddrs(ports), dhtOptionArray, optionArray)
+	if e != nil && len(ports) != 0 {
+		log.Println("使用上次的端口创建主机出错, 改用随机端口:", e)
+		h, dht, e = n.newHost(ctx, *myKey, options.listenAddrs(nil), dhtOptionArray, optionArray)
+	}
+	if e != nil {
+		return fmt.Errorf("创建主机出错: %w", e)
+	}
+	defer h.Close()
+	// 其他协程和接口在锁中读取, 见 Node.current
+	n.mutex.Lock()
+	n.host, n.dht, n.bandwidthCounter, n.relays = h, dht, bandwidthCounter, relays
+	n.mutex.Unlock()
+	collector := &metricsCollector{h: h, bandwidthCounter: bandwidthCounter}
+	e = metricsRegisterer(h).Register(collector)
+	if e != nil {
+		log.Println("注册指标出错", e)
+	}
+	defer metricsRegisterer(h).Unregister(collector)
+	if options.portSave() {
+		e = listenPortsSave(n.config.PrivateDir, h)
+		if e != nil {
+			log.Println("保存监听端口出错", e)
+		}
+	}
+
+	// 连接引导
+	var dnsTxtArray []string
+	if len(options.Bootstraps) != 0 {
+		dnsTxtArray = options.Bootstraps
+	} else if options.PrivateNetwork {
+		log.Println("私有网络没有设置引导, 只能通过MDNS或者 BootstrapSet 连接")
+	} else {
+		dnsTxtArray = publicBootstraps()
+	}
+	for _, v := range dnsTxtArray {
+		go connectBootstrap(ctx, h, v)
+	}
+
+	// 中继和引导服务器不传输文本和文件
+	if !options.relayMode() {
+		// 初始化交换
+		n.initExchange(h)
+
+		// 加载发送队列
+		e = n.queueLoad()
+		if e != nil {
+			log.Println("加载发送队列出错", e)
+		}
+	}
+
+	// 告知节点启动
+	log.Println("开放点对点已经启动", h.ID().Pretty(), h.Addrs())
+	var maArray []string
+	for _, ma := range h.Addrs() {
+		maArray = append(maArray, ma.String())
+	}
+	maArrayBytes, e := json.Marshal(maArray)
+	if e != nil {
+		return fmt.Errorf("我的地址转换出错: %w", e)
+	}
+	n.callback().OnOpStart(h.ID().Pretty(), string(maArrayBytes))
+
+	if options.relayMode() {
+		log.Println("中继和引导服务器, 引导TXT记录:", relayTxtArray(h))
+	} else {
+		// 初始化MDNS
+		mdnsInit(ctx, h, mdnsName, mdnsStopChan, n.callback(), n.connStateMdnsFound)
+	}
 
+	// 初始化状态
+	n.initState(h, bandwidthCounter)
+
+	if !options.relayMode() {
+		// 初始化连接状态
+		n.connStateInit(h)
+	}
+
+	// 保持运行
+	<-ctx.Done()
+
+	// 关闭主机并标记停止, 告知停止后可以再次启动
+	_ = h.Close()
+	n.mutex.Lock()
+	if n.ctx == ctx {
+		n.running = false
+	}
+	n.mutex.Unlock()
+
+	// 告知节点停止
+	n.callback().OnOpStop()
+
+	log.Println("开放点对点已经停止")
+
+	return nil
+}
+
+// 创建主机
+func (n *Node) newHost(ctx context.Context, key crypto.PrivKey, listenAddrs []string, dhtOptionArray []libp2p_dht.Option, optionArray []libp2p.Option) (host.Host, *libp2p_dht.IpfsDHT, error) {
 	// 连接管理器
 	connmgr, e := connmgr.NewConnManager(
 		100, // Lowwater
@@ -115,47 +410,27 @@ func Start(privateDirArg string, publicDirArg string, callbackArg Callback) erro
 		connmgr.WithGracePeriod(time.Minute),
 	)
 	if e != nil {
-		return fmt.Errorf("创建连接管理器失败: %s", e)
+		return nil, nil, fmt.Errorf("创建连接管理器失败: %s", e)
 	}
 
-	// 创建主机
-	port := 0
-	globalHost, e = libp2p.New(
+	var dht *libp2p_dht.IpfsDHT
+	h, e := libp2p.New(append([]libp2p.Option{
 		// Use the keypair we generated
-		libp2p.Identity(*myKey),
+		libp2p.Identity(key),
 		// Multiple listen addresses
-		libp2p.ListenAddrStrings(
-			fmt.Sprint("/ip4/0.0.0.0/tcp/", port),          // regular tcp connections
-			fmt.Sprint("/ip4/0.0.0.0/udp/", port, "/quic"), // a UDP endpoint for the QUIC transport
-			fmt.Sprint("/ip6/::/udp/", port, "/quic"),      // a UDP endpoint for the QUIC transport
-		),
-		// support TLS connections
-		libp2p.Security(libp2p_tls.ID, libp2p_tls.New),
-		// support noise connections
-		libp2p.Security(noise.ID, noise.New),
-		// support any other default transports (TCP)
-		libp2p.DefaultTransports,
+		libp2p.ListenAddrStrings(listenAddrs...),
 		// Let's prevent our peer from having too many
 		// connections by attaching a connection manager.
 		libp2p.ConnectionManager(connmgr),
-		// Attempt to open ports using uPNP for NATed hosts.
-		libp2p.NATPortMap(),
 		// Let this host use the DHT to find other hosts
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
 			var e error
-			globalDHT, e = libp2p_dht.New(globalContext, h)
-			return globalDHT, e
+			dht, e = libp2p_dht.New(ctx, h, dhtOptionArray...)
+			return dht, e
 		}),
 
-		// 开启后会报错 https://github.com/libp2p/go-libp2p/issues/1852
-		// // Let this host use relays and advertise itself on relays if
-		// // it finds it is behind NAT. Use libp2p.Relay(options...) to
-		// // enable active relays and more.
-		// libp2p.EnableAutoRelay(),
-
-		// libp2p.EnableHolePunching(),
-
-		// libp2p.EnableRelayService(),
+		// 中继, 打洞和中继服务见 Node.relayOptions
+		// AutoRelay必须设置静态中继或者候选节点来源 https://github.com/libp2p/go-libp2p/issues/1852
 
 		// If you want to help other peers to figure out if they are behind
 		// NATs, you can launch the server-side of AutoNAT too (AutoRelay
@@ -164,74 +439,128 @@ func Start(privateDirArg string, publicDirArg string, callbackArg Callback) erro
 		// This service is highly rate-limited and should not cause any
 		// performance issues.
 		libp2p.EnableNATService(),
-	)
-	if e != nil {
-		return fmt.Errorf("创建主机出错: %w", e)
-	}
-	defer globalHost.Close()
+	}, optionArray...)...)
+	return h, dht, e
+}
 
-	// 连接引导
-	var dnsTxtArray []string
+// 公共引导
+func publicBootstraps() []string {
+	var array []string
 	maDnsAddrArray, e := dns.MaDNS("/dnsaddr/bootstrap.libp2p.io") // 注意: gomobile不支持dnsaddr!
 	if e == nil {
 		log.Println("通过dnsaddr得到引导地址", maDnsAddrArray)
-		dnsTxtArray = append(dnsTxtArray, maDnsAddrArray...)
+		array = append(array, maDnsAddrArray...)
 	} else {
 		log.Println("通过dnsaddr查询引导地址失败:", e.Error())
 	}
 	liluAddrArray, e := dns.Txt("bootstrap.libp2p.lilu.red") // 附加引导
 	if e == nil {
 		log.Println("通过lilu.red得到引导地址", liluAddrArray)
-		dnsTxtArray = append(dnsTxtArray, liluAddrArray...)
+		array = append(array, liluAddrArray...)
 	} else {
 		log.Println("通过lilu.red查询引导地址失败:", e.Error())
 	}
-	for _, v := range dnsTxtArray {
-		go connectBootstrap(globalContext, globalHost, v)
-	}
+	return array
+}
 
-	// 初始化交换
-	initExchange(globalHost)
+// 当前运行的上下文和主机
+//
+// 启动时在锁中设置, 重新启动后可能还有上次运行的协程, 不能直接读取
+func (n *Node) current() (context.Context, host.Host) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.ctx, n.host
+}
 
-	// 告知节点启动
-	log.Println("开放点对点已经启动", globalHost.ID().Pretty(), globalHost.Addrs())
-	var maArray []string
-	for _, ma := range globalHost.Addrs() {
-		maArray = append(maArray, ma.String())
+// 已经启动时返回当前运行的上下文和主机
+func (n *Node) started() (context.Context, host.Host, error) {
+	ctx, h := n.current()
+	if ctx == nil || ctx.Err() != nil || h == nil {
+		return nil, nil, errors.New("节点没有启动")
 	}
-	maArrayBytes, e := json.Marshal(maArray)
-	if e != nil {
-		return fmt.Errorf("我的地址转换出错: %w", e)
+	return ctx, h, nil
+}
+
+// Stop 停止
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.running || n.ctx.Err() != nil {
+		log.Println("节点没有启动")
+		return
 	}
-	globalCallback.OnOpStart(globalHost.ID().Pretty(), string(maArrayBytes))
 
-	// 初始化MDNS
-	mdnsInit(globalContext, globalHost, mdnsStopChan, globalCallback)
+	log.Println("停止开放点对点")
 
-	// 初始化状态
-	initState(globalHost, stateStopChan, globalCallback)
+	n.mdnsStopChan <- 1
+	n.stateStopChan <- 1
+	n.connStateStopChan <- 1
 
-	// 初始化连接状态
-	connStateInit(globalContext, globalHost, connStateStopChan, globalCallback)
+	n.ctxCancel()
+}
 
-	// 保持运行
-	<-globalContext.Done()
+// Start 启动默认节点, 阻塞直到停止
+//
+// privateDirArg 私有文件夹绝对路径, 用于存放密钥等私密内容
+//
+// publicDirArg 公共文件夹绝对路径, 用于存放接收文件等公开内容
+//
+// passphraseArg 密钥密码, 为空时不加密. 设置后已经存在的未加密密钥自动加密.
+// 密码错误或者密钥已经加密但是没有密码时返回的错误代码为 ErrorCodePassphrase, 见 ErrorCode
+//
+// callbackArg 回调, 用于传递异步状态数据
+func Start(privateDirArg string, publicDirArg string, passphraseArg string, callbackArg Callback) error {
+	return StartWithOptions(privateDirArg, publicDirArg, passphraseArg, "", callbackArg)
+}
 
-	// 告知节点停止
-	globalCallback.OnOpStop()
+// StartWithOptions 使用启动选项启动默认节点, 阻塞直到停止
+//
+// optionsArg 启动选项JSON, 见 Options, 空表示默认选项
+//
+// 其他参数见 Start
+func StartWithOptions(privateDirArg string, publicDirArg string, passphraseArg string, optionsArg string, callbackArg Callback) error {
+	options, e := parseOptions(optionsArg)
+	if e != nil {
+		return e
+	}
 
-	log.Println("开放点对点已经停止")
+	defaultNode.mutex.Lock()
+	if defaultNode.running {
+		defaultNode.mutex.Unlock()
+		return errors.New("节点已经启动")
+	}
+	defaultNode.config = &NodeConfig{
+		PrivateDir: privateDirArg,
+		PublicDir:  publicDirArg,
+		Callback:   callbackArg,
+		Options:    options,
+		Passphrase: passphraseArg,
+	}
+	defaultNode.mutex.Unlock()
 
-	return nil
+	return defaultNode.Start()
 }
 
-// Stop 停止
-func Stop() {
-	log.Println("停止开放点对点")
-
-	mdnsStopChan <- 1
-	stateStopChan <- 1
-	connStateStopChan <- 1
+// StartRelay 以中继和引导服务器模式启动默认节点, 阻塞直到停止
+//
+// 服务器不使用MDNS, 不传输文本和文件, 为其他节点提供中继服务, DHT使用服务器模式.
+// 密钥保存在私有文件夹, 节点标识固定不变. 建议在 optionsArg 中设置固定端口
+//
+// 其他参数见 StartWithOptions
+func StartRelay(privateDirArg string, publicDirArg string, passphraseArg string, optionsArg string, callbackArg Callback) error {
+	options, e := parseOptions(optionsArg)
+	if e != nil {
+		return e
+	}
+	options.Mode = ModeRelay
+	jsonBytes, e := json.Marshal(options)
+	if e != nil {
+		return e
+	}
+	return StartWithOptions(privateDirArg, publicDirArg, passphraseArg, string(jsonBytes), callbackArg)
+}
 
-	globalContextCancel()
+// Stop 停止默认节点
+func Stop() {
+	defaultNode.Stop()
 }
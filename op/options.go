@@ -0,0 +1,278 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2p_tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	libp2p_quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	libp2p_webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// 传输
+const (
+	TransportTCP          = "tcp"
+	TransportQUIC         = "quic"
+	TransportWebSocket    = "ws"
+	TransportWebTransport = "webtransport"
+)
+
+// 安全
+const (
+	SecurityTLS   = "tls"
+	SecurityNoise = "noise"
+)
+
+// Options 启动选项
+type Options struct {
+	// ListenAddrs 监听多址, 设置后忽略 Port 且不保存端口
+	ListenAddrs []string `json:"listenAddrs,omitempty"`
+	// Port 监听端口, 0表示使用上次的端口(第一次随机).
+	// tcp 和 quic 使用此端口, ws 和 webtransport 使用此端口+1
+	Port int `json:"port,omitempty"`
+	// Transports 传输: tcp, quic, ws, webtransport. 空表示 tcp 和 quic
+	Transports []string `json:"transports,omitempty"`
+	// Security 安全: tls, noise, 按顺序协商. 空表示全部
+	Security []string `json:"security,omitempty"`
+	// NATPortMap 是否通过UPnP打开端口, 空表示打开
+	NATPortMap *bool `json:"natPortMap,omitempty"`
+	// StaticRelays 静态中继多址, 包含 /p2p/节点标识. 空表示从DHT中查找中继
+	StaticRelays []string `json:"staticRelays,omitempty"`
+	// AutoRelay 是否在没有公网地址时通过中继预留地址, 空表示打开
+	AutoRelay *bool `json:"autoRelay,omitempty"`
+	// HolePunching 是否通过中继连接打洞建立直接连接, 空表示打开
+	HolePunching *bool `json:"holePunching,omitempty"`
+	// RelayService 是否为其他节点提供中继服务
+	RelayService bool `json:"relayService,omitempty"`
+	// RelayLimit 中继服务资源限制, 空表示默认限制
+	RelayLimit *RelayLimit `json:"relayLimit,omitempty"`
+	// TransportMetrics 是否统计tcp和quic传输的指标, 见 prometheus.DefaultGatherer
+	TransportMetrics bool `json:"transportMetrics,omitempty"`
+	// RateLimit 传输速率限制, 空表示不限制, 运行时通过 Node.RateLimitSet 修改
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// PrivateNetwork 是否使用私有网络, 从私有文件夹的 swarm.key 加载预共享密钥, 只能与使用相同密钥的节点连接.
+	// 不连接公共引导, 使用私有的DHT和MDNS. 不支持 quic 和 webtransport, Transports 为空时只使用 tcp
+	PrivateNetwork bool `json:"privateNetwork,omitempty"`
+	// Bootstraps 引导多址, 包含 /p2p/节点标识. 设置后代替公共引导, 私有网络需要设置
+	Bootstraps []string `json:"bootstraps,omitempty"`
+	// Mode 运行模式: 空表示普通节点, relay 表示中继和引导服务器
+	Mode string `json:"mode,omitempty"`
+}
+
+// 解析启动选项JSON, 空表示默认选项
+func parseOptions(optionsText string) (*Options, error) {
+	options := &Options{}
+	if optionsText == "" {
+		return options, nil
+	}
+	e := json.Unmarshal([]byte(optionsText), options)
+	if e != nil {
+		return nil, fmt.Errorf("解析启动选项出错: %w", e)
+	}
+	if options.Mode != ModeNormal && options.Mode != ModeRelay {
+		return nil, fmt.Errorf("不支持的运行模式: %s", options.Mode)
+	}
+	if options.RateLimit != nil {
+		e = options.RateLimit.check()
+		if e != nil {
+			return nil, e
+		}
+	}
+	return options, nil
+}
+
+func (o *Options) transports() []string {
+	if len(o.Transports) == 0 && o.PrivateNetwork {
+		return []string{TransportTCP}
+	}
+	if len(o.Transports) == 0 {
+		return []string{TransportTCP, TransportQUIC}
+	}
+	return o.Transports
+}
+
+func (o *Options) security() []string {
+	if len(o.Security) == 0 {
+		return []string{SecurityTLS, SecurityNoise}
+	}
+	return o.Security
+}
+
+func (o *Options) natPortMap() bool {
+	return o.NATPortMap == nil || *o.NATPortMap
+}
+
+func (o *Options) autoRelay() bool {
+	return o.AutoRelay == nil || *o.AutoRelay
+}
+
+func (o *Options) holePunching() bool {
+	return o.HolePunching == nil || *o.HolePunching
+}
+
+func (o *Options) relayMode() bool {
+	return o.Mode == ModeRelay
+}
+
+// 传输和安全选项
+func (o *Options) libp2pOptions() ([]libp2p.Option, error) {
+	var options []libp2p.Option
+	for _, v := range o.transports() {
+		// 预共享密钥只能用于tcp上的连接
+		if o.PrivateNetwork && (v == TransportQUIC || v == TransportWebTransport) {
+			return nil, fmt.Errorf("私有网络不支持的传输: %s", v)
+		}
+		switch v {
+		case TransportTCP:
+			if o.TransportMetrics {
+				options = append(options, libp2p.Transport(tcp.NewTCPTransport, tcp.WithMetrics()))
+			} else {
+				options = append(options, libp2p.Transport(tcp.NewTCPTransport))
+			}
+		case TransportQUIC:
+			if o.TransportMetrics {
+				options = append(options, libp2p.Transport(libp2p_quic.NewTransport, libp2p_quic.WithMetrics()))
+			} else {
+				options = append(options, libp2p.Transport(libp2p_quic.NewTransport))
+			}
+		case TransportWebSocket:
+			options = append(options, libp2p.Transport(websocket.New))
+		case TransportWebTransport:
+			options = append(options, libp2p.Transport(libp2p_webtransport.New))
+		default:
+			return nil, fmt.Errorf("不支持的传输: %s", v)
+		}
+	}
+	for _, v := range o.security() {
+		switch v {
+		case SecurityTLS:
+			options = append(options, libp2p.Security(libp2p_tls.ID, libp2p_tls.New))
+		case SecurityNoise:
+			options = append(options, libp2p.Security(noise.ID, noise.New))
+		default:
+			return nil, fmt.Errorf("不支持的安全: %s", v)
+		}
+	}
+	if o.natPortMap() {
+		// Attempt to open ports using uPNP for NATed hosts.
+		options = append(options, libp2p.NATPortMap())
+	}
+	return options, nil
+}
+
+// 监听端口, 键为传输
+type listenPorts map[string]int
+
+// 监听多址
+//
+// ports 为空时使用 Port 或随机端口
+func (o *Options) listenAddrs(ports listenPorts) []string {
+	if len(o.ListenAddrs) != 0 {
+		return o.ListenAddrs
+	}
+
+	port := func(transport string, offset int) int {
+		if o.Port != 0 {
+			return o.Port + offset
+		}
+		return ports[transport]
+	}
+	var array []string
+	for _, v := range o.transports() {
+		switch v {
+		case TransportTCP:
+			p := port(v, 0)
+			array = append(array, fmt.Sprint("/ip4/0.0.0.0/tcp/", p), fmt.Sprint("/ip6/::/tcp/", p))
+		case TransportQUIC:
+			p := port(v, 0)
+			array = append(array, fmt.Sprint("/ip4/0.0.0.0/udp/", p, "/quic"), fmt.Sprint("/ip6/::/udp/", p, "/quic"))
+		case TransportWebSocket:
+			p := port(v, 1)
+			array = append(array, fmt.Sprint("/ip4/0.0.0.0/tcp/", p, "/ws"), fmt.Sprint("/ip6/::/tcp/", p, "/ws"))
+		case TransportWebTransport:
+			p := port(v, 1)
+			array = append(array, fmt.Sprint("/ip4/0.0.0.0/udp/", p, "/quic/webtransport"), fmt.Sprint("/ip6/::/udp/", p, "/quic/webtransport"))
+		}
+	}
+	return array
+}
+
+// 是否需要保存端口
+func (o *Options) portSave() bool {
+	return len(o.ListenAddrs) == 0 && o.Port == 0
+}
+
+// 端口文件路径
+func listenPortsPath(privateDir string) string {
+	return filepath.Join(privateDir, "port.json")
+}
+
+// 加载上次的监听端口, 没有时返回空
+func listenPortsLoad(privateDir string) listenPorts {
+	ports := listenPorts{}
+	data, e := os.ReadFile(listenPortsPath(privateDir))
+	if e != nil {
+		return ports
+	}
+	e = json.Unmarshal(data, &ports)
+	if e != nil {
+		log.Println("解析监听端口出错", e)
+	}
+	return ports
+}
+
+// 保存主机实际的监听端口, 优先使用IPv4的端口
+func listenPortsSave(privateDir string, h host.Host) error {
+	ports := listenPorts{}
+	for _, ma := range h.Network().ListenAddresses() {
+		var transport, portText string
+		var e error
+		if _, e = ma.ValueForProtocol(multiaddr.P_WEBTRANSPORT); e == nil {
+			transport = TransportWebTransport
+			portText, e = ma.ValueForProtocol(multiaddr.P_UDP)
+		} else if _, e = ma.ValueForProtocol(multiaddr.P_WS); e == nil {
+			transport = TransportWebSocket
+			portText, e = ma.ValueForProtocol(multiaddr.P_TCP)
+		} else if _, e = ma.ValueForProtocol(multiaddr.P_QUIC); e == nil {
+			transport = TransportQUIC
+			portText, e = ma.ValueForProtocol(multiaddr.P_UDP)
+		} else {
+			transport = TransportTCP
+			portText, e = ma.ValueForProtocol(multiaddr.P_TCP)
+		}
+		if e != nil {
+			continue
+		}
+		port, e := strconv.Atoi(portText)
+		if e != nil {
+			continue
+		}
+		if _, ok := ports[transport]; ok {
+			if _, e := ma.ValueForProtocol(multiaddr.P_IP4); e != nil {
+				continue
+			}
+		}
+		ports[transport] = port
+	}
+
+	data, e := json.Marshal(ports)
+	if e != nil {
+		return e
+	}
+	e = os.WriteFile(listenPortsPath(privateDir), data, 0600)
+	if e != nil {
+		return e
+	}
+	// 文件已经存在时不会修改权限
+	return os.Chmod(listenPortsPath(privateDir), 0600)
+}
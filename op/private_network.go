@@ -0,0 +1,67 @@
+package op
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// 私有网络密钥文件名称, 保存在私有文件夹, 格式同IPFS的swarm.key
+const privateNetworkKeyName = "swarm.key"
+
+// 私有网络, 只能与使用相同预共享密钥的节点连接
+type privateNetwork struct {
+	psk pnet.PSK
+	// 网络标识, 由密钥计算, 用于区分不同的私有网络
+	id string
+}
+
+// 从私有文件夹加载私有网络密钥
+func privateNetworkLoad(privateDir string) (*privateNetwork, error) {
+	keyPath := filepath.Join(privateDir, privateNetworkKeyName)
+	f, e := os.Open(keyPath)
+	if e != nil {
+		return nil, fmt.Errorf("打开私有网络密钥出错, 需要将 %s 放到私有文件夹: %w", privateNetworkKeyName, e)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	psk, e := pnet.DecodeV1PSK(f)
+	if e != nil {
+		return nil, fmt.Errorf("解析私有网络密钥出错: %w", e)
+	}
+
+	sum := sha256.Sum256(psk)
+	p := &privateNetwork{psk: psk, id: hex.EncodeToString(sum[:8])}
+	log.Println("私有网络", p.id)
+	return p, nil
+}
+
+// DHT协议前缀, 不使用公共的 /ipfs
+func (p *privateNetwork) dhtProtocolPrefix() protocol.ID {
+	return protocol.ID("/lilu.red/op/private/" + p.id)
+}
+
+// MDNS服务名称, 不同的私有网络互相不可见
+func (p *privateNetwork) mdnsServiceName() string {
+	return mdnsServiceName + "-" + p.id
+}
+
+// PrivateNetworkKeyGenerate 生成私有网络密钥, 返回swarm.key文件内容
+//
+// 将内容保存为每个节点私有文件夹中的 swarm.key, 并在启动选项中设置 privateNetwork
+func PrivateNetworkKeyGenerate() (string, error) {
+	b := make([]byte, 32)
+	_, e := rand.Read(b)
+	if e != nil {
+		return "", e
+	}
+	return "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(b) + "\n", nil
+}
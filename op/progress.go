@@ -0,0 +1,105 @@
+package op
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 默认进度通知间隔
+const progressIntervalDefault = 500 * time.Millisecond
+
+// 进度通知, 合并间隔内的进度, 同时计算速度和剩余时间
+//
+// 第一次和完成时总是通知
+type progress struct {
+	interval time.Duration
+	total    int64
+	report   func(size, speed, averageSpeed, etaSecond int64)
+
+	startTime time.Time
+	startSize int64
+	// 上次通知
+	lastTime time.Time
+	lastSize int64
+	// 上次通知的速度, 间隔内没有数据时保持
+	speed int64
+	// 最新的大小, 是否已经通知
+	size     int64
+	reported bool
+	// 是否通知过
+	started bool
+}
+
+// 创建进度通知
+//
+// total 总大小, startSize 续传时已经完成的大小, 不计入速度
+func (n *Node) newProgress(total, startSize int64, report func(size, speed, averageSpeed, etaSecond int64)) *progress {
+	now := time.Now()
+	return &progress{
+		interval:  time.Duration(atomic.LoadInt64(&n.progressInterval)),
+		total:     total,
+		report:    report,
+		startTime: now,
+		startSize: startSize,
+		lastTime:  now,
+		lastSize:  startSize,
+		size:      startSize,
+		reported:  true,
+	}
+}
+
+// 更新完成大小, 第一次, 完成时或者超过间隔时通知
+func (p *progress) update(size int64) {
+	p.size = size
+	p.reported = false
+	now := time.Now()
+	if !p.started || size >= p.total || now.Sub(p.lastTime) >= p.interval {
+		p.emit(now)
+	}
+}
+
+// 通知没有通知过的最新进度, 传输结束时调用
+func (p *progress) flush() {
+	if !p.reported {
+		p.emit(time.Now())
+	}
+}
+
+func (p *progress) emit(now time.Time) {
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 && p.size > p.lastSize {
+		p.speed = int64(float64(p.size-p.lastSize) / elapsed)
+	}
+	var averageSpeed int64
+	if elapsed := now.Sub(p.startTime).Seconds(); elapsed > 0 {
+		averageSpeed = int64(float64(p.size-p.startSize) / elapsed)
+	}
+
+	// 剩余时间优先使用当前速度, 未知时为-1
+	var etaSecond int64 = -1
+	remain := p.total - p.size
+	switch {
+	case remain <= 0:
+		etaSecond = 0
+	case p.speed > 0:
+		etaSecond = (remain + p.speed - 1) / p.speed
+	case averageSpeed > 0:
+		etaSecond = (remain + averageSpeed - 1) / averageSpeed
+	}
+
+	p.lastTime = now
+	p.lastSize = p.size
+	p.reported = true
+	p.started = true
+	p.report(p.size, p.speed, averageSpeed, etaSecond)
+}
+
+// 设置进度通知间隔
+func (n *Node) progressIntervalSet(millisecond int64) {
+	log.Println("设置进度通知间隔毫秒数", millisecond)
+	interval := time.Duration(millisecond) * time.Millisecond
+	if interval < 0 {
+		interval = progressIntervalDefault
+	}
+	atomic.StoreInt64(&n.progressInterval, int64(interval))
+}
@@ -0,0 +1,59 @@
+package op
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	n := NewNode(&NodeConfig{})
+	n.ProgressIntervalSet(time.Hour.Milliseconds())
+
+	type event struct{ size, speed, averageSpeed, etaSecond int64 }
+	var events []event
+	p := n.newProgress(100, 20, func(size, speed, averageSpeed, etaSecond int64) {
+		events = append(events, event{size, speed, averageSpeed, etaSecond})
+	})
+
+	// 间隔内合并, 第一次和完成时总是通知
+	for size := int64(30); size <= 100; size += 10 {
+		time.Sleep(time.Millisecond)
+		p.update(size)
+	}
+	p.flush()
+	if len(events) != 2 || events[0].size != 30 || events[1].size != 100 {
+		t.Fatal("通知次数错误", events)
+	}
+	if events[0].speed <= 0 || events[0].averageSpeed <= 0 || events[0].etaSecond < 0 {
+		t.Fatal("没有计算速度和剩余时间", events[0])
+	}
+	if events[1].etaSecond != 0 {
+		t.Fatal("完成时剩余时间不是0", events[1])
+	}
+
+	// 传输中断时通知最新进度
+	events = nil
+	p = n.newProgress(100, 0, func(size, speed, averageSpeed, etaSecond int64) {
+		events = append(events, event{size, speed, averageSpeed, etaSecond})
+	})
+	p.update(10)
+	p.update(50)
+	p.flush()
+	p.flush()
+	if len(events) != 2 || events[1].size != 50 {
+		t.Fatal("中断时通知错误", events)
+	}
+
+	// 0表示每次都通知
+	n.ProgressIntervalSet(0)
+	events = nil
+	p = n.newProgress(100, 0, func(size, speed, averageSpeed, etaSecond int64) {
+		events = append(events, event{size, speed, averageSpeed, etaSecond})
+	})
+	for size := int64(10); size <= 100; size += 10 {
+		p.update(size)
+	}
+	if len(events) != 10 {
+		t.Fatal("通知次数错误", len(events))
+	}
+}
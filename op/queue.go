@@ -0,0 +1,335 @@
+package op
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 队列项目类型
+const (
+	queueKindText = "text"
+	queueKindFile = "file"
+)
+
+// 队列项目状态
+const (
+	// 等待发送
+	queueStateWait = "wait"
+	// 正在发送
+	queueStateSend = "send"
+	// 发送完成, 已经从队列中移除
+	queueStateDone = "done"
+	// 发送失败, 不再重试
+	queueStateFail = "fail"
+	// 已经取消, 已经从队列中移除
+	queueStateCancel = "cancel"
+)
+
+// 重试间隔
+const (
+	queueRetryMin = time.Second * 5
+	queueRetryMax = time.Hour
+)
+
+// 发送队列项目
+type queueItem struct {
+	UUID       string `json:"uuid"`
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Text       string `json:"text,omitempty"`
+	FilePath   string `json:"filePath,omitempty"`
+	State      string `json:"state"`
+	TryCount   int    `json:"tryCount"`
+	NextTime   int64  `json:"nextTime"` // 下次重试时间, 毫秒时间戳
+	Error      string `json:"error,omitempty"`
+	CreateTime int64  `json:"createTime"`
+}
+
+// 队列文件路径
+func (n *Node) queuePath() string {
+	return filepath.Join(n.config.PrivateDir, "queue.json")
+}
+
+// 加载队列, 上次正在发送的项目重新等待发送
+func (n *Node) queueLoad() error {
+	n.queueMutex.Lock()
+	defer n.queueMutex.Unlock()
+
+	n.queueItems = nil
+	data, e := os.ReadFile(n.queuePath())
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	e = json.Unmarshal(data, &n.queueItems)
+	if e != nil {
+		return e
+	}
+	for _, item := range n.queueItems {
+		if item.State == queueStateSend {
+			item.State = queueStateWait
+		}
+	}
+	log.Println("加载发送队列", len(n.queueItems))
+	return nil
+}
+
+// 保存队列, 先写临时文件再替换, 防止写入中断损坏
+//
+// 注意: 调用前需要锁定
+func (n *Node) queueSave() {
+	data, e := json.Marshal(n.queueItems)
+	if e != nil {
+		log.Println("发送队列转换JSON出错", e)
+		return
+	}
+	tempPath := n.queuePath() + ".tmp"
+	e = os.WriteFile(tempPath, data, 0600)
+	if e != nil {
+		log.Println("保存发送队列出错", e)
+		return
+	}
+	e = os.Rename(tempPath, n.queuePath())
+	if e != nil {
+		log.Println("保存发送队列出错", e)
+	}
+}
+
+// 通知队列项目变化
+func (n *Node) queueNotify(item queueItem) {
+	jsonBytes, e := json.Marshal(item)
+	if e != nil {
+		log.Println("队列项目转换JSON出错", e)
+		return
+	}
+	n.callback().OnOpQueueChanged(string(jsonBytes))
+}
+
+// 添加队列项目并立即尝试发送
+func (n *Node) queueAdd(item *queueItem) error {
+	if _, _, e := n.started(); e != nil {
+		return e
+	}
+	if !IdOk(item.ID) {
+		return errors.New("节点标识无效")
+	}
+
+	item.State = queueStateWait
+	item.CreateTime = time.Now().UnixMilli()
+	n.queueMutex.Lock()
+	for _, v := range n.queueItems {
+		if v.UUID == item.UUID {
+			n.queueMutex.Unlock()
+			return errors.New("唯一标识已经存在")
+		}
+	}
+	n.queueItems = append(n.queueItems, item)
+	n.queueSave()
+	n.queueMutex.Unlock()
+	n.queueNotify(*item)
+
+	r := historyRecord{UUID: item.UUID, ID: item.ID, Direction: historyDirectionSend, Kind: item.Kind, State: historyStateWait}
+	if item.Kind == queueKindText {
+		r.Text = item.Text
+	} else {
+		r.FileName = filepath.Base(item.FilePath)
+		r.FilePath = item.FilePath
+	}
+	n.historyWrite(r)
+
+	n.queueTry(item.ID)
+	return nil
+}
+
+// 移除队列项目, 不存在时返回nil
+func (n *Node) queueRemove(uuid string) *queueItem {
+	n.queueMutex.Lock()
+	defer n.queueMutex.Unlock()
+	for i, item := range n.queueItems {
+		if item.UUID == uuid {
+			n.queueItems = append(n.queueItems[:i], n.queueItems[i+1:]...)
+			n.queueSave()
+			return item
+		}
+	}
+	return nil
+}
+
+// 取消等待中的队列项目, 不存在时返回false
+func (n *Node) queueCancel(uuid string) bool {
+	item := n.queueRemove(uuid)
+	if item == nil {
+		return false
+	}
+	// 正在发送时由发送任务告知取消
+	if item.State == queueStateSend {
+		return true
+	}
+	item.State = queueStateCancel
+	n.queueNotify(*item)
+	n.historySendState(item.ID, item.UUID, historyStateCancel, nil)
+	if item.Kind == queueKindText {
+		n.callback().OnOpTextSendCancel(item.UUID)
+	} else {
+		n.callback().OnOpFileSendCancel(item.UUID)
+	}
+	return true
+}
+
+// 队列中已经到期等待发送的节点标识
+func (n *Node) queueDueIdArray() []string {
+	now := time.Now().UnixMilli()
+	n.queueMutex.Lock()
+	defer n.queueMutex.Unlock()
+	var array []string
+	exists := make(map[string]bool)
+	for _, item := range n.queueItems {
+		if item.State == queueStateWait && item.NextTime <= now && !exists[item.ID] {
+			exists[item.ID] = true
+			array = append(array, item.ID)
+		}
+	}
+	return array
+}
+
+// 尝试发送节点的到期项目, 节点可以连接时调用
+//
+// 在队列锁中创建发送任务, 取消时如果项目正在发送一定能找到发送任务
+func (n *Node) queueTry(id string) {
+	now := time.Now().UnixMilli()
+	var dueItems []queueItem
+	var dueTasks []*sendTask
+	n.queueMutex.Lock()
+	for _, item := range n.queueItems {
+		if item.ID == id && item.State == queueStateWait && item.NextTime <= now {
+			t, e := n.sendTaskAdd(item.UUID)
+			if e != nil {
+				log.Println("创建队列发送任务出错", item.UUID, e)
+				continue
+			}
+			item.State = queueStateSend
+			dueItems = append(dueItems, *item)
+			dueTasks = append(dueTasks, t)
+		}
+	}
+	n.queueMutex.Unlock()
+
+	for i, item := range dueItems {
+		n.queueNotify(item)
+		go n.queueSend(item, dueTasks[i])
+	}
+}
+
+// 发送队列项目
+func (n *Node) queueSend(item queueItem, t *sendTask) {
+	defer n.sendTaskRemove(item.UUID)
+	n.historySendState(item.ID, item.UUID, historyStateSend, nil)
+
+	var fileHash string
+	var e error
+	switch item.Kind {
+	case queueKindText:
+		e = n.textSendOnce(t, item.UUID, item.ID, item.Text)
+	case queueKindFile:
+		fileHash, e = n.fileSendTry(t, item.UUID, item.ID, item.FilePath)
+	}
+	metricsSend(item.Kind, e, t.isCanceled())
+
+	// 取消时已经从队列中移除
+	if t.isCanceled() {
+		item.State = queueStateCancel
+		n.queueNotify(item)
+		n.historySendState(item.ID, item.UUID, historyStateCancel, nil)
+		if item.Kind == queueKindText {
+			n.callback().OnOpTextSendCancel(item.UUID)
+		} else {
+			n.callback().OnOpFileSendCancel(item.UUID)
+		}
+		return
+	}
+	n.queueSendResult(item, fileHash, e)
+}
+
+// 处理队列项目的发送结果, 出错时等待重试或者标记失败
+func (n *Node) queueSendResult(item queueItem, fileHash string, e error) {
+	if e == nil {
+		n.queueRemove(item.UUID)
+		item.State = queueStateDone
+		item.Error = ""
+		n.queueNotify(item)
+		n.historyWrite(historyRecord{UUID: item.UUID, ID: item.ID, Direction: historyDirectionSend, FileHash: fileHash, State: historyStateDone})
+		if item.Kind == queueKindText {
+			n.callback().OnOpTextSendDone(item.UUID)
+		} else {
+			n.callback().OnOpFileSendDone(item.UUID, fileHash)
+		}
+		return
+	}
+
+	// 对方拒绝或者文件不存在时不再重试, 其他错误等待重试
+	item.TryCount++
+	item.Error = e.Error()
+	var ce *codeError
+	if (errors.As(e, &ce) && ce.code == ErrorCodeReject) || errors.Is(e, os.ErrNotExist) {
+		item.State = queueStateFail
+	} else {
+		item.State = queueStateWait
+		retry := queueRetryMin << (item.TryCount - 1)
+		if retry > queueRetryMax || retry <= 0 {
+			retry = queueRetryMax
+		}
+		item.NextTime = time.Now().Add(retry).UnixMilli()
+	}
+	log.Println("发送队列项目出错", item.UUID, item.State, e)
+
+	// 发送期间可能已经被取消移除
+	n.queueMutex.Lock()
+	exists := false
+	for i, v := range n.queueItems {
+		if v.UUID == item.UUID {
+			n.queueItems[i] = &item
+			n.queueSave()
+			exists = true
+			break
+		}
+	}
+	n.queueMutex.Unlock()
+	if !exists {
+		return
+	}
+	n.queueNotify(item)
+	if item.State == queueStateFail {
+		n.historySendState(item.ID, item.UUID, historyStateError, e)
+	} else {
+		n.historySendState(item.ID, item.UUID, historyStateWait, e)
+	}
+
+	if item.State == queueStateFail {
+		if item.Kind == queueKindText {
+			n.callback().OnOpTextSendError(item.UUID, item.Error)
+		} else {
+			n.callback().OnOpFileSendError(item.UUID, item.Error)
+		}
+	}
+}
+
+// 队列列表JSON
+func (n *Node) queueList() (string, error) {
+	n.queueMutex.Lock()
+	defer n.queueMutex.Unlock()
+	items := n.queueItems
+	if items == nil {
+		items = []*queueItem{}
+	}
+	jsonBytes, e := json.Marshal(items)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
@@ -0,0 +1,303 @@
+package op
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RateLimit 传输速率限制, 单位字节每秒, 0表示不限制
+//
+// 只限制文件和文件夹数据, 文本和控制消息不受限制且优先传输
+type RateLimit struct {
+	// Upload 总上传速率
+	Upload int64 `json:"upload"`
+	// Download 总下载速率
+	Download int64 `json:"download"`
+	// PeerUpload 每个节点的上传速率
+	PeerUpload int64 `json:"peerUpload"`
+	// PeerDownload 每个节点的下载速率
+	PeerDownload int64 `json:"peerDownload"`
+}
+
+func (l RateLimit) check() error {
+	if l.Upload < 0 || l.Download < 0 || l.PeerUpload < 0 || l.PeerDownload < 0 {
+		return errors.New("速率限制不能小于0")
+	}
+	return nil
+}
+
+const (
+	// 限速时每次读写的最大字节数, 使数据平稳并让优先消息及时插入
+	rateChunkMax = 64 * 1024
+	rateChunkMin = 4 * 1024
+	// 有优先消息时数据最多等待时长, 防止持续发送文本时数据一直不能传输
+	ratePriorityWait = time.Second
+	// 优先消息读写期限, 防止对方不读写时文件数据一直让出
+	ratePriorityTimeout = 10 * time.Second
+)
+
+// 令牌桶, 允许透支, 透支后等待恢复
+type rateBucket struct {
+	rate   float64
+	tokens float64
+	time   time.Time
+}
+
+func newRateBucket(rate int64) *rateBucket {
+	return &rateBucket{rate: float64(rate), tokens: float64(rate), time: time.Now()}
+}
+
+// 消耗字节数, 返回需要等待的时长
+func (b *rateBucket) take(size int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.time).Seconds() * b.rate
+	// 最多积累1秒
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.time = now
+	b.tokens -= float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 速率限制和优先级
+type rateLimiter struct {
+	mutex        sync.Mutex
+	limit        RateLimit
+	upload       *rateBucket
+	download     *rateBucket
+	peerUpload   map[peer.ID]*rateBucket
+	peerDownload map[peer.ID]*rateBucket
+
+	// 正在传输的优先消息数量
+	priority int32
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{}
+	l.set(RateLimit{})
+	return l
+}
+
+// 设置限制, 重置所有令牌桶
+func (l *rateLimiter) set(limit RateLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+	l.upload, l.download = nil, nil
+	if limit.Upload > 0 {
+		l.upload = newRateBucket(limit.Upload)
+	}
+	if limit.Download > 0 {
+		l.download = newRateBucket(limit.Download)
+	}
+	l.peerUpload = make(map[peer.ID]*rateBucket)
+	l.peerDownload = make(map[peer.ID]*rateBucket)
+}
+
+func (l *rateLimiter) get() RateLimit {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// 每次读写的字节数, 速率越低越小
+func (l *rateLimiter) chunk(upload bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rate := l.limit.Download
+	peerRate := l.limit.PeerDownload
+	if upload {
+		rate = l.limit.Upload
+		peerRate = l.limit.PeerUpload
+	}
+	if rate == 0 || (peerRate != 0 && peerRate < rate) {
+		rate = peerRate
+	}
+	if rate == 0 {
+		return rateChunkMax
+	}
+	size := int(rate / 8)
+	if size > rateChunkMax {
+		return rateChunkMax
+	}
+	if size < rateChunkMin {
+		return rateChunkMin
+	}
+	return size
+}
+
+// 消耗字节数, 返回需要等待的时长
+func (l *rateLimiter) take(upload bool, peerID peer.ID, size int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, peerMap, peerRate := l.download, l.peerDownload, l.limit.PeerDownload
+	if upload {
+		bucket, peerMap, peerRate = l.upload, l.peerUpload, l.limit.PeerUpload
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	if bucket != nil {
+		wait = bucket.take(size, now)
+	}
+	if peerRate > 0 {
+		b, ok := peerMap[peerID]
+		if !ok {
+			// 清理已经恢复满的节点
+			if len(peerMap) > 256 {
+				for k, v := range peerMap {
+					if now.Sub(v.time) > time.Second {
+						delete(peerMap, k)
+					}
+				}
+			}
+			b = newRateBucket(peerRate)
+			peerMap[peerID] = b
+		}
+		if w := b.take(size, now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// 传输数据前等待: 有优先消息时让出, 超出速率时等待恢复
+func (l *rateLimiter) wait(ctx context.Context, upload bool, peerID peer.ID, size int) error {
+	for start := time.Now(); atomic.LoadInt32(&l.priority) > 0 && time.Since(start) < ratePriorityWait; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	wait := l.take(upload, peerID, size)
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 开始传输优先消息, 返回结束函数
+func (l *rateLimiter) priorityBegin() func() {
+	atomic.AddInt32(&l.priority, 1)
+	return func() {
+		atomic.AddInt32(&l.priority, -1)
+	}
+}
+
+// 在已经打开的流上写入优先消息, 写入期间文件数据让出
+func (l *rateLimiter) priorityWrite(s network.Stream, write func() error) error {
+	_ = s.SetWriteDeadline(time.Now().Add(ratePriorityTimeout))
+	defer l.priorityBegin()()
+	return write()
+}
+
+// 在已经打开的流上读取优先消息
+//
+// 等待对方开始写入时不让出, 最多等待 timeout. 开始读取后文件数据让出, 读取期限为 ratePriorityTimeout
+func (l *rateLimiter) priorityRead(s network.Stream, r *bufio.Reader, timeout time.Duration, read func() error) error {
+	_ = s.SetReadDeadline(time.Now().Add(timeout))
+	_, e := r.Peek(1)
+	if e != nil {
+		return e
+	}
+	_ = s.SetReadDeadline(time.Now().Add(ratePriorityTimeout))
+	defer l.priorityBegin()()
+	return read()
+}
+
+// 限速写入
+type rateWriter struct {
+	ctx    context.Context
+	l      *rateLimiter
+	peerID peer.ID
+	w      io.Writer
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	var sum int
+	for len(p) > 0 {
+		size := w.l.chunk(true)
+		if size > len(p) {
+			size = len(p)
+		}
+		e := w.l.wait(w.ctx, true, w.peerID, size)
+		if e != nil {
+			return sum, e
+		}
+		wn, e := w.w.Write(p[:size])
+		sum += wn
+		if e != nil {
+			return sum, e
+		}
+		p = p[size:]
+	}
+	return sum, nil
+}
+
+// 限速读取
+type rateReader struct {
+	ctx    context.Context
+	l      *rateLimiter
+	peerID peer.ID
+	r      io.Reader
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if size := r.l.chunk(false); len(p) > size {
+		p = p[:size]
+	}
+	rn, e := r.r.Read(p)
+	if rn > 0 {
+		// 按实际读取的字节数等待
+		if we := r.l.wait(r.ctx, false, r.peerID, rn); we != nil && e == nil {
+			e = we
+		}
+	}
+	return rn, e
+}
+
+// 发送文件数据的写入
+func (n *Node) rateWriter(ctx context.Context, peerID peer.ID, w io.Writer) io.Writer {
+	return &rateWriter{ctx: ctx, l: n.rateLimiter, peerID: peerID, w: w}
+}
+
+// 接收文件数据的读取
+func (n *Node) rateReader(ctx context.Context, peerID peer.ID, r io.Reader) io.Reader {
+	return &rateReader{ctx: ctx, l: n.rateLimiter, peerID: peerID, r: r}
+}
+
+// 设置速率限制
+func (n *Node) rateLimitSet(jt string) error {
+	var limit RateLimit
+	e := json.Unmarshal([]byte(jt), &limit)
+	if e != nil {
+		return e
+	}
+	e = limit.check()
+	if e != nil {
+		return e
+	}
+	n.rateLimiter.set(limit)
+	return nil
+}
@@ -0,0 +1,169 @@
+package op
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 回执类型
+const (
+	// 已经送达, 接收方的应用已经处理
+	receiptDelivered uint64 = iota + 1
+	// 已读, 接收方的应用调用了 TextMarkRead
+	receiptRead
+)
+
+// 回执消息
+//
+//	message Receipt {
+//	  string uuid = 1;
+//	  uint32 kind = 2;
+//	}
+type frameReceipt struct {
+	uuid string
+	kind uint64
+}
+
+func (r *frameReceipt) marshal() []byte {
+	var b []byte
+	b = appendStringField(b, 1, r.uuid)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, r.kind)
+	return b
+}
+
+func (r *frameReceipt) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, s string) {
+		switch num {
+		case 1:
+			r.uuid = s
+		case 2:
+			r.kind = v
+		}
+	})
+}
+
+// 发送回执
+func (n *Node) receiptSend(id, uuid string, kind uint64) error {
+	ctx, h, e := n.started()
+	if e != nil {
+		return e
+	}
+	s, e := createStream(network.WithUseTransient(ctx, "receipt"), h, id, time.Minute, protocolReceipt)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	r := frameReceipt{uuid: uuid, kind: kind}
+	e = n.rateLimiter.priorityWrite(s, func() error {
+		return writeFrame(rw.Writer, r.marshal())
+	})
+	if e != nil {
+		return e
+	}
+
+	// 接收结果
+	var data []byte
+	e = n.rateLimiter.priorityRead(s, rw.Reader, time.Minute, func() (e error) {
+		data, e = readFrame(rw.Reader)
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	var st frameStatus
+	e = st.unmarshal(data)
+	if e != nil {
+		return e
+	}
+	return st.err()
+}
+
+// 回执处理
+func (n *Node) receiptStreamHandler(s network.Stream) {
+	remotePeerID := s.Conn().RemotePeer()
+	defer func() {
+		_ = s.Close()
+	}()
+	if !n.trustStreamOk(s) {
+		return
+	}
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	data, e := readFrame(rw.Reader)
+	if e != nil {
+		log.Println("回执处理, 读取回执出错:", e)
+		return
+	}
+	var r frameReceipt
+	e = r.unmarshal(data)
+	if e == nil {
+		e = n.receiptHandle(remotePeerID.Pretty(), r)
+	}
+	if e != nil {
+		log.Println("回执处理出错:", remotePeerID, r.uuid, e)
+	}
+
+	st := statusFromError(e)
+	e = writeFrame(rw.Writer, st.marshal())
+	if e != nil {
+		log.Println("回执处理, 回复对方时出错:", e)
+	}
+}
+
+// 处理回执, 只接受发给对方的文本的回执
+func (n *Node) receiptHandle(id string, r frameReceipt) error {
+	record, e := n.historyFind(id, historyDirectionSend, r.uuid)
+	if e != nil {
+		return e
+	}
+	if record == nil || record.Kind != historyKindText {
+		return errors.New("没有找到文本")
+	}
+
+	now := time.Now().UnixMilli()
+	switch r.kind {
+	case receiptDelivered:
+		log.Println("回执处理, 文本已经送达:", r.uuid)
+		n.historyWrite(historyRecord{UUID: r.uuid, ID: id, Direction: historyDirectionSend, DeliverTime: now})
+		n.callback().OnOpTextDelivered(r.uuid)
+	case receiptRead:
+		log.Println("回执处理, 文本已读:", r.uuid)
+		n.historyWrite(historyRecord{UUID: r.uuid, ID: id, Direction: historyDirectionSend, ReadTime: now})
+		n.callback().OnOpTextRead(r.uuid)
+	default:
+		return errors.New("未知回执类型")
+	}
+	return nil
+}
+
+// 标记文本已读并告知对方
+func (n *Node) textMarkRead(id, uuid string) error {
+	if _, _, e := n.started(); e != nil {
+		return e
+	}
+	if !IdOk(id) {
+		return errors.New("节点标识无效")
+	}
+	record, e := n.historyFind(id, historyDirectionReceive, uuid)
+	if e != nil {
+		return e
+	}
+	if record == nil || record.Kind != historyKindText {
+		return errors.New("没有找到文本")
+	}
+
+	n.historyWrite(historyRecord{UUID: uuid, ID: id, Direction: historyDirectionReceive, ReadTime: time.Now().UnixMilli()})
+	return n.receiptSend(id, uuid, receiptRead)
+}
@@ -0,0 +1,148 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// 连接信息
+type connInfo struct {
+	Addr string `json:"addr"`
+	// 是否通过中继连接
+	Relay bool `json:"relay"`
+	// 方向: inbound 对方发起, outbound 我方发起
+	Direction string `json:"direction"`
+	// 建立时间, 毫秒时间戳
+	Opened int64 `json:"opened"`
+}
+
+// 是否为中继连接
+func connIsRelay(c network.Conn) bool {
+	_, e := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT)
+	return e == nil
+}
+
+// 解析静态中继多址
+func parseRelayAddrs(array []string) ([]peer.AddrInfo, error) {
+	var addrInfoArray []peer.AddrInfo
+	for _, v := range array {
+		addrInfo, e := peer.AddrInfoFromString(v)
+		if e != nil {
+			return nil, fmt.Errorf("中继多址错误: %s %w", v, e)
+		}
+		addrInfoArray = append(addrInfoArray, *addrInfo)
+	}
+	return addrInfoArray, nil
+}
+
+// 中继相关选项
+//
+// 设置了静态中继时只使用静态中继, 否则从DHT路由表中查找支持中继的节点
+//
+// 中继和引导服务器只提供中继服务, 见 Node.relayModeOptions
+func (n *Node) relayOptions(options *Options) ([]libp2p.Option, error) {
+	if options.relayMode() {
+		return n.relayModeOptions(options), nil
+	}
+
+	var optionArray []libp2p.Option
+	if options.autoRelay() {
+		relays, e := parseRelayAddrs(options.StaticRelays)
+		if e != nil {
+			return nil, e
+		}
+		if len(relays) != 0 {
+			optionArray = append(optionArray, libp2p.EnableAutoRelay(autorelay.WithStaticRelays(relays)))
+		} else {
+			optionArray = append(optionArray, libp2p.EnableAutoRelay(autorelay.WithPeerSource(n.relayPeerSource, time.Minute)))
+		}
+	}
+	if options.holePunching() {
+		optionArray = append(optionArray, libp2p.EnableHolePunching())
+	}
+	if options.RelayService {
+		optionArray = append(optionArray, n.relayServiceOptions(options)...)
+	}
+	return optionArray, nil
+}
+
+// 中继候选节点, AutoRelay会检查是否支持中继
+func (n *Node) relayPeerSource(ctx context.Context, numPeers int) <-chan peer.AddrInfo {
+	peerChan := make(chan peer.AddrInfo, numPeers)
+	defer close(peerChan)
+	n.mutex.Lock()
+	dht := n.dht
+	n.mutex.Unlock()
+	if dht == nil {
+		return peerChan
+	}
+	for _, id := range dht.RoutingTable().ListPeers() {
+		if len(peerChan) == numPeers {
+			break
+		}
+		addrs := dht.Host().Peerstore().Addrs(id)
+		if len(addrs) == 0 {
+			continue
+		}
+		peerChan <- peer.AddrInfo{ID: id, Addrs: addrs}
+	}
+	return peerChan
+}
+
+// 通过静态中继连接节点的地址
+func (n *Node) relayAddrs(id peer.ID) []multiaddr.Multiaddr {
+	var array []multiaddr.Multiaddr
+	n.mutex.Lock()
+	relays := n.relays
+	n.mutex.Unlock()
+	for _, relay := range relays {
+		if relay.ID == id {
+			continue
+		}
+		circuit, e := multiaddr.NewMultiaddr(fmt.Sprint("/p2p/", relay.ID.Pretty(), "/p2p-circuit"))
+		if e != nil {
+			continue
+		}
+		for _, addr := range relay.Addrs {
+			array = append(array, addr.Encapsulate(circuit))
+		}
+	}
+	return array
+}
+
+// 节点连接信息JSON数组
+func (n *Node) connList(id string) (string, error) {
+	_, h, e := n.started()
+	if e != nil {
+		return "", e
+	}
+	peerID, e := peer.Decode(id)
+	if e != nil {
+		return "", e
+	}
+
+	array := []connInfo{}
+	for _, c := range h.Network().ConnsToPeer(peerID) {
+		stat := c.Stat()
+		array = append(array, connInfo{
+			Addr:      c.RemoteMultiaddr().String(),
+			Relay:     connIsRelay(c),
+			Direction: strings.ToLower(stat.Direction.String()),
+			Opened:    stat.Opened.UnixMilli(),
+		})
+	}
+	jsonBytes, e := json.Marshal(array)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
@@ -0,0 +1,179 @@
+package op
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// 运行模式
+const (
+	// ModeNormal 普通节点
+	ModeNormal = ""
+	// ModeRelay 中继和引导服务器, 不使用MDNS和传输, DHT使用服务器模式
+	ModeRelay = "relay"
+)
+
+// RelayLimit 中继资源限制, 0表示使用默认值
+type RelayLimit struct {
+	// MaxReservations 最多预留数量, 默认128
+	MaxReservations int `json:"maxReservations,omitempty"`
+	// MaxCircuits 每个节点最多中继连接数量, 默认16
+	MaxCircuits int `json:"maxCircuits,omitempty"`
+	// MaxReservationsPerPeer 每个节点最多预留数量, 默认4
+	MaxReservationsPerPeer int `json:"maxReservationsPerPeer,omitempty"`
+	// MaxReservationsPerIP 每个IP最多预留数量, 默认8
+	MaxReservationsPerIP int `json:"maxReservationsPerIP,omitempty"`
+	// DurationSecond 每个中继连接最长秒数, 默认120
+	DurationSecond int64 `json:"durationSecond,omitempty"`
+	// DataSize 每个中继连接每个方向最多字节数, 默认128K
+	DataSize int64 `json:"dataSize,omitempty"`
+}
+
+// 中继服务资源
+func (l *RelayLimit) resources() relay.Resources {
+	rc := relay.DefaultResources()
+	if l == nil {
+		return rc
+	}
+	if l.MaxReservations > 0 {
+		rc.MaxReservations = l.MaxReservations
+	}
+	if l.MaxCircuits > 0 {
+		rc.MaxCircuits = l.MaxCircuits
+	}
+	if l.MaxReservationsPerPeer > 0 {
+		rc.MaxReservationsPerPeer = l.MaxReservationsPerPeer
+	}
+	if l.MaxReservationsPerIP > 0 {
+		rc.MaxReservationsPerIP = l.MaxReservationsPerIP
+	}
+	if l.DurationSecond > 0 {
+		rc.Limit.Duration = time.Duration(l.DurationSecond) * time.Second
+	}
+	if l.DataSize > 0 {
+		rc.Limit.Data = l.DataSize
+	}
+	return rc
+}
+
+// 中继服务统计, 同时作为中继服务的访问控制(全部允许)
+type relayCounter struct {
+	reserveCount int64
+	connectCount int64
+}
+
+func (c *relayCounter) AllowReserve(p peer.ID, a multiaddr.Multiaddr) bool {
+	atomic.AddInt64(&c.reserveCount, 1)
+	return true
+}
+
+func (c *relayCounter) AllowConnect(src peer.ID, srcAddr multiaddr.Multiaddr, dest peer.ID) bool {
+	atomic.AddInt64(&c.connectCount, 1)
+	return true
+}
+
+// 中继服务状态
+type relayStats struct {
+	// 收到的预留请求次数
+	ReserveCount int64 `json:"reserveCount"`
+	// 收到的中继连接请求次数
+	ConnectCount int64 `json:"connectCount"`
+	// 当前中继连接数量
+	CircuitCount int `json:"circuitCount"`
+	// 已经中继的字节数
+	DataSize int64 `json:"dataSize"`
+	// 中继速率, 字节每秒
+	DataRate float64 `json:"dataRate"`
+	// 节点数量
+	NodeCount int `json:"nodeCount"`
+	// 连接数量
+	ConnCount int `json:"connCount"`
+	// 公网多址, 每个可以作为一条引导TXT记录, 见 dns.Txt
+	TxtArray []string `json:"txtArray"`
+}
+
+// 中继服务选项
+func (n *Node) relayServiceOptions(options *Options) []libp2p.Option {
+	counter := &relayCounter{}
+	n.mutex.Lock()
+	n.relayCounter = counter
+	n.mutex.Unlock()
+	return []libp2p.Option{
+		libp2p.EnableRelayService(relay.WithResources(options.RelayLimit.resources()), relay.WithACL(counter)),
+	}
+}
+
+// 中继和引导服务器选项
+//
+// 服务器有公网地址, 不需要AutoRelay和打洞
+func (n *Node) relayModeOptions(options *Options) []libp2p.Option {
+	return append(n.relayServiceOptions(options), libp2p.ForceReachabilityPublic())
+}
+
+// 公网多址, 包含 /p2p/节点标识
+func relayTxtArray(h host.Host) []string {
+	array := []string{}
+	for _, ma := range h.Addrs() {
+		if !manet.IsPublicAddr(ma) {
+			continue
+		}
+		array = append(array, fmt.Sprint(ma, "/p2p/", h.ID().Pretty()))
+	}
+	return array
+}
+
+// 中继服务状态JSON
+func (n *Node) relayStats() (string, error) {
+	_, h, e := n.started()
+	if e != nil {
+		return "", e
+	}
+	n.mutex.Lock()
+	counter, bandwidthCounter := n.relayCounter, n.bandwidthCounter
+	n.mutex.Unlock()
+	if counter == nil {
+		return "", errors.New("没有开启中继服务")
+	}
+
+	stats := relayStats{
+		ReserveCount: atomic.LoadInt64(&counter.reserveCount),
+		ConnectCount: atomic.LoadInt64(&counter.connectCount),
+		NodeCount:    h.Peerstore().Peers().Len(),
+		TxtArray:     relayTxtArray(h),
+	}
+	conns := h.Network().Conns()
+	stats.ConnCount = len(conns)
+	// 每个中继连接对应一个中继发起的stop流
+	for _, c := range conns {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == proto.ProtoIDv2Stop && s.Stat().Direction == network.DirOutbound {
+				stats.CircuitCount++
+			}
+		}
+	}
+	// 中继的数据从hop流和stop流读入
+	for _, p := range []protocol.ID{proto.ProtoIDv2Hop, proto.ProtoIDv2Stop} {
+		bw := bandwidthCounter.GetBandwidthForProtocol(p)
+		stats.DataSize += bw.TotalIn
+		stats.DataRate += bw.RateIn
+	}
+
+	jsonBytes, e := json.Marshal(stats)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
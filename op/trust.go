@@ -0,0 +1,306 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// 信任模式
+const (
+	// TrustModeOpen 接收所有节点(默认)
+	TrustModeOpen = "open"
+	// TrustModeBlock 拒绝黑名单中的节点
+	TrustModeBlock = "block"
+	// TrustModeAllow 只接收白名单中的节点的文本和文件, 同时拒绝黑名单中的节点
+	TrustModeAllow = "allow"
+)
+
+// 拒绝连接时 Callback.OnOpPeerReject 的协议
+const trustRejectConn = "conn"
+
+// 同一节点的同一协议被拒绝时最多每分钟通知一次, 防止对方刷屏
+const trustReportInterval = time.Minute
+
+type trustReportKey struct {
+	peerID   peer.ID
+	protocol string
+}
+
+// 信任列表, 保存在私有文件夹
+type trustList struct {
+	Mode       string   `json:"mode"`
+	AllowArray []string `json:"allowArray"`
+	BlockArray []string `json:"blockArray"`
+}
+
+// 信任状态
+type trustState struct {
+	mode     string
+	allowMap map[peer.ID]bool
+	blockMap map[peer.ID]bool
+}
+
+func (t *trustState) list() trustList {
+	l := trustList{Mode: t.mode, AllowArray: []string{}, BlockArray: []string{}}
+	for id := range t.allowMap {
+		l.AllowArray = append(l.AllowArray, id.Pretty())
+	}
+	for id := range t.blockMap {
+		l.BlockArray = append(l.BlockArray, id.Pretty())
+	}
+	sort.Strings(l.AllowArray)
+	sort.Strings(l.BlockArray)
+	return l
+}
+
+// 是否拒绝连接, 开放模式不拒绝
+func (t *trustState) blocked(peerID peer.ID) bool {
+	return t.mode != TrustModeOpen && t.blockMap[peerID]
+}
+
+// 是否接收文本和文件
+func (t *trustState) accepted(peerID peer.ID) bool {
+	if t.blocked(peerID) {
+		return false
+	}
+	return t.mode != TrustModeAllow || t.allowMap[peerID]
+}
+
+func (n *Node) trustPath() string {
+	return filepath.Join(n.config.PrivateDir, "trust.json")
+}
+
+// 加载信任列表, 没有时使用开放模式
+func (n *Node) trustLoad() error {
+	n.trustMutex.Lock()
+	defer n.trustMutex.Unlock()
+
+	n.trust = &trustState{mode: TrustModeOpen, allowMap: make(map[peer.ID]bool), blockMap: make(map[peer.ID]bool)}
+	n.trustReportMap = make(map[trustReportKey]time.Time)
+	data, e := os.ReadFile(n.trustPath())
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	var l trustList
+	e = json.Unmarshal(data, &l)
+	if e != nil {
+		return e
+	}
+	if trustModeOk(l.Mode) {
+		n.trust.mode = l.Mode
+	}
+	for _, id := range l.AllowArray {
+		if peerID, e := peer.Decode(id); e == nil {
+			n.trust.allowMap[peerID] = true
+		}
+	}
+	for _, id := range l.BlockArray {
+		if peerID, e := peer.Decode(id); e == nil {
+			n.trust.blockMap[peerID] = true
+		}
+	}
+	log.Println("信任模式", n.trust.mode, "白名单", len(n.trust.allowMap), "黑名单", len(n.trust.blockMap))
+	return nil
+}
+
+// 保存信任列表, 需要在锁中调用
+func (n *Node) trustSave() error {
+	data, e := json.Marshal(n.trust.list())
+	if e != nil {
+		return e
+	}
+	tempPath := n.trustPath() + ".tmp"
+	e = os.WriteFile(tempPath, data, 0600)
+	if e != nil {
+		return e
+	}
+	return os.Rename(tempPath, n.trustPath())
+}
+
+func trustModeOk(mode string) bool {
+	return mode == TrustModeOpen || mode == TrustModeBlock || mode == TrustModeAllow
+}
+
+// 修改信任状态并保存, 之后断开不再信任的节点
+func (n *Node) trustUpdate(update func(t *trustState)) error {
+	_, h, e := n.started()
+	if e != nil {
+		return e
+	}
+	n.trustMutex.Lock()
+	update(n.trust)
+	e = n.trustSave()
+	var blockArray []peer.ID
+	for peerID := range n.trust.blockMap {
+		if n.trust.blocked(peerID) {
+			blockArray = append(blockArray, peerID)
+		}
+	}
+	n.trustMutex.Unlock()
+	if e != nil {
+		return fmt.Errorf("保存信任列表出错: %w", e)
+	}
+
+	for _, peerID := range blockArray {
+		if connectCount(h, peerID) > 0 {
+			log.Println("断开黑名单中的节点", peerID)
+			_ = h.Network().ClosePeer(peerID)
+		}
+	}
+	return nil
+}
+
+// 加入白名单, 同时移出黑名单
+func (n *Node) peerAllow(id string) error {
+	peerID, e := peer.Decode(id)
+	if e != nil {
+		return e
+	}
+	log.Println("加入白名单", id)
+	return n.trustUpdate(func(t *trustState) {
+		t.allowMap[peerID] = true
+		delete(t.blockMap, peerID)
+	})
+}
+
+// 加入黑名单, 同时移出白名单
+func (n *Node) peerBlock(id string) error {
+	peerID, e := peer.Decode(id)
+	if e != nil {
+		return e
+	}
+	log.Println("加入黑名单", id)
+	return n.trustUpdate(func(t *trustState) {
+		t.blockMap[peerID] = true
+		delete(t.allowMap, peerID)
+	})
+}
+
+// 移出白名单和黑名单
+func (n *Node) peerForget(id string) error {
+	peerID, e := peer.Decode(id)
+	if e != nil {
+		return e
+	}
+	log.Println("移出白名单和黑名单", id)
+	return n.trustUpdate(func(t *trustState) {
+		delete(t.allowMap, peerID)
+		delete(t.blockMap, peerID)
+	})
+}
+
+// 设置信任模式
+func (n *Node) trustModeSet(mode string) error {
+	if !trustModeOk(mode) {
+		return fmt.Errorf("不支持的信任模式: %s", mode)
+	}
+	log.Println("设置信任模式", mode)
+	return n.trustUpdate(func(t *trustState) {
+		t.mode = mode
+	})
+}
+
+// 信任列表JSON
+func (n *Node) trustListJSON() (string, error) {
+	if _, _, e := n.started(); e != nil {
+		return "", e
+	}
+	n.trustMutex.RLock()
+	l := n.trust.list()
+	n.trustMutex.RUnlock()
+	jsonBytes, e := json.Marshal(l)
+	if e != nil {
+		return "", e
+	}
+	return string(jsonBytes), nil
+}
+
+// 是否拒绝连接
+func (n *Node) trustBlocked(peerID peer.ID) bool {
+	n.trustMutex.RLock()
+	defer n.trustMutex.RUnlock()
+	return n.trust != nil && n.trust.blocked(peerID)
+}
+
+// 检查对方是否可以发送文本和文件, 不可以时重置流并通知
+func (n *Node) trustStreamOk(s network.Stream) bool {
+	peerID := s.Conn().RemotePeer()
+	n.trustMutex.RLock()
+	ok := n.trust == nil || n.trust.accepted(peerID)
+	n.trustMutex.RUnlock()
+	if ok {
+		return true
+	}
+	_ = s.Reset()
+	n.trustReject(peerID, string(s.Protocol()))
+	return false
+}
+
+// 通知拒绝, 同一节点的同一协议间隔内只通知一次
+func (n *Node) trustReject(peerID peer.ID, protocol string) {
+	now := time.Now()
+	key := trustReportKey{peerID: peerID, protocol: protocol}
+	n.trustMutex.Lock()
+	if now.Sub(n.trustReportMap[key]) < trustReportInterval {
+		n.trustMutex.Unlock()
+		return
+	}
+	// 防止占用过多内存, 清理已经超过间隔的节点
+	if len(n.trustReportMap) > 1024 {
+		for k, v := range n.trustReportMap {
+			if now.Sub(v) >= trustReportInterval {
+				delete(n.trustReportMap, k)
+			}
+		}
+	}
+	n.trustReportMap[key] = now
+	n.trustMutex.Unlock()
+
+	log.Println("拒绝节点", peerID, protocol)
+	n.callback().OnOpPeerReject(peerID.Pretty(), protocol)
+}
+
+// 连接过滤, 拒绝黑名单中的节点
+type trustGater struct {
+	n *Node
+}
+
+func (g *trustGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.n.trustBlocked(p)
+}
+
+func (g *trustGater) InterceptAddrDial(peer.ID, multiaddr.Multiaddr) bool {
+	return true
+}
+
+func (g *trustGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+// 完成加密握手后才能确定对方标识
+func (g *trustGater) InterceptSecured(direction network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	if !g.n.trustBlocked(p) {
+		return true
+	}
+	if direction == network.DirInbound {
+		go g.n.trustReject(p, trustRejectConn)
+	}
+	return false
+}
+
+func (g *trustGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}